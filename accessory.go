@@ -9,6 +9,12 @@ type CalaosAccessory interface {
 	AccessoryGet() *accessory.A
 }
 
+// stoppable is implemented by accessories running timers of their own, which
+// stop when the accessories are built again
+type stoppable interface {
+	stop()
+}
+
 type CalaosGateway struct {
 	*accessory.Bridge
 }
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// HAP types of the Adaptive Lighting characteristics, not generated by brutella/hap
+const (
+	TypeCharacteristicValueTransitionControl                = "143"
+	TypeSupportedCharacteristicValueTransitionConfiguration = "144"
+	TypeCharacteristicValueActiveTransitionCount            = "24B"
+)
+
+// DefaultTransitionUpdateInterval is how often the color temperature follows
+// the curve when the controller does not tell
+const DefaultTransitionUpdateInterval = time.Minute
+
+// transitionStateFile is the file, in the HAP store directory, keeping the
+// running transitions, so that the curve goes on after a restart of the bridge
+const transitionStateFile = "transitions.json"
+
+// TLV types of the transition characteristics, as used by HomeKit controllers
+const (
+	tlvSupportedTransitionConfiguration = 0x01 // SupportedCharacteristicValueTransitionConfiguration
+	tlvSupportedCharacteristicIID       = 0x01
+	tlvSupportedTransitionType          = 0x02
+
+	tlvControlRead   = 0x01 // CharacteristicValueTransitionControl requests and responses
+	tlvControlUpdate = 0x02
+	tlvReadIID       = 0x01
+
+	tlvUpdateConfiguration = 0x01 // transition sent in an update request
+	tlvConfigIID           = 0x01
+	tlvConfigParameters    = 0x02
+	tlvConfigEnable        = 0x03
+	tlvConfigCurve         = 0x05
+	tlvConfigInterval      = 0x06
+
+	tlvCurveEntry    = 0x01
+	tlvCurveRange    = 0x03
+	tlvEntryFactor   = 0x01
+	tlvEntryValue    = 0x02
+	tlvEntryOffset   = 0x03
+	tlvEntryDuration = 0x04
+	tlvRangeMin      = 0x01
+	tlvRangeMax      = 0x02
+
+	tlvStatus           = 0x01 // status of the transition in responses
+	tlvStatusIID        = 0x01
+	tlvStatusParams     = 0x02
+	tlvStatusSinceStart = 0x03
+	tlvSeparator        = 0x00
+)
+
+// Transition types of SupportedCharacteristicValueTransitionConfiguration
+const (
+	transitionTypeBrightness       = 0x01
+	transitionTypeColorTemperature = 0x02
+)
+
+// tlvItem is an item of a TLV8 value
+type tlvItem struct {
+	Type  byte
+	Value []byte
+}
+
+// decodeTLV splits b in items, joining the fragments of values longer than 255 bytes
+func decodeTLV(b []byte) ([]tlvItem, error) {
+	var items []tlvItem
+	fragment := false // the previous item was 255 bytes long and may go on
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("truncated TLV8")
+		}
+		t, value := b[0], b[2:2+int(b[1])]
+		if fragment && items[len(items)-1].Type == t {
+			last := &items[len(items)-1]
+			last.Value = append(last.Value, value...)
+		} else {
+			items = append(items, tlvItem{t, append([]byte{}, value...)})
+		}
+		fragment = len(value) == 255
+		b = b[2+len(value):]
+	}
+	return items, nil
+}
+
+// encodeTLV joins items, splitting values longer than 255 bytes in fragments
+func encodeTLV(items ...tlvItem) []byte {
+	var b []byte
+	for _, item := range items {
+		value := item.Value
+		for {
+			n := min(len(value), 255)
+			b = append(b, item.Type, byte(n))
+			b = append(b, value[:n]...)
+			if value = value[n:]; len(value) == 0 {
+				break
+			}
+		}
+	}
+	return b
+}
+
+// tlvValue returns the value of the first item of type t
+func tlvValue(items []tlvItem, t byte) ([]byte, bool) {
+	for _, item := range items {
+		if item.Type == t {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// tlvUint reads a little endian unsigned integer of 1 to 8 bytes
+func tlvUint(b []byte) (uint64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, fmt.Errorf("invalid integer of %d bytes", len(b))
+	}
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// tlvUintBytes writes v as a little endian unsigned integer of 1, 2, 4 or 8 bytes
+func tlvUintBytes(v uint64) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, v)
+	switch {
+	case v <= math.MaxUint8:
+		return b[:1]
+	case v <= math.MaxUint16:
+		return b[:2]
+	case v <= math.MaxUint32:
+		return b[:4]
+	}
+	return b
+}
+
+// tlvFloat reads a little endian float32
+func tlvFloat(b []byte) (float64, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("invalid float of %d bytes", len(b))
+	}
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+}
+
+// transitionPoint is a point of the color temperature curve of a transition
+type transitionPoint struct {
+	Temperature float64       // mireds at the lowest brightness adjustment
+	Factor      float64       // mireds added per brightness percent
+	Offset      time.Duration // time from the previous point, interpolated
+	Duration    time.Duration // time the point is held before moving to the next one
+}
+
+// transition is the Adaptive Lighting curve sent by a controller
+type transition struct {
+	iid        uint64 // ColorTemperature
+	parameters []byte // identify the transition to the controller, sent back as is
+	start      time.Time
+	curve      []transitionPoint
+	minBright  float64 // range of the brightness adjusting the temperature
+	maxBright  float64
+	interval   time.Duration
+}
+
+// savedTransition is what is saved of a running transition
+type savedTransition struct {
+	IID        uint64
+	Parameters []byte
+	Start      time.Time
+	Curve      []transitionPoint
+	MinBright  float64
+	MaxBright  float64
+	Interval   time.Duration
+}
+
+// transitionStore guards the saved transitions of every light
+var transitionStore sync.Mutex
+
+// parseTransition reads the configuration of an update request, nil when it
+// turns Adaptive Lighting off
+func parseTransition(b []byte, start time.Time) (*transition, error) {
+	items, err := decodeTLV(b)
+	if err != nil {
+		return nil, err
+	}
+	t := transition{start: start, interval: DefaultTransitionUpdateInterval}
+	value, found := tlvValue(items, tlvConfigIID)
+	if !found {
+		return nil, errors.New("missing characteristic iid")
+	}
+	if t.iid, err = tlvUint(value); err != nil {
+		return nil, err
+	}
+	if enable, found := tlvValue(items, tlvConfigEnable); !found || len(enable) == 0 || enable[0] == 0 {
+		// Controllers only send the iid to stop the transition
+		return nil, nil
+	}
+	if t.parameters, found = tlvValue(items, tlvConfigParameters); !found {
+		return nil, errors.New("missing transition parameters")
+	}
+	if value, found := tlvValue(items, tlvConfigInterval); found {
+		ms, err := tlvUint(value)
+		if err != nil {
+			return nil, err
+		}
+		if ms > 0 {
+			t.interval = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	value, found = tlvValue(items, tlvConfigCurve)
+	if !found {
+		return nil, errors.New("missing transition curve")
+	}
+	curve, err := decodeTLV(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range curve {
+		switch item.Type {
+		case tlvCurveEntry:
+			point, err := parseTransitionPoint(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			t.curve = append(t.curve, point)
+		case tlvCurveRange:
+			bounds, err := decodeTLV(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, bound := range bounds {
+				v, err := tlvUint(bound.Value)
+				if err != nil {
+					return nil, err
+				}
+				switch bound.Type {
+				case tlvRangeMin:
+					t.minBright = float64(v)
+				case tlvRangeMax:
+					t.maxBright = float64(v)
+				}
+			}
+		}
+	}
+	if len(t.curve) < 2 {
+		return nil, errors.New("transition curve needs at least two points")
+	}
+	if t.maxBright == 0 {
+		t.minBright, t.maxBright = 0, 100
+	}
+	return &t, nil
+}
+
+// parseTransitionPoint reads an entry of the transition curve
+func parseTransitionPoint(b []byte) (transitionPoint, error) {
+	var point transitionPoint
+	items, err := decodeTLV(b)
+	if err != nil {
+		return point, err
+	}
+	for _, item := range items {
+		switch item.Type {
+		case tlvEntryFactor:
+			point.Factor, err = tlvFloat(item.Value)
+		case tlvEntryValue:
+			point.Temperature, err = tlvFloat(item.Value)
+		case tlvEntryOffset, tlvEntryDuration:
+			var ms uint64
+			ms, err = tlvUint(item.Value)
+			if item.Type == tlvEntryOffset {
+				point.Offset = time.Duration(ms) * time.Millisecond
+			} else {
+				point.Duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if err != nil {
+			return point, err
+		}
+	}
+	return point, nil
+}
+
+// temperature returns the color temperature of the curve at now for brightness,
+// false once the curve is over
+func (t *transition) temperature(now time.Time, brightness int) (float64, bool) {
+	elapsed := now.Sub(t.start)
+	var offset time.Duration // time of the lower point
+	for i := 0; i+1 < len(t.curve); i++ {
+		lower, upper := t.curve[i], t.curve[i+1]
+		offset += lower.Offset
+		if elapsed > offset+lower.Duration+upper.Offset {
+			offset += lower.Duration
+			continue
+		}
+
+		progress := 0.0
+		if moving := elapsed - offset - lower.Duration; moving > 0 && upper.Offset > 0 {
+			progress = float64(moving) / float64(upper.Offset)
+		}
+		temperature := lower.Temperature + (upper.Temperature-lower.Temperature)*progress
+		factor := lower.Factor + (upper.Factor-lower.Factor)*progress
+		adjustment := min(max(float64(brightness), t.minBright), t.maxBright)
+		return temperature + factor*adjustment, true
+	}
+	return 0, false
+}
+
+// AdaptiveLighting makes the color temperature of a light follow the curve
+// sent by a HomeKit controller when Adaptive Lighting is turned on
+type AdaptiveLighting struct {
+	Supported   *characteristic.Bytes
+	Control     *characteristic.Bytes
+	ActiveCount *characteristic.Int
+
+	brightness  *characteristic.Brightness
+	temperature *characteristic.ColorTemperature
+	apply       func(mired int) // sends a color temperature of the curve to the light
+	id          uint64          // accessory, by which the transition is saved
+	logger      *log.Entry
+
+	mu         sync.Mutex
+	transition *transition
+	timer      *time.Timer
+}
+
+// newAdaptiveLighting adds the transition characteristics to svc, a service of
+// a, and numbers the services and characteristics of a, as transitions name
+// characteristics by instance id. It must be called once every service is added.
+func newAdaptiveLighting(a *accessory.A, svc *service.S, brightness *characteristic.Brightness, temperature *characteristic.ColorTemperature, apply func(int), logger *log.Entry) *AdaptiveLighting {
+	al := AdaptiveLighting{
+		brightness:  brightness,
+		temperature: temperature,
+		apply:       apply,
+		id:          a.Id,
+		logger:      logger,
+	}
+
+	al.Supported = characteristic.NewBytes(TypeSupportedCharacteristicValueTransitionConfiguration)
+	al.Supported.Permissions = []string{characteristic.PermissionRead}
+	al.Control = characteristic.NewBytes(TypeCharacteristicValueTransitionControl)
+	al.Control.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionWriteResponse}
+	al.Control.SetValue([]byte{})
+	al.ActiveCount = characteristic.NewInt(TypeCharacteristicValueActiveTransitionCount)
+	al.ActiveCount.Format = characteristic.FormatUInt8
+	al.ActiveCount.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	al.ActiveCount.SetValue(0)
+	svc.AddC(al.Supported.C)
+	svc.AddC(al.Control.C)
+	svc.AddC(al.ActiveCount.C)
+
+	assignIIDs(a)
+	al.Supported.SetValue(encodeTLV(
+		tlvItem{tlvSupportedTransitionConfiguration, encodeTLV(
+			tlvItem{tlvSupportedCharacteristicIID, tlvUintBytes(brightness.Id)},
+			tlvItem{tlvSupportedTransitionType, []byte{transitionTypeBrightness}},
+		)},
+		tlvItem{tlvSeparator, nil},
+		tlvItem{tlvSupportedTransitionConfiguration, encodeTLV(
+			tlvItem{tlvSupportedCharacteristicIID, tlvUintBytes(temperature.Id)},
+			tlvItem{tlvSupportedTransitionType, []byte{transitionTypeColorTemperature}},
+		)},
+	))
+
+	al.Control.SetValueRequestFunc = func(v interface{}, r *http.Request) (interface{}, int) {
+		request, _ := base64.StdEncoding.DecodeString(v.(string))
+		response, err := al.control(request, time.Now())
+		if err != nil {
+			al.logger.Warnf("Invalid transition control request: %v", err)
+			return nil, hap.JsonStatusInvalidValueInRequest
+		}
+		return base64.StdEncoding.EncodeToString(response), 0
+	}
+	// Control points keep no value, so that a request written twice is handled twice
+	al.Control.OnValueUpdate(func(new, old []byte, r *http.Request) {
+		if r != nil {
+			al.Control.SetValue([]byte{})
+		}
+	})
+
+	return &al
+}
+
+// assignIIDs numbers the services and characteristics of a like hap.Server,
+// which keeps the ids already set
+func assignIIDs(a *accessory.A) {
+	var iid uint64 = 1
+	for _, s := range a.Ss {
+		if s.Id == 0 {
+			s.Id = iid
+			iid++
+		}
+		for _, c := range s.Cs {
+			if c.Id == 0 {
+				c.Id = iid
+				iid++
+			}
+		}
+	}
+}
+
+// control handles a request written to CharacteristicValueTransitionControl and returns the response
+func (al *AdaptiveLighting) control(request []byte, now time.Time) ([]byte, error) {
+	items, err := decodeTLV(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	if value, found := tlvValue(items, tlvControlRead); found {
+		read, err := decodeTLV(value)
+		if err != nil {
+			return nil, err
+		}
+		iidValue, _ := tlvValue(read, tlvReadIID)
+		iid, err := tlvUint(iidValue)
+		if err != nil {
+			return nil, err
+		}
+		al.mu.Lock()
+		if al.transition != nil && al.transition.iid == iid {
+			response = append(response, encodeTLV(tlvItem{tlvControlRead, al.status(now)})...)
+		}
+		al.mu.Unlock()
+	}
+
+	if value, found := tlvValue(items, tlvControlUpdate); found {
+		update, err := decodeTLV(value)
+		if err != nil {
+			return nil, err
+		}
+		config, found := tlvValue(update, tlvUpdateConfiguration)
+		if !found {
+			return nil, errors.New("missing transition configuration")
+		}
+		t, err := parseTransition(config, now)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil && t.iid != al.temperature.Id {
+			return nil, fmt.Errorf("transition of characteristic %d, not the color temperature", t.iid)
+		}
+
+		al.mu.Lock()
+		if t == nil {
+			al.logger.Info("Adaptive Lighting turned off")
+			al.stopLocked()
+			response = append(response, encodeTLV(tlvItem{tlvControlUpdate, nil})...)
+			al.mu.Unlock()
+		} else {
+			// A running transition is replaced, update restarts its timer
+			al.logger.Infof("Adaptive Lighting turned on, %d points updated every %s", len(t.curve), t.interval)
+			al.transition = t
+			al.ActiveCount.SetValue(1)
+			al.save()
+			response = append(response, encodeTLV(tlvItem{tlvControlUpdate, al.status(now)})...)
+			al.mu.Unlock()
+			al.update()
+		}
+	}
+	return response, nil
+}
+
+// status returns the status of the transition sent to the controller, the caller holds mu
+func (al *AdaptiveLighting) status(now time.Time) []byte {
+	t := al.transition
+	return encodeTLV(tlvItem{tlvStatus, encodeTLV(
+		tlvItem{tlvStatusIID, tlvUintBytes(t.iid)},
+		tlvItem{tlvStatusParams, t.parameters},
+		tlvItem{tlvStatusSinceStart, tlvUintBytes(uint64(now.Sub(t.start).Milliseconds()))},
+	)})
+}
+
+// Temperature returns the color temperature of the curve at brightness, false
+// when no transition is running
+func (al *AdaptiveLighting) Temperature(brightness int) (int, bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.transition == nil {
+		return 0, false
+	}
+	mired, ok := al.transition.temperature(time.Now(), brightness)
+	if !ok {
+		return 0, false
+	}
+	return al.clamp(mired), true
+}
+
+// clamp rounds mired in the range of the color temperature
+func (al *AdaptiveLighting) clamp(mired float64) int {
+	minMired, _ := al.temperature.MinVal.(int)
+	maxMired, _ := al.temperature.MaxVal.(int)
+	return min(max(int(math.Round(mired)), minMired), maxMired)
+}
+
+// update applies the color temperature of the curve and schedules the next update
+func (al *AdaptiveLighting) update() {
+	al.mu.Lock()
+	if al.transition == nil {
+		al.mu.Unlock()
+		return
+	}
+	mired, ok := al.transition.temperature(time.Now(), al.brightness.Value())
+	if !ok {
+		al.logger.Info("Adaptive Lighting curve is over")
+		al.stopLocked()
+		al.mu.Unlock()
+		return
+	}
+
+	if al.timer != nil {
+		al.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(al.transition.interval, func() {
+		al.mu.Lock()
+		current := al.timer == timer
+		al.mu.Unlock()
+		if current {
+			al.update()
+		}
+	})
+	al.timer = timer
+	al.mu.Unlock()
+
+	al.temperature.SetValue(al.clamp(mired))
+	al.apply(al.clamp(mired))
+}
+
+// Stop ends the running transition, like when the color temperature is set by hand
+func (al *AdaptiveLighting) Stop() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.transition != nil {
+		al.logger.Info("Adaptive Lighting stopped")
+	}
+	al.stopLocked()
+}
+
+// stopLocked ends the running transition, the caller holds mu
+func (al *AdaptiveLighting) stopLocked() {
+	if al.transition != nil {
+		al.forget()
+	}
+	al.transition = nil
+	if al.timer != nil {
+		al.timer.Stop()
+		al.timer = nil
+	}
+	al.ActiveCount.SetValue(0)
+}
+
+// halt stops following the curve but keeps it saved, for the light built again
+func (al *AdaptiveLighting) halt() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.transition = nil
+	if al.timer != nil {
+		al.timer.Stop()
+		al.timer = nil
+	}
+}
+
+// resume goes on with the transition saved by a previous run of the bridge
+func (al *AdaptiveLighting) resume() {
+	transitionStore.Lock()
+	st, found := al.loadSaved()[al.id]
+	transitionStore.Unlock()
+	if !found {
+		return
+	}
+	if st.IID != al.temperature.Id {
+		al.logger.Warnf("Ignoring the saved transition of characteristic %d, not the color temperature", st.IID)
+		al.forget()
+		return
+	}
+
+	al.mu.Lock()
+	al.logger.Infof("Adaptive Lighting resumed, started at %s", st.Start.Format(time.RFC3339))
+	al.transition = &transition{
+		iid:        st.IID,
+		parameters: st.Parameters,
+		start:      st.Start,
+		curve:      st.Curve,
+		minBright:  st.MinBright,
+		maxBright:  st.MaxBright,
+		interval:   st.Interval,
+	}
+	al.ActiveCount.SetValue(1)
+	al.mu.Unlock()
+	// Stops at once when the curve is over
+	al.update()
+}
+
+// save keeps the running transition across restarts, the caller holds mu
+func (al *AdaptiveLighting) save() {
+	t := al.transition
+	al.changeSaved(func(saved map[uint64]savedTransition) {
+		saved[al.id] = savedTransition{
+			IID:        t.iid,
+			Parameters: t.parameters,
+			Start:      t.start,
+			Curve:      t.curve,
+			MinBright:  t.minBright,
+			MaxBright:  t.maxBright,
+			Interval:   t.interval,
+		}
+	})
+}
+
+// forget removes the saved transition
+func (al *AdaptiveLighting) forget() {
+	al.changeSaved(func(saved map[uint64]savedTransition) { delete(saved, al.id) })
+}
+
+// changeSaved applies change to the saved transitions, by accessory id
+func (al *AdaptiveLighting) changeSaved(change func(saved map[uint64]savedTransition)) {
+	transitionStore.Lock()
+	defer transitionStore.Unlock()
+	saved := al.loadSaved()
+	change(saved)
+	if err := writeStoreFile(transitionStateFile, saved); err != nil {
+		al.logger.Errorf("Failed to save the Adaptive Lighting transition: %v", err)
+	}
+}
+
+// loadSaved reads the saved transitions by accessory id, the caller holds transitionStore
+func (al *AdaptiveLighting) loadSaved() map[uint64]savedTransition {
+	saved := map[uint64]savedTransition{}
+	if err := readStoreFile(transitionStateFile, &saved); err != nil {
+		al.logger.Warnf("Ignoring the saved Adaptive Lighting transitions: %v", err)
+	}
+	if saved == nil {
+		saved = map[uint64]savedTransition{}
+	}
+	return saved
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tlvFloatBytes(v float64) []byte {
+	return binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(v)))
+}
+
+// transitionRequest returns an update request of a controller turning
+// Adaptive Lighting on for the color temperature of acc
+func transitionRequest(acc *TunableWhiteLight, interval time.Duration, points ...transitionPoint) []byte {
+	var curve []tlvItem
+	for i, p := range points {
+		if i > 0 {
+			curve = append(curve, tlvItem{tlvSeparator, nil})
+		}
+		curve = append(curve, tlvItem{tlvCurveEntry, encodeTLV(
+			tlvItem{tlvEntryFactor, tlvFloatBytes(p.Factor)},
+			tlvItem{tlvEntryValue, tlvFloatBytes(p.Temperature)},
+			tlvItem{tlvEntryOffset, tlvUintBytes(uint64(p.Offset.Milliseconds()))},
+			tlvItem{tlvEntryDuration, tlvUintBytes(uint64(p.Duration.Milliseconds()))},
+		)})
+	}
+	curve = append(curve,
+		tlvItem{0x02, tlvUintBytes(acc.Brightness.Id)},
+		tlvItem{tlvCurveRange, encodeTLV(
+			tlvItem{tlvRangeMin, binary.LittleEndian.AppendUint32(nil, 10)},
+			tlvItem{tlvRangeMax, binary.LittleEndian.AppendUint32(nil, 100)},
+		)},
+	)
+	config := encodeTLV(
+		tlvItem{tlvConfigIID, tlvUintBytes(acc.ColorTemperature.Id)},
+		tlvItem{tlvConfigParameters, encodeTLV(
+			tlvItem{0x01, bytes.Repeat([]byte{0xab}, 16)},
+			tlvItem{0x02, binary.LittleEndian.AppendUint64(nil, 782000000000)},
+		)},
+		tlvItem{tlvConfigEnable, []byte{1}},
+		tlvItem{tlvConfigCurve, encodeTLV(curve...)},
+		tlvItem{tlvConfigInterval, binary.LittleEndian.AppendUint16(nil, uint16(interval.Milliseconds()))},
+		tlvItem{0x08, binary.LittleEndian.AppendUint32(nil, 0)},
+	)
+	return encodeTLV(tlvItem{tlvControlUpdate, encodeTLV(tlvItem{tlvUpdateConfiguration, config})})
+}
+
+// useTempTransitions keeps the transitions saved by the test in a temporary directory
+func useTempTransitions(t *testing.T) {
+	previous := hapStorePath
+	hapStorePath = t.TempDir()
+	t.Cleanup(func() { hapStorePath = previous })
+}
+
+// savedTransitions returns the saved transitions, by accessory id
+func savedTransitions(t *testing.T) map[uint64]savedTransition {
+	saved := map[uint64]savedTransition{}
+	require.NoError(t, readStoreFile(transitionStateFile, &saved))
+	return saved
+}
+
+// writeControl writes request to the transition control point like a
+// controller and returns the write response
+func writeControl(t *testing.T, al *AdaptiveLighting, request []byte) ([]byte, int) {
+	req := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+	value, status := al.Control.SetValueRequest(base64.StdEncoding.EncodeToString(request), req)
+	if status != 0 {
+		return nil, status
+	}
+	response, err := base64.StdEncoding.DecodeString(value.(string))
+	require.NoError(t, err)
+	return response, status
+}
+
+func TestTLV(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	b := encodeTLV(tlvItem{1, []byte{1, 2}}, tlvItem{2, long}, tlvItem{tlvSeparator, nil}, tlvItem{2, nil})
+	assert.Len(t, b, 4+2+255+2+45+2+2)
+
+	items, err := decodeTLV(b)
+	require.NoError(t, err)
+	assert.Equal(t, []tlvItem{{1, []byte{1, 2}}, {2, long}, {tlvSeparator, []byte{}}, {2, []byte{}}}, items)
+
+	_, err = decodeTLV([]byte{1, 5, 0})
+	assert.Error(t, err)
+
+	for _, v := range []uint64{0, 255, 256, 70000, 1 << 40} {
+		n, err := tlvUint(tlvUintBytes(v))
+		require.NoError(t, err)
+		assert.Equal(t, v, n)
+	}
+	assert.Len(t, tlvUintBytes(300), 2)
+}
+
+func TestTransition_Temperature(t *testing.T) {
+	start := time.Now()
+	tr := transition{
+		start: start,
+		curve: []transitionPoint{
+			{Temperature: 200, Factor: 0},
+			{Temperature: 300, Factor: 1, Offset: time.Hour, Duration: 30 * time.Minute},
+			{Temperature: 400, Factor: 0, Offset: time.Hour},
+		},
+		minBright: 10,
+		maxBright: 100,
+	}
+	tests := []struct {
+		elapsed    time.Duration
+		brightness int
+		mired      float64
+	}{
+		{0, 50, 200},
+		{30 * time.Minute, 50, 275},             // halfway to the second point
+		{time.Hour, 50, 350},                    // at the second point
+		{time.Hour + 15*time.Minute, 50, 350},   // held
+		{time.Hour + 15*time.Minute, 0, 310},    // brightness below the adjustment range
+		{2 * time.Hour, 50, 375},                // halfway to the last point
+		{2*time.Hour + 30*time.Minute, 50, 400}, // at the last point
+	}
+	for _, tt := range tests {
+		mired, ok := tr.temperature(start.Add(tt.elapsed), tt.brightness)
+		require.True(t, ok, tt.elapsed)
+		assert.InDelta(t, tt.mired, mired, 0.01, tt.elapsed)
+	}
+
+	_, ok := tr.temperature(start.Add(3*time.Hour), 50)
+	assert.False(t, ok)
+}
+
+func TestAdaptiveLighting_Supported(t *testing.T) {
+	acc := newTestTunableWhiteLight(nil)
+	al := acc.Adaptive
+
+	// Every service and characteristic has its own instance id
+	var ids []uint64
+	for _, s := range acc.AccessoryGet().Ss {
+		ids = append(ids, s.Id)
+		for _, c := range s.Cs {
+			ids = append(ids, c.Id)
+		}
+	}
+	seen := map[uint64]bool{}
+	for _, id := range ids {
+		assert.NotZero(t, id)
+		assert.False(t, seen[id], "iid %d used twice", id)
+		seen[id] = true
+	}
+
+	items, err := decodeTLV(al.Supported.Value())
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	for i, want := range []struct {
+		iid  uint64
+		kind byte
+	}{{acc.Brightness.Id, transitionTypeBrightness}, {acc.ColorTemperature.Id, transitionTypeColorTemperature}} {
+		config, err := decodeTLV(items[2*i].Value)
+		require.NoError(t, err)
+		iid, _ := tlvValue(config, tlvSupportedCharacteristicIID)
+		kind, _ := tlvValue(config, tlvSupportedTransitionType)
+		assert.Equal(t, tlvUintBytes(want.iid), iid)
+		assert.Equal(t, []byte{want.kind}, kind)
+	}
+	assert.Equal(t, 0, al.ActiveCount.Value())
+}
+
+func TestAdaptiveLighting_Control(t *testing.T) {
+	useTempTransitions(t)
+	commands := captureCommands(t)
+	acc := newTestTunableWhiteLight(map[string]string{"strip-warm": "80", "strip-cold": "80"})
+	al := acc.Adaptive
+
+	// Nothing to read before a transition is set
+	read := encodeTLV(tlvItem{tlvControlRead, encodeTLV(tlvItem{tlvReadIID, tlvUintBytes(acc.ColorTemperature.Id)})})
+	response, status := writeControl(t, al, read)
+	require.Zero(t, status)
+	assert.Empty(t, response)
+
+	request := transitionRequest(acc, time.Minute,
+		transitionPoint{Temperature: 370},
+		transitionPoint{Temperature: 153, Offset: time.Hour},
+	)
+	response, status = writeControl(t, al, request)
+	require.Zero(t, status)
+	assert.Equal(t, 1, al.ActiveCount.Value())
+	assert.Equal(t, []string{"strip-warm=set 80", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+	assert.Equal(t, 370, acc.ColorTemperature.Value())
+
+	items, err := decodeTLV(response)
+	require.NoError(t, err)
+	update, found := tlvValue(items, tlvControlUpdate)
+	require.True(t, found)
+	items, err = decodeTLV(update)
+	require.NoError(t, err)
+	value, _ := tlvValue(items, tlvStatus)
+	statusItems, err := decodeTLV(value)
+	require.NoError(t, err)
+	iid, _ := tlvValue(statusItems, tlvStatusIID)
+	assert.Equal(t, tlvUintBytes(acc.ColorTemperature.Id), iid)
+	params, _ := tlvValue(statusItems, tlvStatusParams)
+	assert.Len(t, params, 2+16+2+8)
+
+	// The same request is handled again, and the transition can be read
+	_, status = writeControl(t, al, request)
+	require.Zero(t, status)
+	nextCommands(t, commands, 2)
+	response, _ = writeControl(t, al, read)
+	items, err = decodeTLV(response)
+	require.NoError(t, err)
+	_, found = tlvValue(items, tlvControlRead)
+	assert.True(t, found)
+
+	// The brightness adjusts the temperature at once
+	remoteSet(acc.Brightness.C, 50)
+	assert.Equal(t, []string{"strip-warm=set 50", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+
+	// Setting the temperature by hand stops the transition
+	remoteSet(acc.ColorTemperature.C, 153)
+	assert.Equal(t, []string{"strip-warm=set 0", "strip-cold=set 50"}, nextCommands(t, commands, 2))
+	assert.Equal(t, 0, al.ActiveCount.Value())
+	response, _ = writeControl(t, al, read)
+	assert.Empty(t, response)
+}
+
+func TestAdaptiveLighting_Updates(t *testing.T) {
+	useTempTransitions(t)
+	commands := captureCommands(t)
+	acc := newTestTunableWhiteLight(nil)
+	al := acc.Adaptive
+
+	// Off, the temperature of the curve is kept for when the light is turned on
+	_, status := writeControl(t, al, transitionRequest(acc, 20*time.Millisecond,
+		transitionPoint{Temperature: 153},
+		transitionPoint{Temperature: 153, Offset: 100 * time.Millisecond},
+	))
+	require.Zero(t, status)
+	remoteSet(acc.Lightbulb.Lightbulb.On.C, true)
+	assert.Equal(t, []string{"strip-warm=set 0", "strip-cold=set 100"}, nextCommands(t, commands, 2))
+
+	// Ticks once the light is on, then the curve is over
+	require.NoError(t, acc.Update(&CalaosIO{ID: "strip-cold", State: "100"}))
+	assert.Equal(t, []string{"strip-warm=set 0", "strip-cold=set 100"}, nextCommands(t, commands, 2))
+	require.Eventually(t, func() bool {
+		return al.ActiveCount.Value() == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Empty(t, savedTransitions(t))
+
+	// Only the iid turns Adaptive Lighting off
+	writeControl(t, al, transitionRequest(acc, time.Minute,
+		transitionPoint{Temperature: 153},
+		transitionPoint{Temperature: 153, Offset: time.Hour},
+	))
+	off := encodeTLV(tlvItem{tlvControlUpdate, encodeTLV(tlvItem{tlvUpdateConfiguration, encodeTLV(
+		tlvItem{tlvConfigIID, tlvUintBytes(acc.ColorTemperature.Id)},
+	)})})
+	response, status := writeControl(t, al, off)
+	require.Zero(t, status)
+	assert.Equal(t, []byte{tlvControlUpdate, 0}, response)
+	assert.Equal(t, 0, al.ActiveCount.Value())
+}
+
+func TestAdaptiveLighting_Resume(t *testing.T) {
+	useTempTransitions(t)
+	commands := captureCommands(t)
+	on := map[string]string{"strip-warm": "80", "strip-cold": "80"}
+	acc := newTestTunableWhiteLight(on)
+	request := transitionRequest(acc, time.Minute,
+		transitionPoint{Temperature: 370, Duration: time.Hour},
+		transitionPoint{Temperature: 153, Offset: time.Hour},
+	)
+	_, status := writeControl(t, acc.Adaptive, request)
+	require.Zero(t, status)
+	nextCommands(t, commands, 2)
+	id := acc.Lightbulb.Id
+	saved, found := savedTransitions(t)[id]
+	require.True(t, found)
+
+	// The light built again, or after a restart, follows the saved curve
+	acc.stop()
+	acc = newTestTunableWhiteLight(on)
+	assert.Equal(t, 1, acc.Adaptive.ActiveCount.Value())
+	assert.Equal(t, []string{"strip-warm=set 80", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+	read := encodeTLV(tlvItem{tlvControlRead, encodeTLV(tlvItem{tlvReadIID, tlvUintBytes(acc.ColorTemperature.Id)})})
+	response, _ := writeControl(t, acc.Adaptive, read)
+	assert.NotEmpty(t, response)
+
+	// Setting the temperature by hand forgets it
+	remoteSet(acc.ColorTemperature.C, 153)
+	nextCommands(t, commands, 2)
+	assert.Empty(t, savedTransitions(t))
+	acc = newTestTunableWhiteLight(on)
+	assert.Equal(t, 0, acc.Adaptive.ActiveCount.Value())
+
+	// A saved curve which is over is forgotten
+	saved.Start = saved.Start.Add(-3 * time.Hour)
+	require.NoError(t, writeStoreFile(transitionStateFile, map[uint64]savedTransition{id: saved}))
+	acc = newTestTunableWhiteLight(on)
+	assert.Equal(t, 0, acc.Adaptive.ActiveCount.Value())
+	assert.Empty(t, savedTransitions(t))
+	noCommand(t, commands, 20*time.Millisecond)
+}
+
+func TestAdaptiveLighting_InvalidRequests(t *testing.T) {
+	acc := newTestTunableWhiteLight(nil)
+	al := acc.Adaptive
+
+	wrongIID := transitionRequest(acc, time.Minute, transitionPoint{}, transitionPoint{Offset: time.Hour})
+	acc.ColorTemperature.Id++
+	defer func() { acc.ColorTemperature.Id-- }()
+	for _, request := range [][]byte{
+		{0x02, 0x05, 0x01},
+		encodeTLV(tlvItem{tlvControlUpdate, nil}),
+		wrongIID,
+	} {
+		_, status := writeControl(t, al, request)
+		assert.NotZero(t, status, request)
+	}
+	assert.Equal(t, 0, al.ActiveCount.Value())
+}
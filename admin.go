@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/brutella/hap/service"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminPath is where the HTTP server serves the admin page when HTTP.Admin is set
+const AdminPath = "/admin"
+
+//go:embed admin.html
+var adminPage string
+
+var adminTemplate = template.Must(template.New("admin").Parse(adminPage))
+
+// CharacteristicReport is the value of a HomeKit characteristic
+type CharacteristicReport struct {
+	Service string      `json:"service"`
+	Name    string      `json:"name"`
+	Value   interface{} `json:"value"`
+}
+
+// IOReport describes a Calaos IO and how it is exposed in HomeKit
+type IOReport struct {
+	Room            string                 `json:"room"`
+	IO              CalaosIO               `json:"io"`
+	Mapped          bool                   `json:"mapped"`
+	AccessoryType   string                 `json:"accessory_type,omitempty"`
+	AccessoryID     uint64                 `json:"accessory_id,omitempty"`
+	HomeKitName     string                 `json:"homekit_name,omitempty"`
+	Characteristics []CharacteristicReport `json:"characteristics,omitempty"`
+	SkipReason      string                 `json:"skip_reason,omitempty"`
+}
+
+// reportIO describes the IO of a room exposed by accs, skipped gives why it may not be
+// and routes the IOs of composite accessories
+func reportIO(room string, cio CalaosIO, accs map[uint64]CalaosAccessory, skipped map[string]string, routes map[string]uint64) IOReport {
+	report := IOReport{Room: room, IO: cio}
+	id := accessoryIDFor(routes, cio.ID)
+	acc, found := accs[id]
+	if !found {
+		report.SkipReason = skipped[cio.ID]
+		return report
+	}
+
+	report.Mapped = true
+	report.AccessoryType = accessoryTypeName(acc)
+	report.AccessoryID = id
+	a := acc.AccessoryGet()
+	if a == nil {
+		return report
+	}
+	report.HomeKitName = a.Name()
+	for _, s := range a.Ss {
+		if s.Type == service.TypeAccessoryInformation {
+			continue
+		}
+		for _, c := range s.Cs {
+			report.Characteristics = append(report.Characteristics, CharacteristicReport{
+				Service: hapTypeName(serviceNames, s.Type),
+				Name:    hapTypeName(characteristicNames, c.Type),
+				Value:   c.Value(),
+			})
+		}
+	}
+	return report
+}
+
+// reportIOs describes every IO of the last get_home, the caller holds stateMu
+func reportIOs() []IOReport {
+	return reportHome(home, accessories, skippedIOs, compositeIOs(config))
+}
+
+// reportHome describes every IO of h exposed by accs
+func reportHome(h CalaosJsonMsgHome, accs map[uint64]CalaosAccessory, skipped map[string]string, routes map[string]uint64) []IOReport {
+	reports := []IOReport{}
+	for _, room := range h.Data.Home {
+		for _, cio := range room.IOs {
+			reports = append(reports, reportIO(room.Name, cio, accs, skipped, routes))
+		}
+	}
+	return reports
+}
+
+// hapTypeName returns the name of a HAP type, or the type itself when unknown
+func hapTypeName(names map[string]string, typ string) string {
+	if name, found := names[typ]; found {
+		return name
+	}
+	return fmt.Sprintf("Type %s", typ)
+}
+
+// requireAdminAccess protects the admin page, which shows the live state of
+// the home: with the API token as bearer token or basic auth password when
+// one is set, to loopback clients only otherwise
+func requireAdminAccess(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "the admin page is only served on loopback without HTTP.APIToken", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			_, got, found = r.BasicAuth()
+		}
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="calaos-homekit"`)
+			http.Error(w, "invalid or missing API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	data := struct {
+		BridgeName string
+		Status     StatusSnapshot
+		IOs        []IOReport
+	}{config.BridgeName, status.Snapshot(), reportIOs()}
+	stateMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(w, data); err != nil {
+		log.Errorf("Failed to render admin page: %v", err)
+	}
+}
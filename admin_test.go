@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupAdminTest exposes the test home with a few IOs that cannot be mapped
+func setupAdminTest(t *testing.T) {
+	home = setupTestHome()
+	home.Data.Home[1].IOs = append(home.Data.Home[1].IOs,
+		CalaosIO{ID: "test-io-5", Name: "Scenario", GuiType: "scenario", Visible: "true"},
+		CalaosIO{ID: "test-io-6", Name: "Luminosity", GuiType: CalaosGuiTypeAnalogIn, IoStyle: "luminosity", Visible: "true"},
+		CalaosIO{ID: "test-io-7", Name: "Excluded", GuiType: CalaosGuiTypeTemp, Visible: "true"},
+	)
+	config = setupTestConfig()
+	config.IOs = map[string]IOConfig{"test-io-7": {Exclude: true}}
+	accessories = make(map[uint64]CalaosAccessory)
+	setupCalaosHome()
+}
+
+func TestReportIOs(t *testing.T) {
+	setupAdminTest(t)
+
+	reports := reportIOs()
+	require.Len(t, reports, 7)
+
+	light := reports[0]
+	assert.Equal(t, "Test Room", light.Room)
+	assert.True(t, light.Mapped)
+	assert.Equal(t, "LightDimmer", light.AccessoryType)
+	assert.Equal(t, uint64(murmur.Sum32("test-io-1")), light.AccessoryID)
+	assert.Equal(t, "Test Light", light.HomeKitName)
+	assert.Contains(t, light.Characteristics, CharacteristicReport{Service: "Lightbulb", Name: "On", Value: true})
+	assert.Contains(t, light.Characteristics, CharacteristicReport{Service: "Lightbulb", Name: "Brightness", Value: 50})
+
+	reasons := map[string]string{}
+	for _, r := range reports {
+		if !r.Mapped {
+			reasons[r.IO.ID] = r.SkipReason
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"test-io-3": SkipHidden,
+		"test-io-5": `gui_type "scenario" is not supported`,
+		"test-io-6": `io_style "luminosity" is not supported for gui_type "analog_in"`,
+		"test-io-7": SkipExcluded,
+	}, reasons)
+}
+
+func TestAdminPage(t *testing.T) {
+	setupAdminTest(t)
+
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{Admin: true}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + AdminPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), "<h1>Test Bridge</h1>")
+	assert.Contains(t, string(body), "Lightbulb / Brightness: 50")
+	assert.Contains(t, string(body), "not exposed: gui_type &#34;scenario&#34; is not supported")
+}
+
+func TestAdminPage_Access(t *testing.T) {
+	setupAdminTest(t)
+	get := func(cfg HTTPConfig, remoteAddr string, auth func(r *http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, AdminPath, nil)
+		req.RemoteAddr = remoteAddr
+		if auth != nil {
+			auth(req)
+		}
+		rec := httptest.NewRecorder()
+		newHTTPHandler(cfg).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a token, only loopback clients see the page
+	cfg := HTTPConfig{Admin: true}
+	assert.Equal(t, http.StatusOK, get(cfg, "127.0.0.1:40000", nil))
+	assert.Equal(t, http.StatusOK, get(cfg, "[::1]:40000", nil))
+	assert.Equal(t, http.StatusForbidden, get(cfg, "192.168.1.20:40000", nil))
+
+	// With a token, every client needs it
+	cfg.APIToken = testAPIToken
+	assert.Equal(t, http.StatusUnauthorized, get(cfg, "127.0.0.1:40000", nil))
+	assert.Equal(t, http.StatusUnauthorized, get(cfg, "192.168.1.20:40000", func(r *http.Request) {
+		r.SetBasicAuth("admin", "wrong")
+	}))
+	assert.Equal(t, http.StatusOK, get(cfg, "192.168.1.20:40000", func(r *http.Request) {
+		r.SetBasicAuth("admin", testAPIToken)
+	}))
+	assert.Equal(t, http.StatusOK, get(cfg, "192.168.1.20:40000", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAPIToken)
+	}))
+}
+
+func TestAdminPage_Disabled(t *testing.T) {
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + AdminPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MinAPITokenLength is the minimum length of HTTP.APIToken
+const MinAPITokenLength = 16
+
+// MaxAPIBodySize limits the size of REST API requests
+const MaxAPIBodySize = 4096
+
+// AccessoryReport describes an accessory exposed in HomeKit
+type AccessoryReport struct {
+	ID              uint64                 `json:"id"`
+	Type            string                 `json:"type"`
+	Name            string                 `json:"name"`
+	IOs             []string               `json:"ios"`
+	Characteristics []CharacteristicReport `json:"characteristics"`
+}
+
+// StateRequest is the body of POST /ios/{id}/state
+type StateRequest struct {
+	State string `json:"state"`
+}
+
+// apiError is the body of REST API errors
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// registerAPI adds the REST API routes to mux, protected by token
+func registerAPI(mux *http.ServeMux, token string) {
+	auth := func(h http.HandlerFunc) http.Handler {
+		return requireToken(token, h)
+	}
+	mux.Handle("GET /ios", auth(apiGetIOs))
+	mux.Handle("GET /ios/{id}", auth(apiGetIO))
+	mux.Handle("POST /ios/{id}/state", auth(apiSetState))
+	mux.Handle("GET /accessories", auth(apiGetAccessories))
+}
+
+// requireToken answers 401 to requests without "Authorization: Bearer <token>"
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calaos-homekit"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing API token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write API response: %v", err)
+	}
+}
+
+func apiGetIOs(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	reports := reportIOs()
+	stateMu.Unlock()
+	writeJSON(w, http.StatusOK, reports)
+}
+
+func apiGetIO(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, room := range home.Data.Home {
+		for _, cio := range room.IOs {
+			if cio.ID == id {
+				writeJSON(w, http.StatusOK, reportIO(room.Name, cio, accessories, skippedIOs, compositeIOs(config)))
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusNotFound, apiError{"unknown IO " + id})
+}
+
+func apiSetState(w http.ResponseWriter, r *http.Request) {
+	var req StateRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxAPIBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid body: " + err.Error()})
+		return
+	}
+	if req.State == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"state is required"})
+		return
+	}
+
+	id := r.PathValue("id")
+	stateMu.Lock()
+	session := loggedin
+	cio := getIOFromId(id)
+	var target CalaosIO
+	if cio != nil {
+		target = *cio
+	}
+	stateMu.Unlock()
+	if !session {
+		// Calaos ignores commands sent before logging in
+		writeJSON(w, http.StatusServiceUnavailable, apiError{"not logged in to Calaos"})
+		return
+	}
+	if cio == nil {
+		writeJSON(w, http.StatusNotFound, apiError{"unknown IO " + id})
+		return
+	}
+
+	target.State = req.State
+	log.WithField("io_id", id).Infof("API sets state %q", req.State)
+	if err := CalaosUpdate(target); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrNotConnected) {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, apiError{err.Error()})
+		return
+	}
+	// Calaos confirms the new state with an event
+	writeJSON(w, http.StatusAccepted, StateRequest{State: req.State})
+}
+
+func apiGetAccessories(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	reports := reportIOs()
+	stateMu.Unlock()
+
+	byID := map[uint64]*AccessoryReport{}
+	list := []*AccessoryReport{}
+	for _, report := range reports {
+		if !report.Mapped {
+			continue
+		}
+		acc, found := byID[report.AccessoryID]
+		if !found {
+			acc = &AccessoryReport{
+				ID:              report.AccessoryID,
+				Type:            report.AccessoryType,
+				Name:            report.HomeKitName,
+				Characteristics: report.Characteristics,
+			}
+			byID[report.AccessoryID] = acc
+			list = append(list, acc)
+		}
+		acc.IOs = append(acc.IOs, report.IO.ID)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+const testAPIToken = "0123456789abcdef"
+
+// setupAPITest serves the REST API with websocketClient connected to a FakeCalaos
+func setupAPITest(t *testing.T) (string, *fakeCommands) {
+	setupAdminTest(t)
+	commands := captureCommands(t)
+	loggedin = true
+	t.Cleanup(func() { loggedin = false })
+
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{APIToken: testAPIToken}))
+	t.Cleanup(srv.Close)
+	return srv.URL, commands
+}
+
+func apiRequest(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(b)
+}
+
+func TestAPI_Token(t *testing.T) {
+	url, _ := setupAPITest(t)
+
+	code, _ := apiRequest(t, http.MethodGet, url+"/ios", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = apiRequest(t, http.MethodGet, url+"/ios", "wrong-token-0000", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = apiRequest(t, http.MethodGet, url+"/ios", testAPIToken, "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestAPI_Disabled(t *testing.T) {
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{}))
+	defer srv.Close()
+
+	code, _ := apiRequest(t, http.MethodGet, srv.URL+"/ios", testAPIToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAPI_GetIOs(t *testing.T) {
+	url, _ := setupAPITest(t)
+
+	code, body := apiRequest(t, http.MethodGet, url+"/ios", testAPIToken, "")
+	require.Equal(t, http.StatusOK, code)
+	var ios []IOReport
+	require.NoError(t, json.Unmarshal([]byte(body), &ios))
+	assert.Len(t, ios, 7)
+
+	code, body = apiRequest(t, http.MethodGet, url+"/ios/test-io-2", testAPIToken, "")
+	require.Equal(t, http.StatusOK, code)
+	var report IOReport
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, "22.5", report.IO.State)
+	assert.Equal(t, "Temp", report.AccessoryType)
+
+	code, _ = apiRequest(t, http.MethodGet, url+"/ios/unknown", testAPIToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAPI_SetState(t *testing.T) {
+	url, commands := setupAPITest(t)
+
+	code, body := apiRequest(t, http.MethodPost, url+"/ios/test-io-1/state", testAPIToken, `{"state": "set 30"}`)
+	require.Equal(t, http.StatusAccepted, code, body)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "test-io-1", id)
+	assert.Equal(t, "set 30", value)
+
+	// The Calaos state changes when Calaos sends the event
+	assert.Equal(t, "50", getIOFromId("test-io-1").State)
+
+	code, _ = apiRequest(t, http.MethodPost, url+"/ios/unknown/state", testAPIToken, `{"state": "true"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = apiRequest(t, http.MethodPost, url+"/ios/test-io-1/state", testAPIToken, `{"value": "true"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = apiRequest(t, http.MethodPost, url+"/ios/test-io-1/state", testAPIToken, `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	websocketClient.isConnected.Store(false)
+	code, _ = apiRequest(t, http.MethodPost, url+"/ios/test-io-1/state", testAPIToken, `{"state": "true"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestAPI_SetState_NotLoggedIn(t *testing.T) {
+	url, commands := setupAPITest(t)
+	withState(func() { loggedin = false })
+
+	// Connected, but Calaos would ignore the command
+	code, body := apiRequest(t, http.MethodPost, url+"/ios/test-io-1/state", testAPIToken, `{"state": "set 30"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "not logged in")
+	noCommand(t, commands, 50*time.Millisecond)
+}
+
+func TestAPI_GetAccessories(t *testing.T) {
+	url, _ := setupAPITest(t)
+
+	code, body := apiRequest(t, http.MethodGet, url+"/accessories", testAPIToken, "")
+	require.Equal(t, http.StatusOK, code)
+	var list []AccessoryReport
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list, 3)
+
+	for _, acc := range list {
+		if acc.ID == uint64(murmur.Sum32("test-io-4")) {
+			assert.Equal(t, "LightDimmer", acc.Type)
+			assert.Equal(t, "Second Room Light", acc.Name)
+			assert.Equal(t, []string{"test-io-4"}, acc.IOs)
+			return
+		}
+	}
+	t.Fatal("test-io-4 accessory not listed")
+}
+
+func TestValidateHTTPConfig_APIToken(t *testing.T) {
+	assert.Len(t, validateHTTPConfig(HTTPConfig{APIToken: "short"}), 1)
+	assert.Empty(t, validateHTTPConfig(HTTPConfig{APIToken: testAPIToken}))
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Exit codes of the subcommands, see also ExitAuthFailed and ExitConfigError
+const (
+	ExitOK          = 0
+	ExitUsage       = 64 // EX_USAGE
+	ExitUnavailable = 69 // EX_UNAVAILABLE
+)
+
+// Command is a calaos-homekit subcommand, it returns the process exit code
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands = []Command{
+	{
+		Name:  "check-config",
+		Usage: "validate a configuration file, and optionally log in to Calaos",
+		Run:   runCheckConfig,
+	},
+	{
+		Name:  "list-ios",
+		Usage: "log in to Calaos and list the IOs with the accessories that would expose them",
+		Run:   runListIOs,
+	},
+	{
+		Name:  "dump-home",
+		Usage: "log in to Calaos and print its get_home answer",
+		Run:   runDumpHome,
+	},
+	{
+		Name:  "simulate",
+		Usage: "run a fake Calaos server from a dump-home file, for development",
+		Run:   runSimulate,
+	},
+}
+
+// printUsage describes the bridge flags and the subcommands
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: calaos-homekit [-config file]")
+	fmt.Fprintln(out, "       calaos-homekit <command> [arguments]")
+	fmt.Fprintln(out)
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.Name, cmd.Usage)
+	}
+}
+
+// runCommand runs the subcommand named by args[0], found is false
+// when args do not start with a subcommand and the bridge should run
+func runCommand(args []string) (code int, found bool) {
+	if len(args) == 0 {
+		return ExitOK, false
+	}
+	for _, cmd := range commands {
+		if cmd.Name == args[0] {
+			return cmd.Run(args[1:], os.Stdout, os.Stderr), true
+		}
+	}
+	return ExitOK, false
+}
+
+// runCheckConfig implements "calaos-homekit check-config [-connect] [file]"
+func runCheckConfig(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	filename := fs.String("config", "./config.json", "configuration file to check")
+	connect := fs.Bool("connect", false, "also connect and log in to the Calaos server")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calaos-homekit check-config [-connect] [-config file | file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return ExitUsage
+	}
+	if fs.NArg() == 1 {
+		*filename = fs.Arg(0)
+	}
+
+	cfg, code := loadCommandConfig(*filename, stderr)
+	if code != ExitOK {
+		return code
+	}
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", *filename)
+
+	if !*connect {
+		return ExitOK
+	}
+
+	conn, code := connectCommand(cfg, stderr)
+	if code != ExitOK {
+		return code
+	}
+	conn.Close()
+	uri, _, _ := calaosEndpoint(cfg.WebSocketServer)
+	fmt.Fprintf(stdout, "Logged in to %s as %q\n", uri, cfg.WebSocketServer.User)
+	return ExitOK
+}
+
+// loadCommandConfig loads the configuration of a subcommand and reports its errors
+func loadCommandConfig(filename string, stderr io.Writer) (Configuration, int) {
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(stderr, e)
+			}
+		} else {
+			fmt.Fprintln(stderr, err)
+		}
+		return cfg, ExitConfigError
+	}
+	return cfg, ExitOK
+}
+
+// connectCommand connects and logs in to Calaos for a subcommand, which closes the connection
+func connectCommand(cfg Configuration, stderr io.Writer) (*websocket.Conn, int) {
+	uri, _, _ := calaosEndpoint(cfg.WebSocketServer)
+	conn, err := dialCalaos(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to connect to %s: %v\n", uri, err)
+		return nil, ExitUnavailable
+	}
+
+	if err := loginOnce(conn, cfg); err != nil {
+		conn.Close()
+		fmt.Fprintf(stderr, "Failed to log in to %s as %q: %v\n", uri, cfg.WebSocketServer.User, err)
+		if errors.Is(err, ErrLoginRejected) {
+			return nil, ExitAuthFailed
+		}
+		return nil, ExitUnavailable
+	}
+	return conn, ExitOK
+}
+
+// fetchHome connects to Calaos and returns its get_home answer for a subcommand
+func fetchHome(cfg Configuration, stderr io.Writer) ([]byte, int) {
+	conn, code := connectCommand(cfg, stderr)
+	if code != ExitOK {
+		return nil, code
+	}
+	defer conn.Close()
+
+	data, err := getHomeOnce(conn, cfg.Login.Timeout.Duration)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to get the home from Calaos: %v\n", err)
+		return nil, ExitUnavailable
+	}
+	return data, ExitOK
+}
+
+// getHomeOnce sends get_home on a logged in conn and waits for the answer of Calaos
+func getHomeOnce(conn *websocket.Conn, timeout time.Duration) ([]byte, error) {
+	msg, err := json.Marshal(CalaosJsonGetHomeRequest{Msg: CalaosMsgTypeGetHome, MsgID: CalaosMsgIDGetHome})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("no answer to get_home after %s: %w", timeout, err)
+		}
+		var reply CalaosJsonMsg
+		if err := json.Unmarshal(data, &reply); err == nil && reply.Msg == CalaosMsgTypeGetHome {
+			return data, nil
+		}
+	}
+}
+
+// runListIOs implements "calaos-homekit list-ios [-json] [-config file]"
+func runListIOs(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("list-ios", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	filename := fs.String("config", "./config.json", "configuration file")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calaos-homekit list-ios [-json] [-config file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	cfg, code := loadCommandConfig(*filename, stderr)
+	if code != ExitOK {
+		return code
+	}
+	data, code := fetchHome(cfg, stderr)
+	if code != ExitOK {
+		return code
+	}
+	var h CalaosJsonMsgHome
+	if err := json.Unmarshal(data, &h); err != nil {
+		fmt.Fprintf(stderr, "Invalid get_home answer: %v\n", err)
+		return ExitUnavailable
+	}
+
+	accs, skipped := buildAccessories(h, cfg)
+	reports := reportHome(h, accs, skipped, compositeIOs(cfg))
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+		return ExitOK
+	}
+	printIOTable(stdout, reports)
+	return ExitOK
+}
+
+// printIOTable prints reports as a table, one IO per line
+func printIOTable(w io.Writer, reports []IOReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tIO\tNAME\tGUI_TYPE\tIO_STYLE\tVISIBLE\tACCESSORY\tACCESSORY_ID")
+	exposed := 0
+	for _, r := range reports {
+		accessory, id := "-", "-"
+		if r.Mapped {
+			accessory, id = r.AccessoryType, strconv.FormatUint(r.AccessoryID, 10)
+			exposed++
+		} else if r.SkipReason != "" {
+			accessory = "(" + r.SkipReason + ")"
+		}
+		visible := r.IO.Visible != CalaosVisibleFalse
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			r.Room, r.IO.ID, r.IO.Name, r.IO.GuiType, orDash(r.IO.IoStyle), visible, accessory, id)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d IOs, %d exposed in HomeKit\n", len(reports), exposed)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runDumpHome implements "calaos-homekit dump-home [-config file]"
+func runDumpHome(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dump-home", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	filename := fs.String("config", "./config.json", "configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calaos-homekit dump-home [-config file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	cfg, code := loadCommandConfig(*filename, stderr)
+	if code != ExitOK {
+		return code
+	}
+	data, code := fetchHome(cfg, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		fmt.Fprintf(stderr, "Invalid get_home answer: %v\n", err)
+		return ExitUnavailable
+	}
+	out.WriteString("\n")
+	out.WriteTo(stdout)
+	return ExitOK
+}
+
+// runSimulate implements "calaos-homekit simulate -home file [-listen addr] [-user user -password password]"
+func runSimulate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	homeFile := fs.String("home", "", "home fixture, as printed by dump-home")
+	listen := fs.String("listen", "127.0.0.1:5454", "address to listen on")
+	user := fs.String("user", "", "user to accept, any credentials are accepted when empty")
+	password := fs.String("password", "", "password to accept")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calaos-homekit simulate -home file [-listen addr] [-user user -password password]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() > 0 || *homeFile == "" {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	h, err := LoadFakeHome(*homeFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return ExitConfigError
+	}
+
+	fake := NewFakeCalaos(h, *user, *password)
+	fake.OnSetState = func(id, value, state string) {
+		fmt.Fprintf(stdout, "set_state %s %q -> %q\n", id, value, state)
+	}
+	url, err := fake.Start(*listen)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to listen on %s: %v\n", *listen, err)
+		return ExitUnavailable
+	}
+	defer fake.Close()
+	fmt.Fprintf(stdout, "Fake Calaos listening on %s, press Ctrl+C to stop\n", url)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	return ExitOK
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// newTestLoginServer starts a websocket server answering login messages,
+// and get_home messages with the test home
+func newTestLoginServer(t *testing.T, success string) string {
+	homeMsg := setupTestHome()
+	homeMsg.Msg, homeMsg.MsgID = CalaosMsgTypeGetHome, CalaosMsgIDGetHome
+	homeData, err := json.Marshal(homeMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg CalaosJsonMsg
+			if json.Unmarshal(data, &msg) == nil && msg.Msg == CalaosMsgTypeLogin {
+				answer := fmt.Sprintf(`{"msg": "login", "msg_id": "1", "data": {"success": "%s"}}`, success)
+				conn.WriteMessage(websocket.TextMessage, []byte(answer))
+			}
+			if msg.Msg == CalaosMsgTypeGetHome {
+				conn.WriteMessage(websocket.TextMessage, homeData)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "ws://", 1) + "/api"
+}
+
+func checkConfigTestFile(t *testing.T, url string) string {
+	return writeTestConfig(t, "config.json", fmt.Sprintf(`{
+    "WebSocketServer": {
+        "URL": %q,
+        "Proxy": "none",
+        "User": "user",
+        "Password": "pass"
+    },
+    "Login": {
+        "Timeout": "1s"
+    },
+    "PinCode": "63613161"
+}`, url))
+}
+
+func TestRunCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   func(t *testing.T) []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "Valid file as argument",
+			args:   func(t *testing.T) []string { return []string{"config.json"} },
+			code:   ExitOK,
+			stdout: "config.json: configuration is valid",
+		},
+		{
+			name: "Invalid file",
+			args: func(t *testing.T) []string {
+				return []string{"-config", writeTestConfig(t, "config.json", "{\n  \"PinCode\": \"1\"\n}")}
+			},
+			code:   ExitConfigError,
+			stderr: "config.json:2: PinCode: must be 8 digits",
+		},
+		{
+			name:   "Too many arguments",
+			args:   func(t *testing.T) []string { return []string{"a.json", "b.json"} },
+			code:   ExitUsage,
+			stderr: "Usage: calaos-homekit check-config",
+		},
+		{
+			name: "Login accepted",
+			args: func(t *testing.T) []string {
+				return []string{"-connect", checkConfigTestFile(t, newTestLoginServer(t, "true"))}
+			},
+			code:   ExitOK,
+			stdout: "Logged in to ws://",
+		},
+		{
+			name: "Login rejected",
+			args: func(t *testing.T) []string {
+				return []string{"-connect", checkConfigTestFile(t, newTestLoginServer(t, "false"))}
+			},
+			code:   ExitAuthFailed,
+			stderr: ErrLoginRejected.Error(),
+		},
+		{
+			name: "Server unreachable",
+			args: func(t *testing.T) []string {
+				return []string{"-connect", checkConfigTestFile(t, "ws://127.0.0.1:1/api")}
+			},
+			code:   ExitUnavailable,
+			stderr: "Failed to connect to ws://127.0.0.1:1/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCheckConfig(tt.args(t), &stdout, &stderr)
+			assert.Equal(t, tt.code, code, stderr.String())
+			assert.Contains(t, stdout.String(), tt.stdout)
+			assert.Contains(t, stderr.String(), tt.stderr)
+		})
+	}
+}
+
+func TestRunCommand_NotACommand(t *testing.T) {
+	_, found := runCommand(nil)
+	assert.False(t, found)
+	_, found = runCommand([]string{"-config", "config.json"})
+	assert.False(t, found)
+}
+
+func TestRunListIOs(t *testing.T) {
+	filename := checkConfigTestFile(t, newTestLoginServer(t, "true"))
+
+	var stdout, stderr bytes.Buffer
+	code := runListIOs([]string{"-config", filename}, &stdout, &stderr)
+	require.Equal(t, ExitOK, code, stderr.String())
+
+	lines := strings.Split(stdout.String(), "\n")
+	assert.Regexp(t, `^ROOM +IO +NAME +GUI_TYPE +IO_STYLE +VISIBLE +ACCESSORY +ACCESSORY_ID$`, lines[0])
+	assert.Regexp(t, fmt.Sprintf(`^Test Room +test-io-1 +Test Light +light_dimmer +- +true +LightDimmer +%d$`, murmur.Sum32("test-io-1")), lines[1])
+	assert.Regexp(t, `^Test Room +test-io-3 +Hidden IO +light +- +false +\(hidden in Calaos\) +-$`, lines[3])
+	assert.Contains(t, stdout.String(), "4 IOs, 3 exposed in HomeKit")
+
+	stdout.Reset()
+	code = runListIOs([]string{"-json", "-config", filename}, &stdout, &stderr)
+	require.Equal(t, ExitOK, code, stderr.String())
+	var reports []IOReport
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &reports))
+	require.Len(t, reports, 4)
+	assert.Equal(t, "Temp", reports[1].AccessoryType)
+	assert.Equal(t, "Second Room", reports[3].Room)
+}
+
+func TestRunListIOs_LoginRejected(t *testing.T) {
+	filename := checkConfigTestFile(t, newTestLoginServer(t, "false"))
+
+	var stdout, stderr bytes.Buffer
+	code := runListIOs([]string{"-config", filename}, &stdout, &stderr)
+	assert.Equal(t, ExitAuthFailed, code)
+	assert.Empty(t, stdout.String())
+}
+
+func TestRunDumpHome(t *testing.T) {
+	filename := checkConfigTestFile(t, newTestLoginServer(t, "true"))
+
+	var stdout, stderr bytes.Buffer
+	code := runDumpHome([]string{"-config", filename}, &stdout, &stderr)
+	require.Equal(t, ExitOK, code, stderr.String())
+
+	var h CalaosJsonMsgHome
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &h))
+	assert.Equal(t, setupTestHome().Data.Home, h.Data.Home)
+	assert.Contains(t, stdout.String(), "\n  \"data\": {")
+}
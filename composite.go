@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vcaesar/murmur"
+)
+
+// Composite accessories are built from several Calaos IOs listed in a
+// configuration section, like a garage door made of an impulse output and
+// position contacts. Their IOs are not exposed on their own: the events of
+// every IO update the composite accessory, whose id comes from its main IO.
+
+// compositeConfig is an entry of a configuration section of composite accessories
+type compositeConfig interface {
+	// ios returns the ids of the IOs of the accessory, the main one first
+	ios() []string
+	// newAccessory creates the accessory from the IOs of the home, by id
+	newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory
+}
+
+// composite is a composite accessory and the configuration field describing it
+type composite struct {
+	Field string
+	compositeConfig
+}
+
+// compositeConfigs returns the composite accessories of cfg
+func compositeConfigs(cfg Configuration) []composite {
+	var list []composite
+	for i, c := range cfg.GarageDoors {
+		list = append(list, composite{fmt.Sprintf("GarageDoors[%d]", i), c})
+	}
+	for i, c := range cfg.Locks {
+		list = append(list, composite{fmt.Sprintf("Locks[%d]", i), c})
+	}
+	for i, c := range cfg.SecuritySystems {
+		list = append(list, composite{fmt.Sprintf("SecuritySystems[%d]", i), c})
+	}
+	for i, c := range cfg.Doorbells {
+		list = append(list, composite{fmt.Sprintf("Doorbells[%d]", i), c})
+	}
+	for i, c := range cfg.IrrigationSystems {
+		list = append(list, composite{fmt.Sprintf("IrrigationSystems[%d]", i), c})
+	}
+	for i, c := range cfg.MultiSpeedFans {
+		list = append(list, composite{fmt.Sprintf("MultiSpeedFans[%d]", i), c})
+	}
+	for i, c := range cfg.HeatPumps {
+		list = append(list, composite{fmt.Sprintf("HeatPumps[%d]", i), c})
+	}
+	for i, c := range cfg.TunableWhiteLights {
+		list = append(list, composite{fmt.Sprintf("TunableWhiteLights[%d]", i), c})
+	}
+	return list
+}
+
+// compositeIOs returns the id of the composite accessory fed by each IO of cfg composites
+func compositeIOs(cfg Configuration) map[string]uint64 {
+	routes := map[string]uint64{}
+	for _, c := range compositeConfigs(cfg) {
+		ios := c.ios()
+		if len(ios) == 0 {
+			// Rejected by validateConfig
+			continue
+		}
+		id := uint64(murmur.Sum32(ios[0]))
+		for _, ioID := range ios {
+			routes[ioID] = id
+		}
+	}
+	return routes
+}
+
+// accessoryIDFor returns the id of the accessory fed by the IO ioID, routes
+// are the IOs of composite accessories
+func accessoryIDFor(routes map[string]uint64, ioID string) uint64 {
+	if id, found := routes[ioID]; found {
+		return id
+	}
+	return uint64(murmur.Sum32(ioID))
+}
+
+// homeIOs returns the IOs of every room of h by id, states overrides the state of some of them
+func homeIOs(h CalaosJsonMsgHome, states map[string]string) map[string]CalaosIO {
+	ios := map[string]CalaosIO{}
+	for _, room := range h.Data.Home {
+		for _, cio := range room.IOs {
+			if state, found := states[cio.ID]; found {
+				cio.State = state
+			}
+			ios[cio.ID] = cio
+		}
+	}
+	return ios
+}
+
+// buildComposites adds the composite accessories of cfg to accs. A composite
+// with an IO missing from h is not exposed, skipped says why for its other IOs.
+func buildComposites(h CalaosJsonMsgHome, cfg Configuration, accs map[uint64]CalaosAccessory, skipped map[string]string) {
+	ios := homeIOs(h, nil)
+	for ioID, cio := range ios {
+		if override := cfg.IOs[ioID].Name; override != "" {
+			cio.Name = override
+			ios[ioID] = cio
+		}
+	}
+
+	for _, c := range compositeConfigs(cfg) {
+		if len(c.ios()) == 0 {
+			continue
+		}
+		var missing []string
+		for _, ioID := range c.ios() {
+			if _, found := ios[ioID]; !found {
+				missing = append(missing, ioID)
+			}
+		}
+		if len(missing) > 0 {
+			reason := fmt.Sprintf("%s needs IO %s, not found in Calaos", c.Field, strings.Join(missing, ", "))
+			for _, ioID := range c.ios() {
+				if _, found := ios[ioID]; found {
+					skipped[ioID] = reason
+				}
+			}
+			continue
+		}
+
+		id := uint64(murmur.Sum32(c.ios()[0]))
+		accs[id] = c.newAccessory(ios, id)
+	}
+}
+
+// validateComposites checks that every IO belongs to a single composite accessory
+func validateComposites(cfg Configuration) []error {
+	var errs []error
+	owners := map[string]string{}
+	for _, c := range compositeConfigs(cfg) {
+		for _, ioID := range c.ios() {
+			if ioID == "" {
+				continue
+			}
+			if owner, found := owners[ioID]; found {
+				errs = append(errs, &ConfigError{Field: c.Field, Msg: fmt.Sprintf("IO %s is already used by %s", ioID, owner)})
+				continue
+			}
+			owners[ioID] = c.Field
+		}
+	}
+	return errs
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+func TestComposites(t *testing.T) {
+	tests := []struct {
+		name      string
+		home      CalaosJsonMsgHome
+		configure func(cfg *Configuration)
+		typ       string // accessory type
+		homeKit   string // name shown in HomeKit
+		category  byte   // accessory category, unchecked when 0
+	}{
+		{
+			name: "garage door",
+			home: setupGarageHome(),
+			configure: func(cfg *Configuration) {
+				cfg.GarageDoors = []GarageDoorConfig{garageConfig("garage-closed", "garage-open")}
+			},
+			typ:     "GarageDoor",
+			homeKit: "Garage door",
+		},
+		{
+			name: "lock",
+			home: setupLockHome(),
+			configure: func(cfg *Configuration) {
+				cfg.Locks = []LockConfig{lockConfig("lock-status", 0)}
+			},
+			typ:      "Lock",
+			homeKit:  "Front door",
+			category: accessory.TypeDoorLock,
+		},
+		{
+			name: "security system",
+			home: setupAlarmHome(),
+			configure: func(cfg *Configuration) {
+				cfg.SecuritySystems = []SecuritySystemConfig{alarmConfig()}
+			},
+			typ:      "SecuritySystem",
+			homeKit:  "Alarm",
+			category: accessory.TypeSecuritySystem,
+		},
+		{
+			name: "doorbell",
+			home: setupDoorbellHome(),
+			configure: func(cfg *Configuration) {
+				cfg.Doorbells = []DoorbellConfig{{Name: "Doorbell", Button: "bell"}}
+			},
+			typ:      "Doorbell",
+			homeKit:  "Doorbell",
+			category: accessory.TypeOther,
+		},
+		{
+			name: "irrigation system",
+			home: setupIrrigationHome(),
+			configure: func(cfg *Configuration) {
+				cfg.IrrigationSystems = []IrrigationSystemConfig{{
+					Name:  "Garden",
+					Zones: []IrrigationZoneConfig{{Output: "zone-lawn"}, {Output: "zone-hedge"}},
+				}}
+			},
+			typ:      "IrrigationSystem",
+			homeKit:  "Garden",
+			category: accessory.TypeSprinkler,
+		},
+		{
+			name: "multi-speed fan",
+			home: setupVentilationHome(),
+			configure: func(cfg *Configuration) {
+				cfg.MultiSpeedFans = []MultiSpeedFanConfig{{Name: "VMC", Outputs: []string{"vmc-low", "vmc-high"}}}
+			},
+			typ:      "MultiSpeedFan",
+			homeKit:  "VMC",
+			category: accessory.TypeFan,
+		},
+		{
+			name: "heat pump",
+			home: setupHeatPumpHome(),
+			configure: func(cfg *Configuration) {
+				cfg.HeatPumps = []HeatPumpConfig{{Name: "PAC", Mode: "pac-mode", Setpoint: "pac-setpoint", Temperature: "pac-temp"}}
+			},
+			typ:      "HeatPump",
+			homeKit:  "PAC",
+			category: accessory.TypeAirConditioner,
+		},
+		{
+			name: "tunable white light",
+			home: setupLedStripHome(),
+			configure: func(cfg *Configuration) {
+				cfg.TunableWhiteLights = []TunableWhiteLightConfig{{Name: "Strip", Warm: "strip-warm", Cold: "strip-cold"}}
+			},
+			typ:      "TunableWhiteLight",
+			homeKit:  "Strip",
+			category: accessory.TypeLightbulb,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := setupTestConfig()
+			tt.configure(&cfg)
+			setConfigDefaults(&cfg)
+			composites := compositeConfigs(cfg)
+			require.Len(t, composites, 1)
+			ios := composites[0].ios()
+			id := uint64(murmur.Sum32(ios[0]))
+
+			accs, skipped := buildAccessories(tt.home, cfg)
+			require.Contains(t, accs, id)
+			assert.Equal(t, tt.typ, accessoryTypeName(accs[id]))
+			assert.Equal(t, tt.homeKit, accs[id].AccessoryGet().Name())
+			if tt.category != 0 {
+				assert.Equal(t, tt.category, accs[id].AccessoryGet().Type)
+			}
+			// The other IOs are only exposed through the composite
+			for _, ioID := range ios[1:] {
+				assert.NotContains(t, accs, uint64(murmur.Sum32(ioID)), ioID)
+				assert.NotContains(t, skipped, ioID)
+			}
+		})
+	}
+}
+
+func TestComposite_Routing(t *testing.T) {
+	cfg := setupTestConfig()
+	cfg.GarageDoors = []GarageDoorConfig{garageConfig("garage-closed", "garage-open")}
+	h := setupGarageHome()
+	id := uint64(murmur.Sum32("garage-cmd"))
+
+	accs, skipped := buildAccessories(h, cfg)
+	require.Contains(t, accs, id)
+
+	// Every IO of the door is reported as exposed by it
+	for _, report := range reportHome(h, accs, skipped, compositeIOs(cfg)) {
+		if report.Room == "Garage" {
+			assert.True(t, report.Mapped, report.IO.ID)
+			assert.Equal(t, id, report.AccessoryID)
+		}
+	}
+
+	// Events of the contacts update the door
+	withState(func() {
+		config, home = cfg, h
+		accessories, skippedIOs = accs, skipped
+	})
+	t.Cleanup(func() { withState(func() { config, accessories = Configuration{}, nil }) })
+	event := `{"msg": "event", "data": {"data": {"id": "%s", "state": "%s"}}}`
+	withState(func() {
+		require.NoError(t, handleEventMessage([]byte(fmt.Sprintf(event, "garage-open", "false"))))
+		require.NoError(t, handleEventMessage([]byte(fmt.Sprintf(event, "garage-closed", "true"))))
+	})
+	current, _, _ := doorState(accs[id].(*GarageDoor))
+	assert.Equal(t, characteristic.CurrentDoorStateClosed, current)
+
+	// A missing IO leaves the door out
+	cfg.GarageDoors[0].OpenSensor = "garage-gone"
+	accs, skipped = buildAccessories(h, cfg)
+	assert.NotContains(t, accs, id)
+	assert.Equal(t, "GarageDoors[0] needs IO garage-gone, not found in Calaos", skipped["garage-cmd"])
+}
+
+func TestValidateComposites(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *Configuration)
+		messages  []string
+		defaults  func(t *testing.T, cfg Configuration) // checks the defaults, when set
+	}{
+		{
+			name: "garage doors",
+			configure: func(cfg *Configuration) {
+				cfg.GarageDoors = []GarageDoorConfig{
+					{Command: "garage-cmd", ClosedSensor: "garage-closed"},
+					{TravelTime: Duration{-time.Second}},
+					{Command: "other-cmd", OpenSensor: "garage-closed"},
+				}
+			},
+			messages: []string{
+				"GarageDoors[1].Command: is required",
+				"GarageDoors[1].ClosedSensor: is required when OpenSensor is not set",
+				"GarageDoors[1].TravelTime: must be positive",
+				"GarageDoors[2]: IO garage-closed is already used by GarageDoors[0]",
+			},
+			defaults: func(t *testing.T, cfg Configuration) {
+				assert.Equal(t, DefaultGarageDoorPulse, cfg.GarageDoors[0].Pulse.Duration)
+				assert.Equal(t, DefaultGarageDoorTravelTime, cfg.GarageDoors[0].TravelTime.Duration)
+			},
+		},
+		{
+			name: "locks",
+			configure: func(cfg *Configuration) {
+				cfg.Locks = []LockConfig{
+					{Command: "lock-cmd"},
+					{Pulse: Duration{time.Second}, Timeout: Duration{-time.Second}},
+					{Command: "lock-cmd", Pulse: Duration{-time.Second}},
+				}
+			},
+			messages: []string{
+				"Locks[1].Command: is required",
+				"Locks[1].Status: is required with Pulse, an impulse does not tell the lock state",
+				"Locks[1].Timeout: must be positive",
+				"Locks[2].Pulse: must be positive",
+				"Locks[2]: IO lock-cmd is already used by Locks[0]",
+			},
+			defaults: func(t *testing.T, cfg Configuration) {
+				assert.Equal(t, DefaultLockTimeout, cfg.Locks[0].Timeout.Duration)
+			},
+		},
+		{
+			name: "security systems",
+			configure: func(cfg *Configuration) {
+				cfg.SecuritySystems = []SecuritySystemConfig{
+					alarmConfig(),
+					{ArmAway: "other-away"},
+					{State: "other-state"},
+				}
+			},
+			messages: []string{
+				"SecuritySystems[1].State: is required",
+				"SecuritySystems[1].Disarm: is required with arm commands",
+			},
+		},
+		{
+			name: "doorbells",
+			configure: func(cfg *Configuration) {
+				cfg.Doorbells = []DoorbellConfig{{Button: "bell"}, {Name: "Back door"}, {Button: "gate", Ring: "release"}}
+			},
+			messages: []string{
+				"Doorbells[1].Button: is required",
+				`Doorbells[2].Ring: must be "press" or "toggle", got "release"`,
+			},
+			defaults: func(t *testing.T, cfg Configuration) {
+				assert.Equal(t, DoorbellRingPress, cfg.Doorbells[0].Ring)
+			},
+		},
+		{
+			name: "irrigation systems",
+			configure: func(cfg *Configuration) {
+				cfg.IrrigationSystems = []IrrigationSystemConfig{
+					{Zones: []IrrigationZoneConfig{{Output: "zone-lawn"}}},
+					{Name: "Empty"},
+					{Zones: []IrrigationZoneConfig{{Duration: Duration{2 * time.Hour}}, {Output: "zone-lawn"}}},
+				}
+			},
+			messages: []string{
+				"IrrigationSystems[1].Zones: at least one zone is required",
+				"IrrigationSystems[2].Zones[0].Output: is required",
+				"IrrigationSystems[2].Zones[0].Duration: must be between 0 and 1h0m0s",
+				"IrrigationSystems[2]: IO zone-lawn is already used by IrrigationSystems[0]",
+			},
+		},
+		{
+			name: "multi-speed fans",
+			configure: func(cfg *Configuration) {
+				cfg.MultiSpeedFans = []MultiSpeedFanConfig{
+					{Outputs: []string{"vmc-low", "vmc-high"}, Speeds: [][]string{{"vmc-low"}, {"vmc-low", "vmc-high"}}},
+					{},
+					{Outputs: []string{"a", ""}, Speeds: [][]string{{}, {"a", "z"}, {"z", "a"}}},
+				}
+			},
+			messages: []string{
+				"MultiSpeedFans[1].Outputs: at least one output is required",
+				"MultiSpeedFans[2].Outputs[1]: IO id cannot be empty",
+				"MultiSpeedFans[2].Speeds[0]: at least one output is required, the fan is off when none is on",
+				"MultiSpeedFans[2].Speeds[1]: IO z is not in Outputs",
+				"MultiSpeedFans[2].Speeds[2]: IO z is not in Outputs",
+				"MultiSpeedFans[2].Speeds[2]: same outputs as Speeds[1]",
+			},
+		},
+		{
+			name: "heat pumps",
+			configure: func(cfg *Configuration) {
+				cfg.HeatPumps = []HeatPumpConfig{
+					{Mode: "pac-mode", Setpoint: "pac-setpoint", Temperature: "pac-temp"},
+					{},
+					{Mode: "m", Setpoint: "s", Temperature: "t", Modes: map[string]int{"dry": 4, "heat": 1, "auto": 1}},
+					{Mode: "m2", Setpoint: "s2", Temperature: "t2", Modes: map[string]int{"off": 0}},
+				}
+			},
+			messages: []string{
+				"HeatPumps[1].Mode: is required",
+				"HeatPumps[1].Setpoint: is required",
+				"HeatPumps[1].Temperature: is required",
+				`HeatPumps[2].Modes: unknown mode "dry", must be off, heat, cool or auto`,
+				"HeatPumps[2].Modes: auto and heat have the same value 1",
+				"HeatPumps[2].Modes: off is required",
+				"HeatPumps[3].Modes: heat or cool is required",
+			},
+		},
+		{
+			name: "tunable white lights",
+			configure: func(cfg *Configuration) {
+				cfg.TunableWhiteLights = []TunableWhiteLightConfig{
+					{Warm: "strip-warm", Cold: "strip-cold"},
+					{},
+					{Warm: "w", Cold: "c", WarmMired: 200, ColdMired: 300},
+					{Warm: "w2", Cold: "c2", WarmMired: 2000, ColdMired: 10},
+				}
+			},
+			messages: []string{
+				"TunableWhiteLights[1].Warm: is required",
+				"TunableWhiteLights[1].Cold: is required",
+				"TunableWhiteLights[2].WarmMired: must be greater than ColdMired, warmer light has more mireds",
+				"TunableWhiteLights[3].ColdMired: must be between 50 and 1000",
+				"TunableWhiteLights[3].WarmMired: must be between 50 and 1000",
+			},
+			defaults: func(t *testing.T, cfg Configuration) {
+				assert.Equal(t, DefaultTunableWhiteWarmMired, cfg.TunableWhiteLights[0].WarmMired)
+				assert.Equal(t, DefaultTunableWhiteColdMired, cfg.TunableWhiteLights[0].ColdMired)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := setupTestConfig()
+			cfg.PinCode = "63613161"
+			tt.configure(&cfg)
+			setConfigDefaults(&cfg)
+			if tt.defaults != nil {
+				tt.defaults(t, cfg)
+			}
+
+			var messages []string
+			for _, err := range validateConfig(&cfg) {
+				messages = append(messages, err.Error())
+			}
+			assert.ElementsMatch(t, tt.messages, messages)
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/hap"
+	log "github.com/sirupsen/logrus"
+)
+
+// Configuration defaults
+const (
+	DefaultCalaosPort = 5454
+	DefaultBridgeName = "Calaos Gateway"
+)
+
+type WebSocketConfig struct {
+	URL      string // full Calaos API URL, overrides Scheme, Host and Port when set
+	Host     string
+	Port     int
+	Scheme   string // ws or wss, defaults to wss on port 443 and ws otherwise
+	User     string
+	Password string
+	TLS      TLSConfig
+	Proxy    string            // proxy URL, "none" to disable, defaults to HTTP(S)_PROXY
+	Headers  map[string]string // extra headers sent with the websocket handshake
+}
+
+type LoginConfig struct {
+	Timeout     Duration // time to wait for the login answer, 10s by default
+	RetryDelay  Duration // delay before retrying rejected credentials, 30s by default
+	MaxAttempts int      // rejected logins before exiting, 5 by default, -1 retries forever
+}
+
+// IOConfig overrides how a Calaos IO is exposed in HomeKit
+type IOConfig struct {
+	Name    string // name shown in HomeKit instead of the Calaos name
+	Exclude bool   // do not expose the IO in HomeKit
+}
+
+type Configuration struct {
+	WebSocketServer    WebSocketConfig
+	Login              LoginConfig
+	Log                LogConfig
+	HTTP               HTTPConfig
+	Health             HealthConfig
+	PinCode            string
+	BridgeName         string
+	IOs                map[string]IOConfig // overrides by Calaos IO id
+	GarageDoors        []GarageDoorConfig
+	Locks              []LockConfig
+	SecuritySystems    []SecuritySystemConfig
+	Doorbells          []DoorbellConfig
+	IrrigationSystems  []IrrigationSystemConfig
+	MultiSpeedFans     []MultiSpeedFanConfig
+	HeatPumps          []HeatPumpConfig
+	TunableWhiteLights []TunableWhiteLightConfig
+	WatchConfig        bool // reload the configuration when its files change
+
+	files []string // files read to build the configuration, for WatchConfig
+}
+
+// Duration is a time.Duration read from configuration as a string like "30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// ConfigError is a configuration problem, located at Line when it is known
+type ConfigError struct {
+	File  string
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		if e.Line > 0 {
+			b.WriteString(":" + strconv.Itoa(e.Line))
+		}
+		b.WriteString(": ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ConfigErrors lists every problem found in a configuration file
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// logConfigErrors logs each configuration problem on its own line
+func logConfigErrors(err error) {
+	var errs ConfigErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			log.Error(e)
+		}
+		return
+	}
+	log.Errorf("Invalid configuration: %v", err)
+}
+
+// loadConfig reads, completes and validates a configuration file in JSON,
+// YAML or TOML. Errors are returned as ConfigErrors.
+func loadConfig(filename string) (Configuration, error) {
+	var cfg Configuration
+
+	reader := configReader{}
+	values, lines, err := reader.read(filename, nil)
+	if err != nil {
+		return cfg, ConfigErrors{err.(*ConfigError)}
+	}
+	cfg.files = reader.files
+
+	locate := func(err error) *ConfigError {
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			cerr = &ConfigError{Msg: err.Error()}
+		}
+		if cerr.File == "" {
+			cerr.File = filename
+		}
+		if loc := lines.find(cerr.Field); cerr.Field != "" && loc != nil {
+			cerr.File, cerr.Line = loc.File, loc.Line
+		}
+		return cerr
+	}
+
+	if err := decodeConfig(values, &cfg, lines); err != nil {
+		return cfg, ConfigErrors{locate(err)}
+	}
+
+	setConfigDefaults(&cfg)
+
+	if err := resolveSecrets(&cfg); err != nil {
+		return cfg, ConfigErrors{locate(err)}
+	}
+
+	var errs ConfigErrors
+	for _, err := range validateConfig(&cfg) {
+		errs = append(errs, locate(err))
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// decodeConfig strictly decodes the parsed configuration into cfg,
+// rejecting unknown fields
+func decodeConfig(values map[string]interface{}, cfg *Configuration, lines configLines) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ConfigError{
+			Field: typeErr.Field,
+			Msg:   fmt.Sprintf("expected a %s, got a %s", typeErr.Type, typeErr.Value),
+		}
+	}
+	if m := unknownFieldRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return &ConfigError{Field: unknownFieldPath(lines, m[1]), Msg: "unknown field"}
+	}
+	return &ConfigError{Msg: err.Error()}
+}
+
+// unknownFieldPath returns the full path of a key named field
+func unknownFieldPath(lines configLines, field string) string {
+	var paths []string
+	for p := range lines {
+		if p == field || strings.HasSuffix(p, "."+field) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return field
+	}
+	sort.Strings(paths)
+	return paths[0]
+}
+
+// setConfigDefaults fills the optional fields left empty
+func setConfigDefaults(cfg *Configuration) {
+	if cfg.WebSocketServer.URL == "" && cfg.WebSocketServer.Port == 0 {
+		cfg.WebSocketServer.Port = DefaultCalaosPort
+	}
+	if cfg.BridgeName == "" {
+		cfg.BridgeName = DefaultBridgeName
+	}
+	if cfg.Login.Timeout.Duration == 0 {
+		cfg.Login.Timeout.Duration = DefaultLoginTimeout
+	}
+	if cfg.Login.RetryDelay.Duration == 0 {
+		cfg.Login.RetryDelay.Duration = DefaultLoginRetryDelay
+	}
+	if cfg.Login.MaxAttempts == 0 {
+		cfg.Login.MaxAttempts = DefaultLoginMaxAttempts
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = log.InfoLevel.String()
+	}
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = LogFormatText
+	}
+	if cfg.Log.MaxSize == 0 {
+		cfg.Log.MaxSize = DefaultLogMaxSize
+	}
+	if cfg.Log.MaxBackups == 0 {
+		cfg.Log.MaxBackups = DefaultLogMaxBackups
+	}
+	if cfg.Health.Grace.Duration == 0 {
+		cfg.Health.Grace.Duration = DefaultHealthGrace
+	}
+	setGarageDoorDefaults(cfg.GarageDoors)
+	setLockDefaults(cfg.Locks)
+	setDoorbellDefaults(cfg.Doorbells)
+	setHeatPumpDefaults(cfg.HeatPumps)
+	setTunableWhiteLightDefaults(cfg.TunableWhiteLights)
+}
+
+// validateLogConfig checks the Log section, also used for command line overrides
+func validateLogConfig(cfg LogConfig) []error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if _, err := log.ParseLevel(cfg.Level); err != nil {
+		fail("Log.Level", "%v", err)
+	}
+	if cfg.Format != LogFormatText && cfg.Format != LogFormatJSON {
+		fail("Log.Format", "must be %q or %q, got %q", LogFormatText, LogFormatJSON, cfg.Format)
+	}
+	if cfg.MaxSize < 0 {
+		fail("Log.MaxSize", "must be positive")
+	}
+	if cfg.MaxBackups < 0 {
+		fail("Log.MaxBackups", "must be positive")
+	}
+	for name, level := range cfg.Components {
+		if !isLogComponent(name) {
+			fail("Log.Components."+name, "unknown component, expected one of %s", strings.Join(logComponents, ", "))
+		} else if _, err := log.ParseLevel(level); err != nil {
+			fail("Log.Components."+name, "%v", err)
+		}
+	}
+
+	return errs
+}
+
+var pinCodeRegexp = regexp.MustCompile(`^[0-9]{8}$`)
+
+// validateConfig checks every field and returns all the problems found
+func validateConfig(cfg *Configuration) []error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	ws := cfg.WebSocketServer
+	if ws.URL == "" {
+		if ws.Host == "" {
+			fail("WebSocketServer.Host", "is required when URL is not set")
+		}
+		if ws.Port < 1 || ws.Port > 65535 {
+			fail("WebSocketServer.Port", "must be between 1 and 65535, got %d", ws.Port)
+		}
+	}
+	if ws.Scheme != "" && ws.Scheme != URITypeWS && ws.Scheme != URITypeWSS {
+		fail("WebSocketServer.Scheme", "must be %q or %q, got %q", URITypeWS, URITypeWSS, ws.Scheme)
+	} else if _, _, err := calaosEndpoint(ws); err != nil {
+		fail("WebSocketServer.URL", "%v", err)
+	}
+	if ws.User == "" {
+		fail("WebSocketServer.User", "is required")
+	}
+	if ws.Password == "" {
+		fail("WebSocketServer.Password", "is required")
+	}
+	tlsConfig := ws.TLS
+	tlsConfig.InsecureSkipVerify = false // only check the files, the warning is logged when dialing
+	if _, err := newTLSConfig(tlsConfig); err != nil {
+		fail("WebSocketServer.TLS", "%v", err)
+	}
+	if ws.Proxy != "" && ws.Proxy != ProxyNone {
+		if _, err := newCalaosDialer(WebSocketConfig{Proxy: ws.Proxy}); err != nil {
+			fail("WebSocketServer.Proxy", "%v", err)
+		}
+	}
+
+	if cfg.Login.Timeout.Duration < 0 {
+		fail("Login.Timeout", "must be positive")
+	}
+	if cfg.Login.RetryDelay.Duration < 0 {
+		fail("Login.RetryDelay", "must be positive")
+	}
+	if cfg.Login.MaxAttempts < -1 {
+		fail("Login.MaxAttempts", "must be -1 (forever) or a positive number")
+	}
+
+	errs = append(errs, validateLogConfig(cfg.Log)...)
+	errs = append(errs, validateHTTPConfig(cfg.HTTP)...)
+	if cfg.Health.Grace.Duration < 0 {
+		fail("Health.Grace", "must be positive")
+	}
+
+	for id := range cfg.IOs {
+		if id == "" {
+			fail("IOs", "IO id cannot be empty")
+		}
+	}
+	errs = append(errs, validateGarageDoors(cfg.GarageDoors)...)
+	errs = append(errs, validateLocks(cfg.Locks)...)
+	errs = append(errs, validateSecuritySystems(cfg.SecuritySystems)...)
+	errs = append(errs, validateDoorbells(cfg.Doorbells)...)
+	errs = append(errs, validateIrrigationSystems(cfg.IrrigationSystems)...)
+	errs = append(errs, validateMultiSpeedFans(cfg.MultiSpeedFans)...)
+	errs = append(errs, validateHeatPumps(cfg.HeatPumps)...)
+	errs = append(errs, validateTunableWhiteLights(cfg.TunableWhiteLights)...)
+	errs = append(errs, validateComposites(*cfg)...)
+
+	if cfg.PinCode == "" {
+		fail("PinCode", "is required")
+	} else if !pinCodeRegexp.MatchString(cfg.PinCode) {
+		fail("PinCode", "must be 8 digits")
+	} else if hap.InvalidPins[cfg.PinCode] {
+		fail("PinCode", "%s is too easy to guess and refused by HomeKit", cfg.PinCode)
+	}
+
+	return errs
+}
+
+// jsonKeyLines maps the path of every object key in data to its line.
+// Paths are dotted, array elements are indexed: "Bridges[1].Name".
+func jsonKeyLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	type container struct {
+		path      string
+		object    bool
+		expectKey bool
+		key       string // path of the value being read in an object
+		index     int    // index of the value being read in an array
+	}
+	var stack []*container
+
+	valuePath := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			return top.key
+		}
+		return fmt.Sprintf("%s[%d]", top.path, top.index)
+	}
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			top.expectKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return lines
+		}
+
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.object && top.expectKey {
+				if key, ok := tok.(string); ok {
+					top.key = key
+					if top.path != "" {
+						top.key = top.path + "." + key
+					}
+					lines[top.key] = lineAtOffset(data, skipToToken(data, offset))
+					top.expectKey = false
+					continue
+				}
+			}
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, &container{path: valuePath(), object: true, expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &container{path: valuePath()})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+// skipToToken returns the offset of the first significant byte after offset
+func skipToToken(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// lineAtOffset returns the 1-based line of a byte offset in data
+func lineAtOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
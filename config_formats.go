@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigIncludeKey lists the fragment files merged into a configuration file
+const ConfigIncludeKey = "Include"
+
+// configLines maps the path of every configuration key to where it is defined
+type configLines map[string]*ConfigError
+
+// find returns the location of path, keys are matched without case like encoding/json does
+func (l configLines) find(path string) *ConfigError {
+	if loc, found := l[path]; found {
+		return loc
+	}
+	for p, loc := range l {
+		if strings.EqualFold(p, path) {
+			return loc
+		}
+	}
+	return nil
+}
+
+// configReader reads a configuration file and its includes
+type configReader struct {
+	files []string // files and include directories read so far
+}
+
+// read parses a configuration file in JSON, YAML or TOML depending
+// on its extension, expands environment variables and merges its includes.
+// JSON files are read as is, so existing config.json files keep working
+// with a $ in their values.
+func (r *configReader) read(filename string, parents []string) (map[string]interface{}, configLines, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, nil, &ConfigError{File: filename, Msg: err.Error()}
+	}
+	for _, p := range parents {
+		if p == abs {
+			return nil, nil, &ConfigError{File: filename, Msg: "include cycle: " + strings.Join(append(parents, abs), " -> ")}
+		}
+	}
+
+	r.files = append(r.files, filename)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, &ConfigError{File: filename, Msg: err.Error()}
+	}
+
+	var values map[string]interface{}
+	var lines map[string]int
+	expandEnv := true
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		values, lines, err = parseYAMLConfig(data)
+	case ".toml":
+		values, lines, err = parseTOMLConfig(data)
+	default:
+		values, lines, err = parseJSONConfig(data)
+		expandEnv = false
+	}
+	if err != nil {
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			cerr = &ConfigError{Msg: err.Error()}
+		}
+		cerr.File = filename
+		return nil, nil, cerr
+	}
+
+	locations := configLines{}
+	for path, line := range lines {
+		locations[path] = &ConfigError{File: filename, Line: line}
+	}
+	locate := func(err *ConfigError) *ConfigError {
+		err.File = filename
+		if loc := locations.find(err.Field); loc != nil {
+			err.Line = loc.Line
+		}
+		return err
+	}
+
+	if expandEnv {
+		if err := expandConfigEnv(values, ""); err != nil {
+			return nil, nil, locate(err)
+		}
+	}
+
+	includes, dirs, cerr := configIncludes(values, filename)
+	if cerr != nil {
+		return nil, nil, locate(cerr)
+	}
+	r.files = append(r.files, dirs...)
+
+	merged := map[string]interface{}{}
+	mergedLines := configLines{}
+	for _, include := range includes {
+		v, l, err := r.read(include, append(parents, abs))
+		if err != nil {
+			return nil, nil, err
+		}
+		mergeConfigValues(merged, mergedLines, v, l, "")
+	}
+	mergeConfigValues(merged, mergedLines, values, locations, "")
+
+	return merged, mergedLines, nil
+}
+
+// configIncludes removes the include key from values and returns the
+// files it lists, relative to the including file. Glob patterns are
+// expanded, their directories are returned as dirs.
+func configIncludes(values map[string]interface{}, filename string) (files, dirs []string, cerr *ConfigError) {
+	var key string
+	for k := range values {
+		if strings.EqualFold(k, ConfigIncludeKey) {
+			key = k
+		}
+	}
+	if key == "" {
+		return nil, nil, nil
+	}
+	raw := values[key]
+	delete(values, key)
+
+	var patterns []string
+	switch v := raw.(type) {
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, nil, &ConfigError{Field: key, Msg: "must be a file name or a list of file names"}
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, nil, &ConfigError{Field: key, Msg: "must be a file name or a list of file names"}
+	}
+
+	dir := filepath.Dir(filename)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, &ConfigError{Field: key, Msg: err.Error()}
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+		// Files added to or removed from the directory change its modification time
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+	return files, dirs, nil
+}
+
+// mergeConfigValues merges src into dst, objects are merged key by key and
+// any other value from src replaces the one in dst
+func mergeConfigValues(dst map[string]interface{}, dstLines configLines, src map[string]interface{}, srcLines configLines, prefix string) {
+	for key, value := range src {
+		// Match keys without case like encoding/json does
+		dstKey := key
+		for k := range dst {
+			if strings.EqualFold(k, key) {
+				dstKey = k
+			}
+		}
+		path := joinConfigPath(prefix, dstKey)
+		srcPath := joinConfigPath(prefix, key)
+
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[dstKey].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			if loc := srcLines.find(srcPath); loc != nil {
+				dstLines[path] = loc
+			}
+			mergeConfigValues(dstMap, dstLines, srcMap, srcLines, path)
+			continue
+		}
+
+		dst[dstKey] = value
+		for p := range dstLines {
+			if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(p, path+"[") {
+				delete(dstLines, p)
+			}
+		}
+		for p, loc := range srcLines {
+			if p == srcPath || strings.HasPrefix(p, srcPath+".") || strings.HasPrefix(p, srcPath+"[") {
+				dstLines[path+p[len(srcPath):]] = loc
+			}
+		}
+	}
+}
+
+func joinConfigPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+var configEnvRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv replaces ${NAME} and ${NAME:-default} in every string value
+func expandConfigEnv(value interface{}, path string) *ConfigError {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if s, ok := item.(string); ok {
+				expanded, err := expandEnvString(s)
+				if err != nil {
+					return &ConfigError{Field: joinConfigPath(path, key), Msg: err.Error()}
+				}
+				v[key] = expanded
+			} else if err := expandConfigEnv(item, joinConfigPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			itemPath := path + "[" + strconv.Itoa(i) + "]"
+			if s, ok := item.(string); ok {
+				expanded, err := expandEnvString(s)
+				if err != nil {
+					return &ConfigError{Field: itemPath, Msg: err.Error()}
+				}
+				v[i] = expanded
+			} else if err := expandConfigEnv(item, itemPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expandEnvString(s string) (string, error) {
+	var missing []string
+	expanded := configEnvRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		m := configEnvRegexp.FindStringSubmatch(match)
+		if v, found := os.LookupEnv(m[1]); found {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		missing = append(missing, m[1])
+		return match
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// parseJSONConfig parses a JSON configuration object
+func parseJSONConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var values map[string]interface{}
+	if err := dec.Decode(&values); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, nil, &ConfigError{Line: lineAtOffset(data, syntaxErr.Offset), Msg: syntaxErr.Error()}
+		case errors.As(err, &typeErr):
+			return nil, nil, &ConfigError{Line: lineAtOffset(data, typeErr.Offset), Msg: "configuration must be an object"}
+		case errors.Is(err, io.EOF):
+			return nil, nil, &ConfigError{Msg: "configuration is empty"}
+		}
+		return nil, nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, nil, &ConfigError{Line: lineAtOffset(data, dec.InputOffset()), Msg: "unexpected data after the configuration object"}
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, jsonKeyLines(data), nil
+}
+
+var yamlLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// parseYAMLConfig parses a YAML configuration mapping
+func parseYAMLConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		cerr := &ConfigError{Msg: err.Error()}
+		if m := yamlLineRegexp.FindStringSubmatch(err.Error()); m != nil {
+			cerr.Line, _ = strconv.Atoi(m[1])
+		}
+		return nil, nil, cerr
+	}
+	if len(root.Content) == 0 {
+		return nil, nil, &ConfigError{Msg: "configuration is empty"}
+	}
+
+	var values map[string]interface{}
+	if err := root.Decode(&values); err != nil {
+		return nil, nil, &ConfigError{Line: root.Content[0].Line, Msg: "configuration must be a mapping"}
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+
+	lines := map[string]int{}
+	yamlKeyLines(root.Content[0], "", lines)
+	return values, lines, nil
+}
+
+// yamlKeyLines records the line of every mapping key under node
+func yamlKeyLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := joinConfigPath(path, node.Content[i].Value)
+			lines[key] = node.Content[i].Line
+			yamlKeyLines(node.Content[i+1], key, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			yamlKeyLines(item, path+"["+strconv.Itoa(i)+"]", lines)
+		}
+	case yaml.AliasNode:
+		yamlKeyLines(node.Alias, path, lines)
+	}
+}
+
+// parseTOMLConfig parses a TOML configuration document
+func parseTOMLConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	values := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, nil, &ConfigError{Line: parseErr.Position.Line, Msg: strings.TrimPrefix(parseErr.Error(), "toml: ")}
+		}
+		return nil, nil, err
+	}
+	// Array of tables are decoded as []map[string]interface{}
+	normalizeTOMLValues(values)
+	return values, tomlKeyLines(data), nil
+}
+
+func normalizeTOMLValues(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeTOMLValues(item)
+		}
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = normalizeTOMLValues(item)
+		}
+		return items
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeTOMLValues(item)
+		}
+	}
+	return value
+}
+
+var (
+	tomlTableRegexp      = regexp.MustCompile(`^\s*\[\s*([^\[\]]+?)\s*\]\s*(#.*)?$`)
+	tomlArrayTableRegexp = regexp.MustCompile(`^\s*\[\[\s*([^\[\]]+?)\s*\]\]\s*(#.*)?$`)
+	tomlKeyRegexp        = regexp.MustCompile(`^\s*([A-Za-z0-9_.\-"' ]+?)\s*=`)
+)
+
+// tomlKeyLines finds the line of table headers and keys. It follows
+// [table] and [[array]] headers, multi-line values are not tracked.
+func tomlKeyLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	arrays := map[string]int{}
+	table := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if m := tomlArrayTableRegexp.FindStringSubmatch(text); m != nil {
+			name := tomlKeyPath("", m[1])
+			table = name + "[" + strconv.Itoa(arrays[name]) + "]"
+			arrays[name]++
+			if _, found := lines[name]; !found {
+				lines[name] = n
+			}
+			continue
+		}
+		if m := tomlTableRegexp.FindStringSubmatch(text); m != nil {
+			table = tomlKeyPath("", m[1])
+			lines[table] = n
+			continue
+		}
+		if m := tomlKeyRegexp.FindStringSubmatch(text); m != nil {
+			lines[tomlKeyPath(table, m[1])] = n
+		}
+	}
+	return lines
+}
+
+// tomlKeyPath joins a possibly dotted and quoted TOML key to prefix
+func tomlKeyPath(prefix, key string) string {
+	path := prefix
+	for _, part := range strings.Split(key, ".") {
+		path = joinConfigPath(path, strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return path
+}
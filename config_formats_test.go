@@ -0,0 +1,246 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigFiles writes files in a temporary directory and returns its path
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0700))
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestLoadConfig_YAML(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"config.yaml": `
+# Calaos server
+WebSocketServer:
+  Host: calaos.local
+  Port: 5454
+  User: user
+  Password: pass
+Login:
+  Timeout: 5s
+PinCode: "63613161"
+`})
+
+	cfg, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "calaos.local", cfg.WebSocketServer.Host)
+	assert.Equal(t, 5454, cfg.WebSocketServer.Port)
+	assert.Equal(t, 5*time.Second, cfg.Login.Timeout.Duration)
+	assert.Equal(t, "63613161", cfg.PinCode)
+}
+
+func TestLoadConfig_TOML(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"config.toml": `
+PinCode = "63613161"
+BridgeName = "Calaos TOML"
+
+[WebSocketServer]
+Host = "calaos.local"
+User = "user"
+Password = "pass"
+
+[WebSocketServer.Headers]
+X-Test = "1"
+`})
+
+	cfg, err := loadConfig(filepath.Join(dir, "config.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "calaos.local", cfg.WebSocketServer.Host)
+	assert.Equal(t, DefaultCalaosPort, cfg.WebSocketServer.Port)
+	assert.Equal(t, "1", cfg.WebSocketServer.Headers["X-Test"])
+	assert.Equal(t, "Calaos TOML", cfg.BridgeName)
+}
+
+func TestLoadConfig_FormatErrorLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		line    int
+		field   string
+	}{
+		{
+			name:    "YAML syntax error",
+			file:    "config.yaml",
+			content: "PinCode: \"63613161\"\nWebSocketServer:\n\tHost: calaos.local\n",
+			line:    3,
+		},
+		{
+			name:    "YAML validation error",
+			file:    "config.yaml",
+			content: "WebSocketServer:\n  Host: calaos.local\n  User: user\n  Password: pass\n  Port: 0\nPinCode: \"1234\"\n",
+			line:    6,
+			field:   "PinCode",
+		},
+		{
+			name:    "YAML unknown field",
+			file:    "config.yml",
+			content: "WebSocketServer:\n  Host: calaos.local\n  Hots: typo\n",
+			line:    3,
+			field:   "WebSocketServer.Hots",
+		},
+		{
+			name:    "TOML syntax error",
+			file:    "config.toml",
+			content: "PinCode = \"63613161\"\nPort = 12x\n",
+			line:    2,
+		},
+		{
+			name:    "TOML validation error",
+			file:    "config.toml",
+			content: "PinCode = \"1234\"\n\n[WebSocketServer]\nHost = \"calaos.local\"\nPort = 99999\nUser = \"user\"\nPassword = \"pass\"\n",
+			line:    5,
+			field:   "WebSocketServer.Port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, map[string]string{tt.file: tt.content})
+			_, err := loadConfig(filepath.Join(dir, tt.file))
+			errs := configErrors(t, err)
+			for _, e := range errs {
+				if e.Field == tt.field {
+					assert.Equal(t, tt.line, e.Line, e.Error())
+					return
+				}
+			}
+			t.Fatalf("no error for field %q in %v", tt.field, err)
+		})
+	}
+}
+
+func TestLoadConfig_Include(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+    "Include": ["base.yaml", "conf.d/*.toml"],
+    "WebSocketServer": {
+        "Password": "from-main"
+    },
+    "PinCode": "63613161"
+}`,
+		"base.yaml": `
+WebSocketServer:
+  Host: base.local
+  User: base
+  Password: from-base
+BridgeName: Base
+`,
+		"conf.d/10-host.toml": `
+[websocketserver]
+Host = "override.local"
+`,
+		"conf.d/20-port.toml": `
+[WebSocketServer]
+Port = 70000
+`,
+	})
+
+	_, err := loadConfig(filepath.Join(dir, "config.json"))
+	errs := configErrors(t, err)
+	require.Len(t, errs, 1)
+	// The error points to the fragment defining the invalid value
+	assert.Equal(t, filepath.Join(dir, "conf.d/20-port.toml"), errs[0].File)
+	assert.Equal(t, 3, errs[0].Line)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "conf.d/20-port.toml")))
+	cfg, err := loadConfig(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "override.local", cfg.WebSocketServer.Host)
+	assert.Equal(t, "base", cfg.WebSocketServer.User)
+	assert.Equal(t, "from-main", cfg.WebSocketServer.Password)
+	assert.Equal(t, "Base", cfg.BridgeName)
+}
+
+func TestLoadConfig_IncludeErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"cycle.yaml":   "Include: other.yaml\n",
+		"other.yaml":   "Include: cycle.yaml\n",
+		"missing.yaml": "Include: [nowhere.yaml]\n",
+		"invalid.yaml": "Include: 42\n",
+	})
+
+	_, err := loadConfig(filepath.Join(dir, "cycle.yaml"))
+	assert.Contains(t, err.Error(), "include cycle")
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yaml"))
+	assert.Contains(t, err.Error(), "nowhere.yaml")
+
+	_, err = loadConfig(filepath.Join(dir, "invalid.yaml"))
+	errs := configErrors(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 1, errs[0].Line)
+}
+
+func TestLoadConfig_EnvExpansion(t *testing.T) {
+	t.Setenv("CALAOS_TEST_HOST", "env.local")
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+WebSocketServer:
+  Host: ${CALAOS_TEST_HOST}
+  User: ${CALAOS_TEST_USER:-homekit}
+  Password: pass
+PinCode: "63613161"
+`,
+		"missing.yaml": `
+WebSocketServer:
+  Host: ${CALAOS_TEST_UNSET}
+`,
+		"config.json": `{
+  "WebSocketServer": {"Host": "${CALAOS_TEST_HOST}", "User": "user", "Password": "pa${ss}"},
+  "PinCode": "63613161"
+}`,
+	})
+
+	cfg, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "env.local", cfg.WebSocketServer.Host)
+	assert.Equal(t, "homekit", cfg.WebSocketServer.User)
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yaml"))
+	errs := configErrors(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "WebSocketServer.Host", errs[0].Field)
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Contains(t, errs[0].Msg, "CALAOS_TEST_UNSET")
+
+	// JSON values are never expanded
+	cfg, err = loadConfig(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "${CALAOS_TEST_HOST}", cfg.WebSocketServer.Host)
+	assert.Equal(t, "pa${ss}", cfg.WebSocketServer.Password)
+}
+
+func TestTomlKeyLines(t *testing.T) {
+	lines := tomlKeyLines([]byte(`PinCode = "1"
+
+[WebSocketServer]
+Host = "a"
+TLS.CAFile = "ca.pem"
+
+[[Items]]
+Name = "first"
+
+[[Items]]
+Name = "second"
+`))
+	assert.Equal(t, 1, lines["PinCode"])
+	assert.Equal(t, 3, lines["WebSocketServer"])
+	assert.Equal(t, 4, lines["WebSocketServer.Host"])
+	assert.Equal(t, 5, lines["WebSocketServer.TLS.CAFile"])
+	assert.Equal(t, 8, lines["Items[0].Name"])
+	assert.Equal(t, 11, lines["Items[1].Name"])
+}
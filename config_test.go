@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestConfig writes content to a configuration file in a temporary directory
+func writeTestConfig(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+// configErrors returns the ConfigErrors wrapped in err
+func configErrors(t *testing.T, err error) ConfigErrors {
+	var errs ConfigErrors
+	require.True(t, errors.As(err, &errs), "expected ConfigErrors, got %v", err)
+	return errs
+}
+
+func TestLoadConfig_RepositoryConfig(t *testing.T) {
+	cfg, err := loadConfig("config.json")
+	require.NoError(t, err)
+	assert.Equal(t, "demo.calaos.fr", cfg.WebSocketServer.Host)
+	assert.Equal(t, "Calaos Gateway", cfg.BridgeName)
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	filename := writeTestConfig(t, "config.json", `{
+    "WebSocketServer": {
+        "Host": "calaos.local",
+        "User": "user",
+        "Password": "pass"
+    },
+    "PinCode": "63613161"
+}`)
+
+	cfg, err := loadConfig(filename)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCalaosPort, cfg.WebSocketServer.Port)
+	assert.Equal(t, DefaultBridgeName, cfg.BridgeName)
+	assert.Equal(t, DefaultLoginTimeout, cfg.Login.Timeout.Duration)
+	assert.Equal(t, DefaultLoginRetryDelay, cfg.Login.RetryDelay.Duration)
+	assert.Equal(t, DefaultLoginMaxAttempts, cfg.Login.MaxAttempts)
+}
+
+func TestLoadConfig_DecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		field   string
+	}{
+		{
+			name:    "Unknown field",
+			content: "{\n  \"WebSocketServer\": {\n    \"Host\": \"calaos.local\",\n    \"Pasword\": \"typo\"\n  }\n}",
+			line:    4,
+			field:   "WebSocketServer.Pasword",
+		},
+		{
+			name:    "Wrong type",
+			content: "{\n  \"WebSocketServer\": {\n    \"Host\": \"calaos.local\",\n    \"Port\": \"5454\"\n  }\n}",
+			line:    4,
+			field:   "WebSocketServer.Port",
+		},
+		{
+			name:    "Syntax error",
+			content: "{\n  \"PinCode\": \"63613161\",\n  \"BridgeName\": \"Calaos\",,\n}",
+			line:    3,
+		},
+		{
+			name:    "Invalid duration",
+			content: "{\n  \"Login\": {\n    \"Timeout\": \"ten seconds\"\n  }\n}",
+		},
+		{
+			name:    "Trailing data",
+			content: "{\n  \"PinCode\": \"63613161\"\n}\n{}",
+			line:    4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, "config.json", tt.content))
+			errs := configErrors(t, err)
+			require.Len(t, errs, 1)
+			assert.Equal(t, tt.line, errs[0].Line)
+			assert.Equal(t, tt.field, errs[0].Field)
+		})
+	}
+}
+
+func TestLoadConfig_ValidationErrors(t *testing.T) {
+	filename := writeTestConfig(t, "config.json", `{
+    "WebSocketServer": {
+        "Host": "",
+        "Port": 70000,
+        "Scheme": "http",
+        "User": "user",
+        "Password": "pass",
+        "Proxy": "ftp://proxy"
+    },
+    "Login": {
+        "MaxAttempts": -2
+    },
+    "PinCode": "12345678"
+}`)
+
+	_, err := loadConfig(filename)
+	errs := configErrors(t, err)
+
+	lines := map[string]int{}
+	for _, e := range errs {
+		assert.Equal(t, filename, e.File)
+		lines[e.Field] = e.Line
+	}
+	assert.Equal(t, map[string]int{
+		"WebSocketServer.Host":   3,
+		"WebSocketServer.Port":   4,
+		"WebSocketServer.Scheme": 5,
+		"WebSocketServer.Proxy":  8,
+		"Login.MaxAttempts":      11,
+		"PinCode":                13,
+	}, lines)
+	assert.Contains(t, err.Error(), filename+":13: PinCode: 12345678 is too easy to guess")
+}
+
+func TestLoadConfig_MissingFields(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, "config.json", `{}`))
+	errs := configErrors(t, err)
+
+	fields := []string{}
+	for _, e := range errs {
+		assert.Zero(t, e.Line)
+		fields = append(fields, e.Field)
+	}
+	assert.ElementsMatch(t, []string{
+		"WebSocketServer.Host",
+		"WebSocketServer.User",
+		"WebSocketServer.Password",
+		"PinCode",
+	}, fields)
+}
+
+func TestLoadConfig_MissingFile(t *testing.T) {
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.Len(t, configErrors(t, err), 1)
+}
+
+func TestLoadConfig_SecretError(t *testing.T) {
+	filename := writeTestConfig(t, "config.json", `{
+    "WebSocketServer": {
+        "Host": "calaos.local",
+        "User": "user",
+        "Password": "env:CALAOS_TEST_UNSET"
+    },
+    "PinCode": "63613161"
+}`)
+
+	_, err := loadConfig(filename)
+	errs := configErrors(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "WebSocketServer.Password", errs[0].Field)
+	assert.Equal(t, 5, errs[0].Line)
+}
+
+func TestJsonKeyLines(t *testing.T) {
+	data := []byte(`{
+  "A": 1,
+  "B": {
+    "C": [1, 2],
+    "D": [
+      {"E": true},
+      {
+        "E": false
+      }
+    ]
+  },
+  "F": "x"
+}`)
+
+	lines := jsonKeyLines(data)
+	assert.Equal(t, 2, lines["A"])
+	assert.Equal(t, 3, lines["B"])
+	assert.Equal(t, 4, lines["B.C"])
+	assert.Equal(t, 5, lines["B.D"])
+	assert.Equal(t, 6, lines["B.D[0].E"])
+	assert.Equal(t, 8, lines["B.D[1].E"])
+	assert.Equal(t, 12, lines["F"])
+	assert.Len(t, lines, 7)
+}
+
+func TestDuration_MarshalJSON(t *testing.T) {
+	b, err := Duration{90 * time.Second}.MarshalJSON()
+	require.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(b))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// Inputs changes ringing a doorbell
+const (
+	DoorbellRingPress  = "press"  // the input turns true, for push buttons
+	DoorbellRingToggle = "toggle" // the input changes, for inputs toggling at each press
+)
+
+// DoorbellConfig describes a doorbell made of a Calaos push button input
+type DoorbellConfig struct {
+	Name   string // name shown in HomeKit, defaults to the name of the Button IO
+	Button string // input pressed by the visitors
+	Ring   string // input changes ringing the doorbell, press or toggle
+}
+
+func (cfg DoorbellConfig) ios() []string {
+	return []string{cfg.Button}
+}
+
+func (cfg DoorbellConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewDoorbell(cfg, ios, id)
+}
+
+// setDoorbellDefaults sets the default values of the Doorbells section
+func setDoorbellDefaults(cfgs []DoorbellConfig) {
+	for i := range cfgs {
+		if cfgs[i].Ring == "" {
+			cfgs[i].Ring = DoorbellRingPress
+		}
+	}
+}
+
+// validateDoorbells checks the Doorbells section of the configuration
+func validateDoorbells(cfgs []DoorbellConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("Doorbells[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.Button == "" {
+			fail("Button", "is required")
+		}
+		if cfg.Ring != DoorbellRingPress && cfg.Ring != DoorbellRingToggle {
+			fail("Ring", fmt.Sprintf("must be %q or %q, got %q", DoorbellRingPress, DoorbellRingToggle, cfg.Ring))
+		}
+	}
+	return errs
+}
+
+// Doorbell rings in HomeKit when its button input is pressed
+type Doorbell struct {
+	*accessory.A
+	Doorbell *service.Doorbell
+
+	config DoorbellConfig
+	logger *log.Entry
+
+	mu      sync.Mutex
+	pressed bool // state of the button input
+}
+
+var LogComponentDoorbell = registerLogComponent("doorbell")
+
+func NewDoorbell(cfg DoorbellConfig, ios map[string]CalaosIO, id uint64) *Doorbell {
+	button := ios[cfg.Button]
+	acc := Doorbell{
+		config: cfg,
+		logger: accessoryLogger(LogComponentDoorbell, button, id),
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = button.Name
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: button.ID,
+		Manufacturer: "Calaos",
+		Model:        button.IoType,
+	}, accessory.TypeOther) // a video doorbell needs a camera
+	acc.A.Id = id
+
+	acc.Doorbell = service.NewDoorbell()
+	acc.Doorbell.ProgrammableSwitchEvent.ValidVals = []int{characteristic.ProgrammableSwitchEventSinglePress}
+	acc.AddS(acc.Doorbell.S)
+
+	acc.pressed, _ = strconv.ParseBool(button.State)
+
+	return &acc
+}
+
+func (acc *Doorbell) Update(cio *CalaosIO) error {
+	pressed, err := strconv.ParseBool(cio.State)
+	if err != nil {
+		return err
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	ring := pressed && !acc.pressed
+	if acc.config.Ring == DoorbellRingToggle {
+		ring = pressed != acc.pressed
+	}
+	if ring {
+		acc.logger.Info("Doorbell pressed")
+		acc.Doorbell.ProgrammableSwitchEvent.SetValue(characteristic.ProgrammableSwitchEventSinglePress)
+	}
+	acc.pressed = pressed
+	return nil
+}
+
+func (acc *Doorbell) AccessoryGet() *accessory.A {
+	return acc.A
+}
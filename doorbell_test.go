@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupDoorbellHome adds a doorbell button, released, to the test home
+func setupDoorbellHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Entrance",
+		IOs: []CalaosIO{
+			{ID: "bell", Name: "Front door bell", GuiType: "switch", IoType: "input", Visible: "true", State: "false"},
+		},
+	})
+	return h
+}
+
+// newTestDoorbell returns a doorbell ringing on ring and counts its rings
+func newTestDoorbell(t *testing.T, ring string) (*Doorbell, *int) {
+	cfgs := []DoorbellConfig{{Button: "bell", Ring: ring}}
+	setDoorbellDefaults(cfgs)
+	cfg := cfgs[0]
+	acc := NewDoorbell(cfg, homeIOs(setupDoorbellHome(), nil), uint64(murmur.Sum32(cfg.Button)))
+	require.Equal(t, "Front door bell", acc.AccessoryGet().Name())
+
+	rings := 0
+	acc.Doorbell.ProgrammableSwitchEvent.OnValueUpdate(func(new, old int, r *http.Request) {
+		rings++
+	})
+	return acc, &rings
+}
+
+func TestDoorbell_Rings(t *testing.T) {
+	acc, rings := newTestDoorbell(t, "")
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "true"}))
+	assert.Equal(t, 1, *rings)
+
+	// Holding the button rings once
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "true"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "false"}))
+	assert.Equal(t, 1, *rings)
+
+	// Every press rings, the event value is always a single press
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "true"}))
+	assert.Equal(t, 2, *rings)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "bell", State: "invalid"}))
+	assert.Equal(t, 2, *rings)
+}
+
+func TestDoorbell_Toggle(t *testing.T) {
+	acc, rings := newTestDoorbell(t, DoorbellRingToggle)
+
+	// Every change is a press
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "true"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "false"}))
+	assert.Equal(t, 2, *rings)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "bell", State: "false"}))
+	assert.Equal(t, 2, *rings)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Proxy value disabling any proxy, including the one from the environment
+const ProxyNone = "none"
+
+// DefaultCalaosPath is the path of the Calaos websocket API
+const DefaultCalaosPath = "/api"
+
+// calaosEndpoint returns the websocket URI of the Calaos API and the
+// headers to send with the handshake. Credentials embedded in URL are
+// moved to a basic Authorization header, websocket URIs cannot carry them.
+func calaosEndpoint(cfg WebSocketConfig) (string, http.Header, error) {
+	var u *url.URL
+	if cfg.URL != "" {
+		var err error
+		u, err = url.Parse(cfg.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		switch u.Scheme {
+		case "http":
+			u.Scheme = URITypeWS
+		case "https":
+			u.Scheme = URITypeWSS
+		case URITypeWS, URITypeWSS:
+		default:
+			return "", nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return "", nil, fmt.Errorf("missing host in URL %q", cfg.URL)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = DefaultCalaosPath
+		}
+	} else {
+		scheme := cfg.Scheme
+		switch scheme {
+		case "":
+			scheme = URITypeWS
+			if cfg.Port == PortWSS {
+				scheme = URITypeWSS
+			}
+		case URITypeWS, URITypeWSS:
+		default:
+			return "", nil, fmt.Errorf("invalid scheme %q, expected %q or %q", scheme, URITypeWS, URITypeWSS)
+		}
+		u = &url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+			Path:   DefaultCalaosPath,
+		}
+	}
+
+	header := http.Header{}
+	for k, v := range cfg.Headers {
+		header.Set(k, v)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		header.Set("Authorization", "Basic "+credentials)
+		u.User = nil
+	}
+
+	return u.String(), header, nil
+}
+
+// newCalaosDialer returns the websocket dialer configured for the Calaos server
+func newCalaosDialer(cfg WebSocketConfig) (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	switch cfg.Proxy {
+	case "":
+		// DefaultDialer already honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	case ProxyNone:
+		dialer.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, expected http or socks5", proxyURL.Scheme)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &dialer, nil
+}
+
+// dialCalaos opens a single websocket connection to the Calaos server,
+// without the reconnection logic of WebSocketClient
+func dialCalaos(cfg Configuration) (*websocket.Conn, error) {
+	uri, header, err := calaosEndpoint(cfg.WebSocketServer)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newCalaosDialer(cfg.WebSocketServer)
+	if err != nil {
+		return nil, err
+	}
+	dialer.HandshakeTimeout = cfg.Login.Timeout.Duration
+
+	conn, _, err := dialer.Dial(uri, header)
+	return conn, err
+}
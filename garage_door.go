@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+)
+
+// Defaults of the GarageDoors configuration entries
+const (
+	DefaultGarageDoorPulse      = 500 * time.Millisecond
+	DefaultGarageDoorTravelTime = 30 * time.Second
+)
+
+// GarageDoorConfig describes a garage door made of an impulse output and position contacts
+type GarageDoorConfig struct {
+	Name         string   // name shown in HomeKit, defaults to the name of the Command IO
+	Command      string   // output receiving an impulse to move the door
+	Pulse        Duration // length of the impulse
+	ClosedSensor string   // input true while the door is closed
+	OpenSensor   string   // input true while the door is fully open
+	TravelTime   Duration // time the door takes to open or close
+}
+
+func (cfg GarageDoorConfig) ios() []string {
+	ios := []string{cfg.Command}
+	for _, id := range []string{cfg.ClosedSensor, cfg.OpenSensor} {
+		if id != "" {
+			ios = append(ios, id)
+		}
+	}
+	return ios
+}
+
+func (cfg GarageDoorConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewGarageDoor(cfg, ios, id)
+}
+
+// setGarageDoorDefaults fills the optional fields of the GarageDoors entries
+func setGarageDoorDefaults(cfgs []GarageDoorConfig) {
+	for i := range cfgs {
+		if cfgs[i].Pulse.Duration == 0 {
+			cfgs[i].Pulse.Duration = DefaultGarageDoorPulse
+		}
+		if cfgs[i].TravelTime.Duration == 0 {
+			cfgs[i].TravelTime.Duration = DefaultGarageDoorTravelTime
+		}
+	}
+}
+
+// validateGarageDoors checks the GarageDoors section of the configuration
+func validateGarageDoors(cfgs []GarageDoorConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("GarageDoors[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.Command == "" {
+			fail("Command", "is required")
+		}
+		if cfg.ClosedSensor == "" && cfg.OpenSensor == "" {
+			fail("ClosedSensor", "is required when OpenSensor is not set")
+		}
+		if cfg.Pulse.Duration < 0 {
+			fail("Pulse", "must be positive")
+		}
+		if cfg.TravelTime.Duration < 0 {
+			fail("TravelTime", "must be positive")
+		}
+	}
+	return errs
+}
+
+// GarageDoor sends an impulse to the Command output when the target state changes,
+// and derives the current state from the position contacts and the travel time
+type GarageDoor struct {
+	*accessory.GarageDoorOpener
+
+	config  GarageDoorConfig
+	command CalaosIO
+	logger  *log.Entry
+
+	mu     sync.Mutex
+	closed bool        // state of the closed contact
+	open   bool        // state of the open contact
+	timer  *time.Timer // running while the door travels
+}
+
+var LogComponentGarageDoor = registerLogComponent("garage_door")
+
+func NewGarageDoor(cfg GarageDoorConfig, ios map[string]CalaosIO, id uint64) *GarageDoor {
+	command := ios[cfg.Command]
+	acc := GarageDoor{
+		config:  cfg,
+		command: command,
+		logger:  accessoryLogger(LogComponentGarageDoor, command, id),
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = command.Name
+	}
+	acc.GarageDoorOpener = accessory.NewGarageDoorOpener(accessory.Info{
+		Name:         name,
+		SerialNumber: command.ID,
+		Manufacturer: "Calaos",
+		Model:        command.IoType,
+	})
+	acc.GarageDoorOpener.Id = id
+
+	acc.closed, _ = strconv.ParseBool(ios[cfg.ClosedSensor].State)
+	acc.open, _ = strconv.ParseBool(ios[cfg.OpenSensor].State)
+	acc.settle(acc.restingState())
+
+	acc.GarageDoorOpener.GarageDoorOpener.TargetDoorState.OnValueRemoteUpdate(func(target int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.moveTo(target)
+	})
+
+	return &acc
+}
+
+// restingState returns the state of the door when it does not move, the caller holds mu
+func (acc *GarageDoor) restingState() int {
+	switch {
+	case acc.config.ClosedSensor != "" && acc.closed:
+		return characteristic.CurrentDoorStateClosed
+	case acc.config.OpenSensor != "" && acc.open:
+		return characteristic.CurrentDoorStateOpen
+	case acc.config.OpenSensor == "":
+		// Not closed is open without an open contact
+		return characteristic.CurrentDoorStateOpen
+	case acc.config.ClosedSensor == "":
+		return characteristic.CurrentDoorStateClosed
+	}
+	return characteristic.CurrentDoorStateStopped
+}
+
+// settle shows the door at rest in state, the caller holds mu
+func (acc *GarageDoor) settle(state int) {
+	acc.stopTimer()
+	svc := acc.GarageDoorOpener.GarageDoorOpener
+	svc.CurrentDoorState.SetValue(state)
+	if state == characteristic.CurrentDoorStateClosed {
+		svc.TargetDoorState.SetValue(characteristic.TargetDoorStateClosed)
+	} else if state == characteristic.CurrentDoorStateOpen {
+		svc.TargetDoorState.SetValue(characteristic.TargetDoorStateOpen)
+	}
+	svc.ObstructionDetected.SetValue(false)
+}
+
+// moveTo sends the impulse moving the door to target, the caller holds mu
+func (acc *GarageDoor) moveTo(target int) {
+	current := acc.GarageDoorOpener.GarageDoorOpener.CurrentDoorState.Value()
+	if acc.timer == nil && current == target {
+		return
+	}
+
+	cio := acc.command
+	cio.State = fmt.Sprintf("impulse %d", acc.config.Pulse.Milliseconds())
+	acc.logger.Debugf("Impulse to move the door to %d", target)
+	if err := CalaosUpdate(cio); err != nil {
+		return
+	}
+	acc.travel(target)
+}
+
+// travel shows the door moving to target until a contact or the travel time
+// tells where it is, the caller holds mu
+func (acc *GarageDoor) travel(target int) {
+	svc := acc.GarageDoorOpener.GarageDoorOpener
+	svc.TargetDoorState.SetValue(target)
+	if target == characteristic.TargetDoorStateOpen {
+		svc.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpening)
+	} else {
+		svc.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosing)
+	}
+	svc.ObstructionDetected.SetValue(false)
+
+	acc.stopTimer()
+	var timer *time.Timer
+	timer = time.AfterFunc(acc.config.TravelTime.Duration, func() {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if acc.timer == timer {
+			acc.timer = nil
+			acc.travelEnded(target)
+		}
+	})
+	acc.timer = timer
+}
+
+// travelEnded checks that the door reached target in time, the caller holds mu
+func (acc *GarageDoor) travelEnded(target int) {
+	sensor := acc.config.OpenSensor
+	if target == characteristic.TargetDoorStateClosed {
+		sensor = acc.config.ClosedSensor
+	}
+	if sensor == "" {
+		// Nothing tells otherwise
+		acc.settle(target)
+		return
+	}
+
+	// The contact of target would have settled the door
+	acc.logger.Warnf("Door did not reach state %d in %s", target, acc.config.TravelTime.Duration)
+	svc := acc.GarageDoorOpener.GarageDoorOpener
+	svc.CurrentDoorState.SetValue(characteristic.CurrentDoorStateStopped)
+	svc.ObstructionDetected.SetValue(true)
+}
+
+// stopTimer stops the travel timer, the caller holds mu
+func (acc *GarageDoor) stopTimer() {
+	if acc.timer != nil {
+		acc.timer.Stop()
+		acc.timer = nil
+	}
+}
+
+func (acc *GarageDoor) Update(cio *CalaosIO) error {
+	if cio.ID != acc.config.ClosedSensor && cio.ID != acc.config.OpenSensor {
+		// The command output only pulses
+		return nil
+	}
+	v, err := strconv.ParseBool(cio.State)
+	if err != nil {
+		return err
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	if cio.ID == acc.config.ClosedSensor {
+		acc.closed = v
+	} else {
+		acc.open = v
+	}
+
+	current := acc.GarageDoorOpener.GarageDoorOpener.CurrentDoorState.Value()
+	switch state := acc.restingState(); {
+	case state == characteristic.CurrentDoorStateClosed && acc.config.ClosedSensor != "" && acc.closed,
+		state == characteristic.CurrentDoorStateOpen && acc.config.OpenSensor != "" && acc.open:
+		acc.settle(state)
+	case acc.timer != nil:
+		// Travelling, the travel time tells whether the door got stuck
+	case current == characteristic.CurrentDoorStateClosed:
+		// Moved from a wall button or a remote
+		acc.travel(characteristic.TargetDoorStateOpen)
+	case current == characteristic.CurrentDoorStateOpen:
+		acc.travel(characteristic.TargetDoorStateClosed)
+	}
+	return nil
+}
+
+func (acc *GarageDoor) AccessoryGet() *accessory.A {
+	return acc.GarageDoorOpener.A
+}
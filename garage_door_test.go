@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// garageTravelTime keeps the travel of the test doors short
+const garageTravelTime = 50 * time.Millisecond
+
+// setupGarageHome adds a garage door, open and at rest, to the test home
+func setupGarageHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Garage",
+		IOs: []CalaosIO{
+			{ID: "garage-cmd", Name: "Garage door", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "false"},
+			{ID: "garage-closed", Name: "Garage closed", GuiType: "switch", IoType: "input", Visible: "true", State: "false"},
+			{ID: "garage-open", Name: "Garage open", GuiType: "switch", IoType: "input", Visible: "true", State: "true"},
+		},
+	})
+	return h
+}
+
+func garageConfig(closed, open string) GarageDoorConfig {
+	cfg := GarageDoorConfig{Command: "garage-cmd", ClosedSensor: closed, OpenSensor: open}
+	cfgs := []GarageDoorConfig{cfg}
+	setGarageDoorDefaults(cfgs)
+	cfgs[0].TravelTime.Duration = garageTravelTime
+	return cfgs[0]
+}
+
+func newTestGarageDoor(cfg GarageDoorConfig, states map[string]string) *GarageDoor {
+	return NewGarageDoor(cfg, homeIOs(setupGarageHome(), states), uint64(murmur.Sum32(cfg.Command)))
+}
+
+func doorState(acc *GarageDoor) (current, target int, obstruction bool) {
+	svc := acc.GarageDoorOpener.GarageDoorOpener
+	return svc.CurrentDoorState.Value(), svc.TargetDoorState.Value(), svc.ObstructionDetected.Value()
+}
+
+func waitDoorState(t *testing.T, acc *GarageDoor, state int) {
+	require.Eventually(t, func() bool {
+		current, _, _ := doorState(acc)
+		return current == state
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestGarageDoor_InitialState(t *testing.T) {
+	tests := []struct {
+		name     string
+		closed   string
+		open     string
+		states   map[string]string
+		expected int
+	}{
+		{"open contact", "garage-closed", "garage-open", nil, characteristic.CurrentDoorStateOpen},
+		{"closed contact", "garage-closed", "garage-open", map[string]string{"garage-closed": "true", "garage-open": "false"}, characteristic.CurrentDoorStateClosed},
+		{"between contacts", "garage-closed", "garage-open", map[string]string{"garage-open": "false"}, characteristic.CurrentDoorStateStopped},
+		{"not closed", "garage-closed", "", nil, characteristic.CurrentDoorStateOpen},
+		{"not open", "", "garage-open", map[string]string{"garage-open": "false"}, characteristic.CurrentDoorStateClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := newTestGarageDoor(garageConfig(tt.closed, tt.open), tt.states)
+			current, _, obstruction := doorState(acc)
+			assert.Equal(t, tt.expected, current)
+			assert.False(t, obstruction)
+			assert.Equal(t, "Garage door", acc.AccessoryGet().Name())
+		})
+	}
+}
+
+func TestGarageDoor_Close(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestGarageDoor(garageConfig("garage-closed", "garage-open"), nil)
+
+	remoteSet(acc.GarageDoorOpener.GarageDoorOpener.TargetDoorState.C, characteristic.TargetDoorStateClosed)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "garage-cmd", id)
+	assert.Equal(t, "impulse 500", value)
+	current, target, _ := doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateClosing, current)
+	assert.Equal(t, characteristic.TargetDoorStateClosed, target)
+
+	// Leaving the open contact is expected while closing
+	require.NoError(t, acc.Update(&CalaosIO{ID: "garage-open", State: "false"}))
+	current, _, _ = doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateClosing, current)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "garage-closed", State: "true"}))
+	current, target, obstruction := doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateClosed, current)
+	assert.Equal(t, characteristic.TargetDoorStateClosed, target)
+	assert.False(t, obstruction)
+
+	// The travel timer was stopped
+	time.Sleep(2 * garageTravelTime)
+	current, _, _ = doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateClosed, current)
+}
+
+func TestGarageDoor_Obstruction(t *testing.T) {
+	captureCommands(t)
+	acc := newTestGarageDoor(garageConfig("garage-closed", "garage-open"), nil)
+
+	remoteSet(acc.GarageDoorOpener.GarageDoorOpener.TargetDoorState.C, characteristic.TargetDoorStateClosed)
+	require.NoError(t, acc.Update(&CalaosIO{ID: "garage-open", State: "false"}))
+	waitDoorState(t, acc, characteristic.CurrentDoorStateStopped)
+	_, _, obstruction := doorState(acc)
+	assert.True(t, obstruction)
+
+	// Reaching a contact clears it
+	require.NoError(t, acc.Update(&CalaosIO{ID: "garage-closed", State: "true"}))
+	current, _, obstruction := doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateClosed, current)
+	assert.False(t, obstruction)
+}
+
+func TestGarageDoor_MovedOutsideHomeKit(t *testing.T) {
+	acc := newTestGarageDoor(garageConfig("garage-closed", ""), map[string]string{"garage-closed": "true"})
+	current, _, _ := doorState(acc)
+	require.Equal(t, characteristic.CurrentDoorStateClosed, current)
+
+	// Without an open contact, the door is open after the travel time
+	require.NoError(t, acc.Update(&CalaosIO{ID: "garage-closed", State: "false"}))
+	current, target, _ := doorState(acc)
+	assert.Equal(t, characteristic.CurrentDoorStateOpening, current)
+	assert.Equal(t, characteristic.TargetDoorStateOpen, target)
+	waitDoorState(t, acc, characteristic.CurrentDoorStateOpen)
+	_, _, obstruction := doorState(acc)
+	assert.False(t, obstruction)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "garage-closed", State: "invalid"}))
+	assert.NoError(t, acc.Update(&CalaosIO{ID: "garage-cmd", State: "true"}))
+}
+
+func TestGarageDoor_AlreadyAtTarget(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestGarageDoor(garageConfig("garage-closed", "garage-open"), nil)
+
+	remoteSet(acc.GarageDoorOpener.GarageDoorOpener.TargetDoorState.C, characteristic.TargetDoorStateOpen)
+	noCommand(t, commands, 2*garageTravelTime)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// characteristicNames are the names of the HAP characteristic types of the
+// accessories this bridge creates, the admin page shows others by type
+var characteristicNames = map[string]string{
+	characteristic.TypeActive:                               "Active",
+	characteristic.TypeBrightness:                           "Brightness",
+	characteristic.TypeColorTemperature:                     "Color Temperature",
+	characteristic.TypeCoolingThresholdTemperature:          "Cooling Threshold Temperature",
+	characteristic.TypeCurrentDoorState:                     "Current Door State",
+	characteristic.TypeCurrentFanState:                      "Current Fan State",
+	characteristic.TypeCurrentHeaterCoolerState:             "Current Heater Cooler State",
+	characteristic.TypeCurrentHumidifierDehumidifierState:   "Current Humidifier Dehumidifier State",
+	characteristic.TypeCurrentPosition:                      "Current Position",
+	characteristic.TypeCurrentRelativeHumidity:              "Current Relative Humidity",
+	characteristic.TypeCurrentTemperature:                   "Current Temperature",
+	characteristic.TypeHeatingThresholdTemperature:          "Heating Threshold Temperature",
+	characteristic.TypeHoldPosition:                         "Hold Position",
+	characteristic.TypeInUse:                                "In Use",
+	characteristic.TypeIsConfigured:                         "Is Configured",
+	characteristic.TypeLockCurrentState:                     "Lock Current State",
+	characteristic.TypeLockTargetState:                      "Lock Target State",
+	characteristic.TypeName:                                 "Name",
+	characteristic.TypeObstructionDetected:                  "Obstruction Detected",
+	characteristic.TypeOn:                                   "On",
+	characteristic.TypeOutletInUse:                          "Outlet In Use",
+	characteristic.TypePositionState:                        "Position State",
+	characteristic.TypeProgramMode:                          "Program Mode",
+	characteristic.TypeProgrammableSwitchEvent:              "Programmable Switch Event",
+	characteristic.TypeRelativeHumidityHumidifierThreshold:  "Relative Humidity Humidifier Threshold",
+	characteristic.TypeRemainingDuration:                    "Remaining Duration",
+	characteristic.TypeRotationSpeed:                        "Rotation Speed",
+	characteristic.TypeSecuritySystemCurrentState:           "Security System Current State",
+	characteristic.TypeSecuritySystemTargetState:            "Security System Target State",
+	characteristic.TypeServiceLabelIndex:                    "Service Label Index",
+	characteristic.TypeSetDuration:                          "Set Duration",
+	characteristic.TypeTargetDoorState:                      "Target Door State",
+	characteristic.TypeTargetHeaterCoolerState:              "Target Heater Cooler State",
+	characteristic.TypeTargetHumidifierDehumidifierState:    "Target Humidifier Dehumidifier State",
+	characteristic.TypeTargetPosition:                       "Target Position",
+	characteristic.TypeValveType:                            "Valve Type",
+	TypeCharacteristicValueActiveTransitionCount:            "Active Transition Count",
+	TypeCharacteristicValueTransitionControl:                "Transition Control",
+	TypeSupportedCharacteristicValueTransitionConfiguration: "Supported Transition Configuration",
+}
+
+// serviceNames are the names of the HAP service types of the accessories this bridge creates
+var serviceNames = map[string]string{
+	service.TypeDoorbell:               "Doorbell",
+	service.TypeFan:                    "Fan",
+	service.TypeFanV2:                  "Fan V2",
+	service.TypeGarageDoorOpener:       "Garage Door Opener",
+	service.TypeHeaterCooler:           "Heater Cooler",
+	service.TypeHumidifierDehumidifier: "Humidifier Dehumidifier",
+	service.TypeHumiditySensor:         "Humidity Sensor",
+	service.TypeIrrigationSystem:       "Irrigation System",
+	service.TypeLightbulb:              "Lightbulb",
+	service.TypeLockMechanism:          "Lock Mechanism",
+	service.TypeOutlet:                 "Outlet",
+	service.TypeSecuritySystem:         "Security System",
+	service.TypeSwitch:                 "Switch",
+	service.TypeTemperatureSensor:      "Temperature Sensor",
+	service.TypeValve:                  "Valve",
+	service.TypeWindowCovering:         "Window Covering",
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/chacha20poly1305"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/curve25519"
+	"github.com/brutella/hap/hkdf"
+	"github.com/brutella/hap/tlv8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tadglines/go-pkgs/crypto/srp"
+	"github.com/vcaesar/murmur"
+)
+
+// hapTestTimeout bounds every exchange with the HAP server
+const hapTestTimeout = 5 * time.Second
+
+// hapController is a minimal HomeKit controller: it pairs with the bridge
+// over loopback, opens an encrypted session and sends HAP requests on it.
+type hapController struct {
+	t    *testing.T
+	id   string
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+
+	conn   net.Conn
+	w      io.Writer     // plain, then the encrypted session
+	r      *bufio.Reader // plain, then the encrypted session
+	events []hapCharacteristic
+
+	accessoryID  string
+	accessoryKey []byte
+}
+
+// hapCharacteristic is a characteristic of a HAP JSON message
+type hapCharacteristic struct {
+	Aid   uint64      `json:"aid"`
+	Iid   uint64      `json:"iid"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	Ev    *bool       `json:"ev,omitempty"`
+}
+
+type hapAccessories struct {
+	Accessories []struct {
+		Aid      uint64 `json:"aid"`
+		Services []struct {
+			Type            string              `json:"type"`
+			Characteristics []hapCharacteristic `json:"characteristics"`
+		} `json:"services"`
+	} `json:"accessories"`
+}
+
+// find returns the characteristic of type typ of accessory aid
+func (a hapAccessories) find(aid uint64, typ string) (hapCharacteristic, bool) {
+	for _, acc := range a.Accessories {
+		if acc.Aid != aid {
+			continue
+		}
+		for _, s := range acc.Services {
+			for _, c := range s.Characteristics {
+				if c.Type == typ {
+					c.Aid = aid
+					return c, true
+				}
+			}
+		}
+	}
+	return hapCharacteristic{}, false
+}
+
+// useTestHAPAddr makes the HAP server listen on a free loopback port and returns its address
+func useTestHAPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	withState(func() { hapAddr = addr })
+	t.Cleanup(func() { withState(func() { hapAddr = "" }) })
+	return addr
+}
+
+// pairTestController pairs a new controller with the HAP server at addr
+// and verifies the pairing to open an encrypted session
+func pairTestController(t *testing.T, addr string) *hapController {
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial("tcp", addr)
+		return err == nil
+	}, hapTestTimeout, 10*time.Millisecond)
+	t.Cleanup(func() { conn.Close() })
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	c := &hapController{
+		t:    t,
+		id:   "hap-test-controller",
+		pub:  pub,
+		priv: priv,
+		conn: conn,
+		w:    conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	pin := config.PinCode
+	c.pairSetup(fmt.Sprintf("%s-%s-%s", pin[:3], pin[3:5], pin[5:]))
+	c.pairVerify()
+	return c
+}
+
+// pairTLV posts a pairing message and decodes the answer in resp
+func (c *hapController) pairTLV(path string, req interface{}, resp interface{}) {
+	body, err := tlv8.Marshal(req)
+	require.NoError(c.t, err)
+	status, data := c.request(http.MethodPost, path, "application/pairing+tlv8", body)
+	require.Equal(c.t, http.StatusOK, status)
+
+	var tlvError struct {
+		Error byte `tlv8:"7,optional"`
+	}
+	require.NoError(c.t, tlv8.Unmarshal(data, &tlvError))
+	require.Zero(c.t, tlvError.Error, "%s failed", path)
+	require.NoError(c.t, tlv8.Unmarshal(data, resp))
+}
+
+// pairSetup runs the SRP pair setup M1 to M6 with pin
+func (c *hapController) pairSetup(pin string) {
+	var m2 struct {
+		Salt      []byte `tlv8:"2"`
+		PublicKey []byte `tlv8:"3"`
+		State     byte   `tlv8:"6"`
+	}
+	c.pairTLV("/pair-setup", struct {
+		Method byte `tlv8:"0"`
+		State  byte `tlv8:"6"`
+	}{0, 1}, &m2)
+
+	username := []byte("Pair-Setup")
+	s, err := srp.NewSRP("rfc5054.3072", sha512.New, func(salt, pin []byte) []byte {
+		h := sha512.New()
+		h.Write(username)
+		h.Write([]byte(":"))
+		h.Write(pin)
+		t := h.Sum(nil)
+		h.Reset()
+		h.Write(salt)
+		h.Write(t)
+		return h.Sum(nil)
+	})
+	require.NoError(c.t, err)
+	session := s.NewClientSession(username, []byte(pin))
+	key, err := session.ComputeKey(m2.Salt, m2.PublicKey)
+	require.NoError(c.t, err)
+
+	var m4 struct {
+		Proof []byte `tlv8:"4"`
+		State byte   `tlv8:"6"`
+	}
+	c.pairTLV("/pair-setup", struct {
+		PublicKey []byte `tlv8:"3"`
+		Proof     []byte `tlv8:"4"`
+		State     byte   `tlv8:"6"`
+	}{session.GetA(), session.ComputeAuthenticator(), 3}, &m4)
+	require.True(c.t, session.VerifyServerAuthenticator(m4.Proof), "invalid accessory proof")
+
+	encKey, err := hkdf.Sha512(key, []byte("Pair-Setup-Encrypt-Salt"), []byte("Pair-Setup-Encrypt-Info"))
+	require.NoError(c.t, err)
+	signKey, err := hkdf.Sha512(key, []byte("Pair-Setup-Controller-Sign-Salt"), []byte("Pair-Setup-Controller-Sign-Info"))
+	require.NoError(c.t, err)
+	signed := append(append(signKey[:], c.id...), c.pub...)
+	sub, err := tlv8.Marshal(struct {
+		Identifier string `tlv8:"1"`
+		PublicKey  []byte `tlv8:"3"`
+		Signature  []byte `tlv8:"10"`
+	}{c.id, c.pub, ed25519.Sign(c.priv, signed)})
+	require.NoError(c.t, err)
+
+	var m6 struct {
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}
+	c.pairTLV("/pair-setup", struct {
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}{seal(c.t, encKey, "PS-Msg05", sub), 5}, &m6)
+
+	var accessory struct {
+		Identifier string `tlv8:"1"`
+		PublicKey  []byte `tlv8:"3"`
+		Signature  []byte `tlv8:"10"`
+	}
+	require.NoError(c.t, tlv8.Unmarshal(open(c.t, encKey, "PS-Msg06", m6.EncryptedData), &accessory))
+	signKey, err = hkdf.Sha512(key, []byte("Pair-Setup-Accessory-Sign-Salt"), []byte("Pair-Setup-Accessory-Sign-Info"))
+	require.NoError(c.t, err)
+	signed = append(append(signKey[:], accessory.Identifier...), accessory.PublicKey...)
+	require.True(c.t, ed25519.Verify(accessory.PublicKey, signed, accessory.Signature), "invalid accessory signature")
+	c.accessoryID, c.accessoryKey = accessory.Identifier, accessory.PublicKey
+}
+
+// pairVerify runs the pair verify M1 to M4 and switches to the encrypted session
+func (c *hapController) pairVerify() {
+	public, private := curve25519.GenerateKeyPair()
+	var m2 struct {
+		PublicKey     []byte `tlv8:"3"`
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}
+	c.pairTLV("/pair-verify", struct {
+		PublicKey []byte `tlv8:"3"`
+		State     byte   `tlv8:"6"`
+	}{public[:], 1}, &m2)
+
+	var accessoryPublic [32]byte
+	copy(accessoryPublic[:], m2.PublicKey)
+	shared := curve25519.SharedSecret(private, accessoryPublic)
+	encKey, err := hkdf.Sha512(shared[:], []byte("Pair-Verify-Encrypt-Salt"), []byte("Pair-Verify-Encrypt-Info"))
+	require.NoError(c.t, err)
+
+	var accessory struct {
+		Identifier string `tlv8:"1"`
+		Signature  []byte `tlv8:"10"`
+	}
+	require.NoError(c.t, tlv8.Unmarshal(open(c.t, encKey, "PV-Msg02", m2.EncryptedData), &accessory))
+	require.Equal(c.t, c.accessoryID, accessory.Identifier)
+	signed := append(append(append([]byte{}, accessoryPublic[:]...), accessory.Identifier...), public[:]...)
+	require.True(c.t, ed25519.Verify(c.accessoryKey, signed, accessory.Signature), "invalid accessory signature")
+
+	signed = append(append(append([]byte{}, public[:]...), c.id...), accessoryPublic[:]...)
+	sub, err := tlv8.Marshal(struct {
+		Identifier string `tlv8:"1"`
+		Signature  []byte `tlv8:"10"`
+	}{c.id, ed25519.Sign(c.priv, signed)})
+	require.NoError(c.t, err)
+
+	var m4 struct {
+		State byte `tlv8:"6"`
+	}
+	c.pairTLV("/pair-verify", struct {
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}{seal(c.t, encKey, "PV-Msg03", sub), 3}, &m4)
+	require.Equal(c.t, byte(4), m4.State)
+
+	readKey, err := hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Read-Encryption-Key"))
+	require.NoError(c.t, err)
+	writeKey, err := hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Write-Encryption-Key"))
+	require.NoError(c.t, err)
+	secure := &hapSecureConn{r: c.r, w: c.conn, readKey: readKey, writeKey: writeKey}
+	c.w, c.r = secure, bufio.NewReader(secure)
+}
+
+// seal encrypts a pairing sub TLV, the MAC is appended
+func seal(t *testing.T, key [32]byte, nonce string, data []byte) []byte {
+	encrypted, mac, err := chacha20poly1305.EncryptAndSeal(key[:], []byte(nonce), data, nil)
+	require.NoError(t, err)
+	return append(encrypted, mac[:]...)
+}
+
+// open decrypts a pairing sub TLV sealed by the accessory
+func open(t *testing.T, key [32]byte, nonce string, data []byte) []byte {
+	require.Greater(t, len(data), 16)
+	var mac [16]byte
+	copy(mac[:], data[len(data)-16:])
+	decrypted, err := chacha20poly1305.DecryptAndVerify(key[:], []byte(nonce), data[:len(data)-16], mac, nil)
+	require.NoError(t, err)
+	return decrypted
+}
+
+// hapSecureConn frames the session data like the HAP server:
+// 2 bytes little endian length, up to 1024 encrypted bytes and a 16 bytes MAC
+type hapSecureConn struct {
+	r                 *bufio.Reader
+	w                 io.Writer
+	readKey, writeKey [32]byte
+	readCount         uint64
+	writeCount        uint64
+	buf               bytes.Buffer
+}
+
+func (s *hapSecureConn) Write(b []byte) (int, error) {
+	for data := b; len(data) > 0; {
+		n := min(len(data), 0x400)
+		length := binary.LittleEndian.AppendUint16(nil, uint16(n))
+		nonce := binary.LittleEndian.AppendUint64(nil, s.writeCount)
+		s.writeCount++
+		encrypted, mac, err := chacha20poly1305.EncryptAndSeal(s.writeKey[:], nonce, data[:n], length)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.w.Write(append(append(length, encrypted...), mac[:]...)); err != nil {
+			return 0, err
+		}
+		data = data[n:]
+	}
+	return len(b), nil
+}
+
+func (s *hapSecureConn) Read(b []byte) (int, error) {
+	if s.buf.Len() == 0 {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(s.r, length); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, int(binary.LittleEndian.Uint16(length))+16)
+		if _, err := io.ReadFull(s.r, frame); err != nil {
+			return 0, err
+		}
+		var mac [16]byte
+		copy(mac[:], frame[len(frame)-16:])
+		nonce := binary.LittleEndian.AppendUint64(nil, s.readCount)
+		s.readCount++
+		decrypted, err := chacha20poly1305.DecryptAndVerify(s.readKey[:], nonce, frame[:len(frame)-16], mac, length)
+		if err != nil {
+			return 0, err
+		}
+		s.buf.Write(decrypted)
+	}
+	return s.buf.Read(b)
+}
+
+// request sends a HAP request and returns the status and body of the response,
+// the events received meanwhile are queued
+func (c *hapController) request(method, path, contentType string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, "http://calaos-homekit"+path, bytes.NewReader(body))
+	require.NoError(c.t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.conn.SetDeadline(time.Now().Add(hapTestTimeout))
+	require.NoError(c.t, req.Write(c.w))
+
+	for c.readEventIfAny() {
+	}
+	resp, err := http.ReadResponse(c.r, req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+	return resp.StatusCode, data
+}
+
+// readEventIfAny queues the next message when it is an event, which
+// http.ReadResponse does not parse as its protocol is EVENT/1.0
+func (c *hapController) readEventIfAny() bool {
+	prefix, err := c.r.Peek(len("EVENT/"))
+	require.NoError(c.t, err)
+	if string(prefix) != "EVENT/" {
+		return false
+	}
+
+	tp := textproto.NewReader(c.r)
+	line, err := tp.ReadLine()
+	require.NoError(c.t, err)
+	require.Equal(c.t, "EVENT/1.0 200 OK", line)
+	header, err := tp.ReadMIMEHeader()
+	require.NoError(c.t, err)
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	require.NoError(c.t, err)
+	body := make([]byte, length)
+	_, err = io.ReadFull(c.r, body)
+	require.NoError(c.t, err)
+
+	var event struct {
+		Characteristics []hapCharacteristic `json:"characteristics"`
+	}
+	require.NoError(c.t, json.Unmarshal(body, &event))
+	c.events = append(c.events, event.Characteristics...)
+	return true
+}
+
+// nextEvent waits for the next characteristic event
+func (c *hapController) nextEvent() hapCharacteristic {
+	if len(c.events) == 0 {
+		c.conn.SetDeadline(time.Now().Add(hapTestTimeout))
+		require.True(c.t, c.readEventIfAny(), "expected an event")
+	}
+	event := c.events[0]
+	c.events = c.events[1:]
+	return event
+}
+
+func (c *hapController) accessories() hapAccessories {
+	status, data := c.request(http.MethodGet, "/accessories", "", nil)
+	require.Equal(c.t, http.StatusOK, status)
+	var accs hapAccessories
+	require.NoError(c.t, json.Unmarshal(data, &accs))
+	return accs
+}
+
+func (c *hapController) putCharacteristics(cs ...hapCharacteristic) {
+	body, err := json.Marshal(struct {
+		Characteristics []hapCharacteristic `json:"characteristics"`
+	}{cs})
+	require.NoError(c.t, err)
+	status, data := c.request(http.MethodPut, "/characteristics", "application/hap+json", body)
+	require.Equal(c.t, http.StatusNoContent, status, string(data))
+}
+
+func (c *hapController) getCharacteristic(ch hapCharacteristic) interface{} {
+	status, data := c.request(http.MethodGet, fmt.Sprintf("/characteristics?id=%d.%d", ch.Aid, ch.Iid), "", nil)
+	require.Equal(c.t, http.StatusOK, status)
+	var resp struct {
+		Characteristics []hapCharacteristic `json:"characteristics"`
+	}
+	require.NoError(c.t, json.Unmarshal(data, &resp))
+	require.Len(c.t, resp.Characteristics, 1)
+	return resp.Characteristics[0].Value
+}
+
+// hapType returns the short form of a HAP type used in the JSON messages
+func hapType(typ string) string {
+	return strings.TrimLeft(typ, "0")
+}
+
+func TestHAP_Controller(t *testing.T) {
+	if raceEnabled {
+		// brutella/hap switches a connection to the encrypted session
+		// without synchronization, which the detector reports
+		t.Skip("brutella/hap is not race free")
+	}
+	fake, url := startFakeCalaos(t)
+	addr := useTestHAPAddr(t)
+	startTestBridge(t, url)
+	waitLoggedIn(t)
+	c := pairTestController(t, addr)
+
+	// The bridge and every exposed IO are listed
+	accs := c.accessories()
+	assert.Len(t, accs.Accessories, 5)
+	dimmer := uint64(murmur.Sum32("io_1"))
+	lamp := uint64(murmur.Sum32("io_2"))
+	sensor := uint64(murmur.Sum32("io_3"))
+	name, found := accs.find(dimmer, hapType(characteristic.TypeName))
+	require.True(t, found)
+	assert.Equal(t, "Ceiling", name.Value)
+	temperature, found := accs.find(sensor, hapType(characteristic.TypeCurrentTemperature))
+	require.True(t, found)
+	assert.EqualValues(t, 21.5, temperature.Value)
+
+	// Writes from HomeKit are sent to Calaos
+	brightness, found := accs.find(dimmer, hapType(characteristic.TypeBrightness))
+	require.True(t, found)
+	brightness.Value = 40
+	c.putCharacteristics(brightness)
+	require.Eventually(t, func() bool {
+		state, _ := fake.State("io_1")
+		return state == "40"
+	}, 2*time.Second, 10*time.Millisecond)
+	commands := fake.Commands()
+	require.NotEmpty(t, commands)
+	assert.Equal(t, "io_1", commands[len(commands)-1].Data.Id)
+	assert.Equal(t, "set 40", commands[len(commands)-1].Data.Value)
+
+	on, found := accs.find(lamp, hapType(characteristic.TypeOn))
+	require.True(t, found)
+	on.Value = true
+	c.putCharacteristics(on)
+	require.Eventually(t, func() bool {
+		state, _ := fake.State("io_2")
+		return state == "true"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The event Calaos sends back updates the other characteristics
+	dimmerOn, found := accs.find(dimmer, hapType(characteristic.TypeOn))
+	require.True(t, found)
+	require.Eventually(t, func() bool {
+		return c.getCharacteristic(dimmerOn) == true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Changes made on Calaos are notified to the subscribed controllers
+	ev := true
+	c.putCharacteristics(hapCharacteristic{Aid: temperature.Aid, Iid: temperature.Iid, Ev: &ev})
+	require.NoError(t, fake.SetState("io_3", "19"))
+	event := c.nextEvent()
+	assert.Equal(t, temperature.Aid, event.Aid)
+	assert.Equal(t, temperature.Iid, event.Iid)
+	assert.EqualValues(t, 19, event.Value)
+	assert.EqualValues(t, 19, c.getCharacteristic(temperature))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Health endpoints of the HTTP server
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// DefaultHealthGrace is how long the bridge may be away from Calaos before it is unhealthy
+const DefaultHealthGrace = 2 * time.Minute
+
+type HealthConfig struct {
+	Grace Duration // time without a Calaos session before the bridge is unhealthy, 2m by default
+}
+
+// HealthChecks are the conditions for the bridge to be ready
+type HealthChecks struct {
+	WebSocket bool `json:"websocket"`  // connected to the Calaos WebSocket
+	LoggedIn  bool `json:"logged_in"`  // logged in to Calaos
+	HAPServer bool `json:"hap_server"` // serving accessories to HomeKit
+}
+
+// HealthReport is the health of the bridge at a given time
+type HealthReport struct {
+	Ready   bool           `json:"ready"`
+	Healthy bool           `json:"healthy"`
+	Checks  HealthChecks   `json:"checks"`
+	Status  StatusSnapshot `json:"status"`
+}
+
+// checkHealth reports the bridge health at now. The bridge is ready when
+// every check passes. It is healthy while logged in to Calaos and for grace
+// after it started or lost its session, to give reconnections a chance.
+func checkHealth(now time.Time, grace time.Duration) HealthReport {
+	snapshot := status.Snapshot()
+	report := HealthReport{
+		Checks: HealthChecks{
+			WebSocket: websocketClient != nil && websocketClient.IsConnected(),
+			LoggedIn:  snapshot.State == StateLoggedIn,
+			HAPServer: hapRunning.Load(),
+		},
+		Status: snapshot,
+	}
+	report.Ready = report.Checks.WebSocket && report.Checks.LoggedIn && report.Checks.HAPServer
+	report.Healthy = (report.Checks.WebSocket && report.Checks.LoggedIn) || now.Sub(snapshot.OfflineSince) < grace
+	return report
+}
+
+// healthGrace holds Health.Grace for the HTTP handlers and the watchdog
+var healthGrace atomic.Int64
+
+// applyHealthConfig makes cfg the settings used to report health
+func applyHealthConfig(cfg HealthConfig) {
+	healthGrace.Store(int64(cfg.Grace.Duration))
+}
+
+// currentHealth reports the bridge health with the configured grace
+func currentHealth() HealthReport {
+	return checkHealth(time.Now(), time.Duration(healthGrace.Load()))
+}
+
+// healthHandler answers 200 when pass returns true for the current health, 503 otherwise
+func healthHandler(pass func(HealthReport) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := currentHealth()
+		w.Header().Set("Content-Type", "application/json")
+		if !pass(report) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupHealthTest makes the bridge logged in to Calaos with the HAP server running
+func setupHealthTest(t *testing.T) {
+	withState(func() {
+		status = newBridgeStatus()
+		websocketClient = &WebSocketClient{}
+		websocketClient.isConnected.Store(true)
+		status.Set(StateLoggedIn, nil)
+	})
+	hapRunning.Store(true)
+	applyHealthConfig(HealthConfig{Grace: Duration{time.Minute}})
+
+	t.Cleanup(func() {
+		withState(func() { status = newBridgeStatus() })
+		hapRunning.Store(false)
+	})
+}
+
+func TestCheckHealth(t *testing.T) {
+	setupHealthTest(t)
+	now := time.Now()
+
+	report := checkHealth(now, time.Minute)
+	assert.True(t, report.Ready)
+	assert.True(t, report.Healthy)
+
+	// No accessories exposed yet
+	hapRunning.Store(false)
+	report = checkHealth(now, time.Minute)
+	assert.False(t, report.Ready)
+	assert.True(t, report.Healthy)
+
+	// Calaos lost, healthy during the grace period
+	websocketClient.isConnected.Store(false)
+	status.Set(StateConnecting, nil)
+	report = checkHealth(time.Now(), time.Minute)
+	assert.False(t, report.Ready)
+	assert.True(t, report.Healthy)
+	assert.False(t, report.Checks.WebSocket)
+	assert.False(t, report.Checks.LoggedIn)
+
+	// Login attempts do not extend the grace period
+	status.Set(StateLoggingIn, nil)
+	status.Set(StateLoginTimeout, nil)
+	report = checkHealth(time.Now().Add(2*time.Minute), time.Minute)
+	assert.False(t, report.Healthy)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	setupHealthTest(t)
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{}))
+	defer srv.Close()
+
+	get := func(path string) (int, HealthReport) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var report HealthReport
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		return resp.StatusCode, report
+	}
+
+	code, report := get(ReadyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StateLoggedIn, report.Status.State)
+
+	hapRunning.Store(false)
+	code, _ = get(ReadyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = get(HealthzPath)
+	assert.Equal(t, http.StatusOK, code)
+
+	applyHealthConfig(HealthConfig{})
+	websocketClient.isConnected.Store(false)
+	status.Set(StateConnecting, nil)
+	code, report = get(HealthzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Healthy)
+}
+
+// listenNotifySocket sets NOTIFY_SOCKET to a socket receiving systemd notifications
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := sdNotify(SdNotifyReady)
+	assert.NoError(t, err)
+	assert.False(t, sent)
+
+	conn := listenNotifySocket(t)
+	sent, err = sdNotify(SdNotifyReady)
+	require.NoError(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, SdNotifyReady, readNotification(t, conn))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	assert.Zero(t, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Zero(t, sdWatchdogInterval())
+}
+
+func TestRunSystemdNotify(t *testing.T) {
+	setupHealthTest(t)
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runSystemdNotify(ctx, time.Hour)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	assert.Equal(t, SdNotifyReady, readNotification(t, conn))
+	assert.Equal(t, SdNotifyWatchdog, readNotification(t, conn))
+	// Pinged again within half the watchdog timeout
+	assert.Equal(t, SdNotifyWatchdog, readNotification(t, conn))
+}
+
+func TestRunSystemdNotify_NothingToExpose(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	var h CalaosJsonMsgHome
+	h.Data.Home = []CalaosHome{{
+		Name: "Cellar",
+		IOs:  []CalaosIO{{ID: "io_1", Name: "Pump mode", GuiType: "var_string", IoType: "output", Visible: "true"}},
+	}}
+	fake := NewFakeCalaos(h, "user", "pass")
+	url, err := fake.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(fake.Close)
+	startTestBridge(t, url)
+
+	// Started without waiting for Calaos
+	runSystemdNotify(context.Background(), time.Hour)
+	assert.Equal(t, SdNotifyReady, readNotification(t, conn))
+
+	// Logged in, but without accessories the HAP server does not run
+	require.Eventually(t, func() bool {
+		loggedIn := false
+		withState(func() { loggedIn = status.State() == StateLoggedIn && len(home.Data.Home) > 0 })
+		return loggedIn
+	}, 5*time.Second, 10*time.Millisecond)
+	withState(func() { assert.False(t, hapServerStarted) })
+	report := currentHealth()
+	assert.True(t, report.Checks.LoggedIn)
+	assert.False(t, report.Checks.HAPServer)
+	assert.False(t, report.Ready)
+}
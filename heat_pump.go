@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// Range of the heating and cooling thresholds of heat pumps, in °C
+const (
+	HeatPumpMinSetpoint  = 10
+	HeatPumpMaxSetpoint  = 30
+	HeatPumpSetpointStep = 0.5
+)
+
+// Heat pump modes, keys of HeatPumpConfig.Modes
+const (
+	HeatPumpModeOff  = "off"
+	HeatPumpModeHeat = "heat"
+	HeatPumpModeCool = "cool"
+	HeatPumpModeAuto = "auto"
+)
+
+// HeatPumpConfig describes a reversible heat pump made of a mode variable, a
+// setpoint output and a temperature input
+type HeatPumpConfig struct {
+	Name        string         // name shown in HomeKit, defaults to the name of the Mode IO
+	Mode        string         // var_int holding the mode of the heat pump
+	Modes       map[string]int // value of Mode for each mode: off, heat, cool and auto
+	Setpoint    string         // analog output receiving the temperature to reach
+	Temperature string         // temperature input of the room
+}
+
+func (cfg HeatPumpConfig) ios() []string {
+	return []string{cfg.Mode, cfg.Setpoint, cfg.Temperature}
+}
+
+func (cfg HeatPumpConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewHeatPump(cfg, ios, id)
+}
+
+// setHeatPumpDefaults fills the optional fields of the HeatPumps entries
+func setHeatPumpDefaults(cfgs []HeatPumpConfig) {
+	for i := range cfgs {
+		if cfgs[i].Modes == nil {
+			cfgs[i].Modes = map[string]int{HeatPumpModeOff: 0, HeatPumpModeHeat: 1, HeatPumpModeCool: 2}
+		}
+	}
+}
+
+// validateHeatPumps checks the HeatPumps section of the configuration
+func validateHeatPumps(cfgs []HeatPumpConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("HeatPumps[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.Mode == "" {
+			fail("Mode", "is required")
+		}
+		if cfg.Setpoint == "" {
+			fail("Setpoint", "is required")
+		}
+		if cfg.Temperature == "" {
+			fail("Temperature", "is required")
+		}
+
+		values := map[int]string{}
+		for _, mode := range slices.Sorted(maps.Keys(cfg.Modes)) {
+			value := cfg.Modes[mode]
+			switch mode {
+			case HeatPumpModeOff, HeatPumpModeHeat, HeatPumpModeCool, HeatPumpModeAuto:
+			default:
+				fail("Modes", fmt.Sprintf("unknown mode %q, must be off, heat, cool or auto", mode))
+				continue
+			}
+			if other, found := values[value]; found {
+				fail("Modes", fmt.Sprintf("%s and %s have the same value %d", other, mode, value))
+			}
+			values[value] = mode
+		}
+		if _, found := cfg.Modes[HeatPumpModeOff]; !found {
+			fail("Modes", "off is required")
+		}
+		_, heat := cfg.Modes[HeatPumpModeHeat]
+		_, cool := cfg.Modes[HeatPumpModeCool]
+		if !heat && !cool {
+			fail("Modes", "heat or cool is required")
+		}
+	}
+	return errs
+}
+
+// heatPumpTargets are the TargetHeaterCoolerState values of the modes
+var heatPumpTargets = map[string]int{
+	HeatPumpModeAuto: characteristic.TargetHeaterCoolerStateAuto,
+	HeatPumpModeHeat: characteristic.TargetHeaterCoolerStateHeat,
+	HeatPumpModeCool: characteristic.TargetHeaterCoolerStateCool,
+}
+
+// HeatPump is a HeaterCooler writing the mode and setpoint of a reversible
+// heat pump. Its single setpoint is the heating threshold when heating, the
+// cooling threshold when cooling and halfway between them in auto mode.
+type HeatPump struct {
+	*accessory.A
+	HeaterCooler     *service.HeaterCooler
+	HeatingThreshold *characteristic.HeatingThresholdTemperature
+	CoolingThreshold *characteristic.CoolingThresholdTemperature
+
+	config   HeatPumpConfig
+	mode     CalaosIO
+	setpoint CalaosIO
+	logger   *log.Entry
+
+	mu     sync.Mutex
+	active bool
+	target int // TargetHeaterCoolerState, kept while off
+}
+
+var LogComponentHeatPump = registerLogComponent("heat_pump")
+
+func NewHeatPump(cfg HeatPumpConfig, ios map[string]CalaosIO, id uint64) *HeatPump {
+	mode := ios[cfg.Mode]
+	acc := HeatPump{
+		config:   cfg,
+		mode:     mode,
+		setpoint: ios[cfg.Setpoint],
+		logger:   accessoryLogger(LogComponentHeatPump, mode, id),
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = mode.Name
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: mode.ID,
+		Manufacturer: "Calaos",
+		Model:        mode.IoType,
+	}, accessory.TypeAirConditioner)
+	acc.A.Id = id
+
+	svc := service.NewHeaterCooler()
+	acc.HeaterCooler = svc
+	svc.CurrentTemperature.SetMinValue(-50)
+	svc.CurrentTemperature.SetMaxValue(50)
+	svc.TargetHeaterCoolerState.ValidVals = nil
+	for _, m := range []string{HeatPumpModeAuto, HeatPumpModeHeat, HeatPumpModeCool} {
+		if _, found := cfg.Modes[m]; found {
+			svc.TargetHeaterCoolerState.ValidVals = append(svc.TargetHeaterCoolerState.ValidVals, heatPumpTargets[m])
+		}
+	}
+	acc.target = svc.TargetHeaterCoolerState.ValidVals[0]
+
+	acc.HeatingThreshold = characteristic.NewHeatingThresholdTemperature()
+	acc.CoolingThreshold = characteristic.NewCoolingThresholdTemperature()
+	for _, c := range []*characteristic.Float{acc.HeatingThreshold.Float, acc.CoolingThreshold.Float} {
+		c.SetMinValue(HeatPumpMinSetpoint)
+		c.SetMaxValue(HeatPumpMaxSetpoint)
+		c.SetStepValue(HeatPumpSetpointStep)
+		svc.AddC(c.C)
+	}
+	acc.AddS(svc.S)
+
+	if setpoint, err := strconv.ParseFloat(acc.setpoint.State, 64); err == nil {
+		acc.HeatingThreshold.SetValue(setpoint)
+		acc.CoolingThreshold.SetValue(setpoint)
+	}
+	if t, err := strconv.ParseFloat(ios[cfg.Temperature].State, 64); err == nil {
+		svc.CurrentTemperature.SetValue(t)
+	}
+	acc.setMode(mode.State)
+	acc.show()
+
+	svc.Active.OnValueRemoteUpdate(func(active int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if active == characteristic.ActiveInactive {
+			acc.writeMode(HeatPumpModeOff)
+			return
+		}
+		acc.writeTarget()
+	})
+	svc.TargetHeaterCoolerState.OnValueRemoteUpdate(func(target int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.target = target
+		if svc.Active.Value() == characteristic.ActiveActive {
+			acc.writeTarget()
+		}
+	})
+	acc.HeatingThreshold.OnValueRemoteUpdate(func(float64) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if acc.target != characteristic.TargetHeaterCoolerStateCool {
+			acc.writeSetpoint()
+		}
+	})
+	acc.CoolingThreshold.OnValueRemoteUpdate(func(float64) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if acc.target != characteristic.TargetHeaterCoolerStateHeat {
+			acc.writeSetpoint()
+		}
+	})
+
+	return &acc
+}
+
+// modeOf returns the mode whose value is state
+func (acc *HeatPump) modeOf(state string) (string, error) {
+	v, err := strconv.ParseFloat(state, 64)
+	if err != nil {
+		return "", err
+	}
+	for mode, value := range acc.config.Modes {
+		if float64(value) == v {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown heat pump mode %s", state)
+}
+
+// setMode updates active and target from the state of the Mode IO, the caller holds mu
+func (acc *HeatPump) setMode(state string) error {
+	mode, err := acc.modeOf(state)
+	if err != nil {
+		return err
+	}
+	acc.active = mode != HeatPumpModeOff
+	if acc.active {
+		acc.target = heatPumpTargets[mode]
+	}
+	return nil
+}
+
+// writeMode sends mode to the Mode IO, the caller holds mu
+func (acc *HeatPump) writeMode(mode string) {
+	acc.logger.Debugf("Setting heat pump mode to %s", mode)
+	cio := acc.mode
+	cio.State = strconv.Itoa(acc.config.Modes[mode])
+	CalaosUpdate(cio)
+}
+
+// writeTarget sends the mode and setpoint of target, the caller holds mu
+func (acc *HeatPump) writeTarget() {
+	for mode, target := range heatPumpTargets {
+		if target == acc.target {
+			acc.writeMode(mode)
+		}
+	}
+	acc.writeSetpoint()
+}
+
+// writeSetpoint sends the setpoint of target, the caller holds mu
+func (acc *HeatPump) writeSetpoint() {
+	setpoint := acc.HeatingThreshold.Value()
+	switch acc.target {
+	case characteristic.TargetHeaterCoolerStateCool:
+		setpoint = acc.CoolingThreshold.Value()
+	case characteristic.TargetHeaterCoolerStateAuto:
+		setpoint = (acc.HeatingThreshold.Value() + acc.CoolingThreshold.Value()) / 2
+	}
+	acc.logger.Debugf("Setting heat pump setpoint to %g", setpoint)
+	cio := acc.setpoint
+	cio.State = strconv.FormatFloat(setpoint, 'f', -1, 64)
+	CalaosUpdate(cio)
+}
+
+// show sets Active, the target and the current state, the caller holds mu
+func (acc *HeatPump) show() {
+	svc := acc.HeaterCooler
+	svc.TargetHeaterCoolerState.SetValue(acc.target)
+	if !acc.active {
+		svc.Active.SetValue(characteristic.ActiveInactive)
+		svc.CurrentHeaterCoolerState.SetValue(characteristic.CurrentHeaterCoolerStateInactive)
+		return
+	}
+	svc.Active.SetValue(characteristic.ActiveActive)
+
+	// The heat pump does not tell whether it runs, guess it from the temperature
+	t := svc.CurrentTemperature.Value()
+	heating := acc.target != characteristic.TargetHeaterCoolerStateCool && t < acc.HeatingThreshold.Value()
+	cooling := acc.target != characteristic.TargetHeaterCoolerStateHeat && t > acc.CoolingThreshold.Value()
+	switch {
+	case heating:
+		svc.CurrentHeaterCoolerState.SetValue(characteristic.CurrentHeaterCoolerStateHeating)
+	case cooling:
+		svc.CurrentHeaterCoolerState.SetValue(characteristic.CurrentHeaterCoolerStateCooling)
+	default:
+		svc.CurrentHeaterCoolerState.SetValue(characteristic.CurrentHeaterCoolerStateIdle)
+	}
+}
+
+func (acc *HeatPump) Update(cio *CalaosIO) error {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	switch cio.ID {
+	case acc.config.Mode:
+		if err := acc.setMode(cio.State); err != nil {
+			return err
+		}
+	case acc.config.Setpoint:
+		setpoint, err := strconv.ParseFloat(cio.State, 64)
+		if err != nil {
+			return err
+		}
+		switch acc.target {
+		case characteristic.TargetHeaterCoolerStateHeat:
+			acc.HeatingThreshold.SetValue(setpoint)
+		case characteristic.TargetHeaterCoolerStateCool:
+			acc.CoolingThreshold.SetValue(setpoint)
+		}
+		// In auto mode the setpoint cannot tell both thresholds
+	case acc.config.Temperature:
+		t, err := strconv.ParseFloat(cio.State, 64)
+		if err != nil {
+			return err
+		}
+		acc.HeaterCooler.CurrentTemperature.SetValue(t)
+	}
+	acc.show()
+	return nil
+}
+
+func (acc *HeatPump) AccessoryGet() *accessory.A {
+	return acc.A
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupHeatPumpHome adds a heat pump heating to 20°C in a 18°C room to the test home
+func setupHeatPumpHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Living room",
+		IOs: []CalaosIO{
+			{ID: "pac-mode", Name: "Heat pump", GuiType: "var_int", IoType: "output", Visible: "true", State: "1"},
+			{ID: "pac-setpoint", Name: "Heat pump setpoint", GuiType: "analog_out", IoType: "output", Visible: "true", State: "20"},
+			{ID: "pac-temp", Name: "Living room temperature", GuiType: CalaosGuiTypeTemp, IoType: "input", Visible: "true", State: "18"},
+		},
+	})
+	return h
+}
+
+func newTestHeatPump(cfg HeatPumpConfig) *HeatPump {
+	cfg.Mode, cfg.Setpoint, cfg.Temperature = "pac-mode", "pac-setpoint", "pac-temp"
+	cfgs := []HeatPumpConfig{cfg}
+	setHeatPumpDefaults(cfgs)
+	cfg = cfgs[0]
+	return NewHeatPump(cfg, homeIOs(setupHeatPumpHome(), nil), uint64(murmur.Sum32(cfg.Mode)))
+}
+
+func TestHeatPump_Initial(t *testing.T) {
+	acc := newTestHeatPump(HeatPumpConfig{})
+	svc := acc.HeaterCooler
+	assert.Equal(t, "Heat pump", acc.AccessoryGet().Name())
+	assert.Equal(t, characteristic.ActiveActive, svc.Active.Value())
+	assert.Equal(t, characteristic.TargetHeaterCoolerStateHeat, svc.TargetHeaterCoolerState.Value())
+	assert.Equal(t, []int{characteristic.TargetHeaterCoolerStateHeat, characteristic.TargetHeaterCoolerStateCool}, svc.TargetHeaterCoolerState.ValidVals)
+	assert.Equal(t, 20.0, acc.HeatingThreshold.Value())
+	assert.Equal(t, 18.0, svc.CurrentTemperature.Value())
+	assert.Equal(t, characteristic.CurrentHeaterCoolerStateHeating, svc.CurrentHeaterCoolerState.Value())
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-temp", State: "21.5"}))
+	assert.Equal(t, characteristic.CurrentHeaterCoolerStateIdle, svc.CurrentHeaterCoolerState.Value())
+
+	// The setpoint follows the threshold of the current mode
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-setpoint", State: "22"}))
+	assert.Equal(t, 22.0, acc.HeatingThreshold.Value())
+	assert.Equal(t, characteristic.CurrentHeaterCoolerStateHeating, svc.CurrentHeaterCoolerState.Value())
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-mode", State: "0"}))
+	assert.Equal(t, characteristic.ActiveInactive, svc.Active.Value())
+	assert.Equal(t, characteristic.CurrentHeaterCoolerStateInactive, svc.CurrentHeaterCoolerState.Value())
+	assert.Equal(t, characteristic.TargetHeaterCoolerStateHeat, svc.TargetHeaterCoolerState.Value())
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "pac-mode", State: "7"}))
+	assert.Error(t, acc.Update(&CalaosIO{ID: "pac-temp", State: "invalid"}))
+}
+
+func TestHeatPump_Commands(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestHeatPump(HeatPumpConfig{})
+	svc := acc.HeaterCooler
+
+	remoteSet(acc.HeatingThreshold.C, 21.5)
+	assert.Equal(t, []string{"pac-setpoint=21.5"}, nextCommands(t, commands, 1))
+
+	// The cooling threshold does not apply while heating
+	remoteSet(acc.CoolingThreshold.C, 25.0)
+	remoteSet(svc.TargetHeaterCoolerState.C, characteristic.TargetHeaterCoolerStateCool)
+	assert.Equal(t, []string{"pac-mode=2", "pac-setpoint=25"}, nextCommands(t, commands, 2))
+
+	remoteSet(svc.Active.C, characteristic.ActiveInactive)
+	assert.Equal(t, []string{"pac-mode=0"}, nextCommands(t, commands, 1))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-mode", State: "0"}))
+
+	// The mode is kept while off
+	remoteSet(svc.TargetHeaterCoolerState.C, characteristic.TargetHeaterCoolerStateHeat)
+	remoteSet(svc.Active.C, characteristic.ActiveActive)
+	assert.Equal(t, []string{"pac-mode=1", "pac-setpoint=21.5"}, nextCommands(t, commands, 2))
+}
+
+func TestHeatPump_Auto(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestHeatPump(HeatPumpConfig{Modes: map[string]int{"off": 0, "auto": 3, "heat": 1}})
+	svc := acc.HeaterCooler
+	assert.Equal(t, []int{characteristic.TargetHeaterCoolerStateAuto, characteristic.TargetHeaterCoolerStateHeat}, svc.TargetHeaterCoolerState.ValidVals)
+
+	remoteSet(acc.CoolingThreshold.C, 24.0)
+	remoteSet(svc.TargetHeaterCoolerState.C, characteristic.TargetHeaterCoolerStateAuto)
+	assert.Equal(t, []string{"pac-mode=3", "pac-setpoint=22"}, nextCommands(t, commands, 2))
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-mode", State: "3"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "pac-temp", State: "26"}))
+	assert.Equal(t, characteristic.CurrentHeaterCoolerStateCooling, svc.CurrentHeaterCoolerState.Value())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTPShutdownTimeout is how long running requests get to finish when the HTTP server stops
+const HTTPShutdownTimeout = 5 * time.Second
+
+// HTTPConfig configures the optional HTTP server of the bridge
+type HTTPConfig struct {
+	Listen   string // address like ":9101", the HTTP server is disabled when empty
+	Admin    bool   // serve the admin page
+	APIToken string // bearer token of the REST API, the API is disabled when empty
+}
+
+var httpServer *http.Server
+
+// newHTTPHandler returns the routes served by the HTTP server
+func newHTTPHandler(cfg HTTPConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, metricsHandler())
+	mux.Handle(HealthzPath, healthHandler(func(r HealthReport) bool { return r.Healthy }))
+	mux.Handle(ReadyzPath, healthHandler(func(r HealthReport) bool { return r.Ready }))
+	if cfg.Admin {
+		mux.Handle(AdminPath, requireAdminAccess(cfg.APIToken, http.HandlerFunc(adminHandler)))
+	}
+	if cfg.APIToken != "" {
+		registerAPI(mux, cfg.APIToken)
+	}
+	return mux
+}
+
+// startHTTPServer serves newHTTPHandler on cfg.Listen, it does nothing when Listen is empty
+func startHTTPServer(cfg HTTPConfig) error {
+	if cfg.Listen == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           newHTTPHandler(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	httpServer = srv
+
+	log.Infof("HTTP server listening on %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopHTTPServer stops the running HTTP server
+func stopHTTPServer() {
+	if httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HTTPShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Warnf("HTTP server did not stop cleanly: %v", err)
+	}
+	httpServer = nil
+}
+
+// validateHTTPConfig checks the HTTP section of the configuration
+func validateHTTPConfig(cfg HTTPConfig) []error {
+	var errs []error
+	if cfg.Listen != "" {
+		if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+			errs = append(errs, &ConfigError{Field: "HTTP.Listen", Msg: err.Error()})
+		} else if _, err := net.LookupPort("tcp", port); err != nil {
+			errs = append(errs, &ConfigError{Field: "HTTP.Listen", Msg: err.Error()})
+		}
+	}
+	if cfg.APIToken != "" && len(cfg.APIToken) < MinAPITokenLength {
+		errs = append(errs, &ConfigError{Field: "HTTP.APIToken", Msg: fmt.Sprintf("must be at least %d characters", MinAPITokenLength)})
+	}
+	return errs
+}
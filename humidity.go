@@ -3,6 +3,8 @@ package main
 import (
 	"strconv"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/service"
 )
@@ -10,10 +12,14 @@ import (
 type Humidity struct {
 	*accessory.A
 	HumiditySensor *service.HumiditySensor
+
+	logger *log.Entry
 }
 
+var LogComponentHumidity = registerLogComponent("humidity")
+
 func NewHumiditySensor(cio CalaosIO, id uint64) *Humidity {
-	acc := Humidity{}
+	acc := Humidity{logger: accessoryLogger(LogComponentHumidity, cio, id)}
 	// info := accessory.Info{
 	// 	Name:         cio.Name,
 	// 	SerialNumber: cio.ID,
@@ -34,6 +40,7 @@ func (acc *Humidity) Update(cio *CalaosIO) error {
 	if h, err := strconv.ParseFloat(cio.State, 32); err == nil {
 		acc.HumiditySensor.CurrentRelativeHumidity.SetValue(h)
 	} else {
+		acc.logger.Debugf("invalid humidity %q, reporting 0", cio.State)
 		acc.HumiditySensor.CurrentRelativeHumidity.SetValue(0.0)
 	}
 	return nil
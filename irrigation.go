@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// Calaos relay outputs have no timer: the bridge turns valves off when their
+// SetDuration elapses. The end of every running timer is saved next to the
+// HAP store, so that a restart of the bridge still turns the valve off.
+
+// MaxValveDuration is the longest run duration HomeKit can set
+const MaxValveDuration = time.Hour
+
+// valveStateFile is the file, in the HAP store directory, keeping the valve timers
+const valveStateFile = "valves.json"
+
+var LogComponentIrrigation = registerLogComponent("irrigation")
+
+// valveState is what is saved of the valves across restarts, by output id
+type valveState struct {
+	Durations map[string]int       // SetDuration chosen in HomeKit, in seconds
+	Ends      map[string]time.Time // end of the running timers
+}
+
+// valveTimer turns a valve off at end
+type valveTimer struct {
+	timer *time.Timer
+	end   time.Time
+}
+
+// valveTimers are the running timers by output id, mu also guards the saved state
+var valveTimers = struct {
+	mu      sync.Mutex
+	running map[string]*valveTimer
+}{running: map[string]*valveTimer{}}
+
+// loadValveState reads the saved state of the valves, the caller holds valveTimers.mu
+func loadValveState() valveState {
+	st := valveState{}
+	if err := readStoreFile(valveStateFile, &st); err != nil {
+		componentLogger(LogComponentIrrigation).Warnf("Ignoring the saved valve timers: %v", err)
+	}
+	if st.Durations == nil {
+		st.Durations = map[string]int{}
+	}
+	if st.Ends == nil {
+		st.Ends = map[string]time.Time{}
+	}
+	return st
+}
+
+// changeValveState applies change to the saved state of the valves, the caller holds valveTimers.mu
+func changeValveState(change func(st *valveState)) {
+	st := loadValveState()
+	change(&st)
+	if err := writeStoreFile(valveStateFile, st); err != nil {
+		componentLogger(LogComponentIrrigation).Errorf("Failed to save the valve timers: %v", err)
+	}
+}
+
+// savedValveDuration returns the SetDuration saved for the output id, or def
+func savedValveDuration(id string, def int) int {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	if seconds, found := loadValveState().Durations[id]; found {
+		return seconds
+	}
+	return def
+}
+
+// saveValveDuration saves the SetDuration chosen in HomeKit for the output id
+func saveValveDuration(id string, seconds int) {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	changeValveState(func(st *valveState) { st.Durations[id] = seconds })
+}
+
+// startValveTimer turns the output id off after d
+func startValveTimer(id string, d time.Duration) {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	end := time.Now().Add(d)
+	scheduleValveOff(id, end)
+	changeValveState(func(st *valveState) { st.Ends[id] = end })
+}
+
+// stopValveTimer cancels the timer of the output id, when it runs
+func stopValveTimer(id string) {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	if vt, found := valveTimers.running[id]; found {
+		vt.timer.Stop()
+		delete(valveTimers.running, id)
+	}
+	if _, found := loadValveState().Ends[id]; found {
+		changeValveState(func(st *valveState) { delete(st.Ends, id) })
+	}
+}
+
+// valveRemaining returns the time left before the output id is turned off
+func valveRemaining(id string) time.Duration {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	vt, found := valveTimers.running[id]
+	if !found {
+		return 0
+	}
+	return max(time.Until(vt.end), 0)
+}
+
+// scheduleValveOff turns the output id off at end, the caller holds valveTimers.mu
+func scheduleValveOff(id string, end time.Time) {
+	if vt, found := valveTimers.running[id]; found {
+		vt.timer.Stop()
+	}
+	vt := &valveTimer{end: end}
+	vt.timer = time.AfterFunc(time.Until(end), func() {
+		valveTimers.mu.Lock()
+		defer valveTimers.mu.Unlock()
+		if valveTimers.running[id] != vt {
+			return
+		}
+		delete(valveTimers.running, id)
+		turnValveOff(id)
+	})
+	valveTimers.running[id] = vt
+}
+
+// turnValveOff turns off the output id whose timer elapsed, the caller holds valveTimers.mu
+func turnValveOff(id string) {
+	componentLogger(LogComponentIrrigation).WithField("io_id", id).Info("Valve duration elapsed, turning it off")
+	if err := CalaosUpdate(CalaosIO{ID: id, State: "false"}); err != nil {
+		// Still saved, the next login turns it off
+		return
+	}
+	changeValveState(func(st *valveState) { delete(st.Ends, id) })
+}
+
+// resumeValveTimers restarts the timers saved by a previous run of the bridge,
+// or still saved because Calaos could not be reached when they elapsed, for
+// the valves still on in h
+func resumeValveTimers(h CalaosJsonMsgHome) {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+
+	ends := loadValveState().Ends
+	if len(ends) == 0 {
+		return
+	}
+	states := map[string]string{}
+	for _, room := range h.Data.Home {
+		for _, cio := range room.IOs {
+			states[cio.ID] = cio.State
+		}
+	}
+
+	var stopped []string
+	for id, end := range ends {
+		if _, found := valveTimers.running[id]; found {
+			continue
+		}
+		on, _ := strconv.ParseBool(states[id])
+		switch {
+		case !on:
+			stopped = append(stopped, id)
+		case time.Until(end) <= 0:
+			turnValveOff(id)
+		default:
+			componentLogger(LogComponentIrrigation).WithField("io_id", id).Infof("Valve still on, turning it off at %s", end.Format(time.TimeOnly))
+			scheduleValveOff(id, end)
+		}
+	}
+	if len(stopped) > 0 {
+		changeValveState(func(st *valveState) {
+			for _, id := range stopped {
+				delete(st.Ends, id)
+			}
+		})
+	}
+}
+
+// timedValve is a Valve service switching a Calaos relay output, turned off by
+// the bridge when its SetDuration elapses
+type timedValve struct {
+	*service.Valve
+	SetDuration       *characteristic.SetDuration
+	RemainingDuration *characteristic.RemainingDuration
+
+	cio     CalaosIO
+	logger  *log.Entry
+	changed func() // called when the valve turns on or off, optional
+}
+
+// newTimedValve adds the duration characteristics to svc, duration is the
+// SetDuration until one is chosen in HomeKit
+func newTimedValve(svc *service.Valve, cio CalaosIO, duration time.Duration, logger *log.Entry) *timedValve {
+	v := timedValve{Valve: svc, cio: cio, logger: logger}
+
+	v.SetDuration = characteristic.NewSetDuration()
+	v.SetDuration.SetValue(savedValveDuration(cio.ID, int(duration.Seconds())))
+	svc.AddC(v.SetDuration.C)
+
+	v.RemainingDuration = characteristic.NewRemainingDuration()
+	v.RemainingDuration.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		return int(valveRemaining(cio.ID).Round(time.Second).Seconds()), 0
+	}
+	svc.AddC(v.RemainingDuration.C)
+
+	on, _ := strconv.ParseBool(cio.State)
+	v.show(on)
+
+	svc.Active.OnValueRemoteUpdate(func(active int) {
+		v.setActive(active == characteristic.ActiveActive)
+	})
+	v.SetDuration.OnValueRemoteUpdate(func(seconds int) {
+		// Applies to the next run, as HomeKit expects
+		saveValveDuration(cio.ID, seconds)
+	})
+
+	return &v
+}
+
+// setActive turns the valve on for its SetDuration, or off
+func (v *timedValve) setActive(on bool) {
+	setRelay(v.logger, v.cio, on)
+	if !on {
+		stopValveTimer(v.cio.ID)
+		v.RemainingDuration.SetValue(0)
+		return
+	}
+	if seconds := v.SetDuration.Value(); seconds > 0 {
+		startValveTimer(v.cio.ID, time.Duration(seconds)*time.Second)
+		v.RemainingDuration.SetValue(seconds)
+	}
+}
+
+// show sets Active and InUse from the state of the output
+func (v *timedValve) show(on bool) {
+	v.Active.SetValue(activeValue(on))
+	if on {
+		v.InUse.SetValue(characteristic.InUseInUse)
+	} else {
+		v.InUse.SetValue(characteristic.InUseNotInUse)
+		v.RemainingDuration.SetValue(0)
+	}
+	if v.changed != nil {
+		v.changed()
+	}
+}
+
+func (v *timedValve) Update(cio *CalaosIO) error {
+	on, err := strconv.ParseBool(cio.State)
+	if err != nil {
+		return err
+	}
+	if !on {
+		// Turned off before the end of its duration
+		stopValveTimer(v.cio.ID)
+	}
+	v.show(on)
+	return nil
+}
+
+// IrrigationZoneConfig is a zone of an irrigation system
+type IrrigationZoneConfig struct {
+	Name     string   // name shown in HomeKit, defaults to the name of the Output IO
+	Output   string   // relay output of the zone
+	Duration Duration // run duration until one is chosen in HomeKit, 0 runs until turned off
+}
+
+// IrrigationSystemConfig groups relay outputs as the zones of a sprinkler
+type IrrigationSystemConfig struct {
+	Name  string // name shown in HomeKit, defaults to Irrigation
+	Zones []IrrigationZoneConfig
+}
+
+func (cfg IrrigationSystemConfig) ios() []string {
+	var ios []string
+	for _, zone := range cfg.Zones {
+		if zone.Output != "" {
+			ios = append(ios, zone.Output)
+		}
+	}
+	return ios
+}
+
+func (cfg IrrigationSystemConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewIrrigationSystem(cfg, ios, id)
+}
+
+// validateIrrigationSystems checks the IrrigationSystems section of the configuration
+func validateIrrigationSystems(cfgs []IrrigationSystemConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("IrrigationSystems[%d].%s", i, field), Msg: msg})
+		}
+		if len(cfg.Zones) == 0 {
+			fail("Zones", "at least one zone is required")
+		}
+		for j, zone := range cfg.Zones {
+			if zone.Output == "" {
+				fail(fmt.Sprintf("Zones[%d].Output", j), "is required")
+			}
+			if zone.Duration.Duration < 0 || zone.Duration.Duration > MaxValveDuration {
+				fail(fmt.Sprintf("Zones[%d].Duration", j), fmt.Sprintf("must be between 0 and %s", MaxValveDuration))
+			}
+		}
+	}
+	return errs
+}
+
+// IrrigationSystem is a sprinkler whose zones are valves linked to the
+// IrrigationSystem service. Turning the system off turns every zone off.
+type IrrigationSystem struct {
+	*accessory.A
+	IrrigationSystem *service.IrrigationSystem
+	Zones            []*timedValve
+
+	zones map[string]*timedValve // by output id
+}
+
+func NewIrrigationSystem(cfg IrrigationSystemConfig, ios map[string]CalaosIO, id uint64) *IrrigationSystem {
+	first := ios[cfg.Zones[0].Output]
+	acc := IrrigationSystem{zones: map[string]*timedValve{}}
+
+	name := cfg.Name
+	if name == "" {
+		name = "Irrigation"
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: first.ID,
+		Manufacturer: "Calaos",
+		Model:        first.IoType,
+	}, accessory.TypeSprinkler)
+	acc.A.Id = id
+
+	system := service.NewIrrigationSystem()
+	system.Active.SetValue(characteristic.ActiveActive)
+	system.ProgramMode.SetValue(characteristic.ProgramModeNoProgramScheduled)
+	acc.IrrigationSystem = system
+	acc.AddS(system.S)
+
+	for i, zone := range cfg.Zones {
+		cio := ios[zone.Output]
+		svc := service.NewValve()
+		svc.ValveType.SetValue(characteristic.ValveTypeIrrigation)
+
+		zoneName := characteristic.NewName()
+		zoneName.SetValue(cio.Name)
+		if zone.Name != "" {
+			zoneName.SetValue(zone.Name)
+		}
+		svc.AddC(zoneName.C)
+		index := characteristic.NewServiceLabelIndex()
+		index.SetValue(i + 1)
+		svc.AddC(index.C)
+		configured := characteristic.NewIsConfigured()
+		configured.SetValue(characteristic.IsConfiguredConfigured)
+		svc.AddC(configured.C)
+
+		v := newTimedValve(svc, cio, zone.Duration.Duration, accessoryLogger(LogComponentIrrigation, cio, id))
+		v.changed = acc.refresh
+		acc.Zones = append(acc.Zones, v)
+		acc.zones[cio.ID] = v
+		system.AddS(svc.S)
+		acc.AddS(svc.S)
+	}
+	acc.refresh()
+
+	system.Active.OnValueRemoteUpdate(func(active int) {
+		if active == characteristic.ActiveActive {
+			return
+		}
+		for _, v := range acc.Zones {
+			if v.Active.Value() == characteristic.ActiveActive {
+				v.setActive(false)
+			}
+		}
+	})
+
+	return &acc
+}
+
+// refresh shows the system in use while a zone is on
+func (acc *IrrigationSystem) refresh() {
+	inUse := characteristic.InUseNotInUse
+	for _, v := range acc.Zones {
+		if v.InUse.Value() == characteristic.InUseInUse {
+			inUse = characteristic.InUseInUse
+		}
+	}
+	acc.IrrigationSystem.InUse.SetValue(inUse)
+	if inUse == characteristic.InUseInUse {
+		// A system running a zone is active
+		acc.IrrigationSystem.Active.SetValue(characteristic.ActiveActive)
+	}
+}
+
+func (acc *IrrigationSystem) Update(cio *CalaosIO) error {
+	if v, found := acc.zones[cio.ID]; found {
+		return v.Update(cio)
+	}
+	return nil
+}
+
+func (acc *IrrigationSystem) AccessoryGet() *accessory.A {
+	return acc.A
+}
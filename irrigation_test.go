@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// useTempValveState keeps the saved valve timers of the test in a temporary
+// directory, and stops its timers at the end
+func useTempValveState(t *testing.T) string {
+	previous := hapStorePath
+	hapStorePath = t.TempDir()
+	t.Cleanup(func() {
+		valveTimers.mu.Lock()
+		for id, vt := range valveTimers.running {
+			vt.timer.Stop()
+			delete(valveTimers.running, id)
+		}
+		valveTimers.mu.Unlock()
+		hapStorePath = previous
+	})
+	return hapStorePath
+}
+
+func savedValveState() valveState {
+	valveTimers.mu.Lock()
+	defer valveTimers.mu.Unlock()
+	return loadValveState()
+}
+
+// setupIrrigationHome adds two garden zones, off, to the test home
+func setupIrrigationHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Garden",
+		IOs: []CalaosIO{
+			{ID: "zone-lawn", Name: "Lawn", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "false"},
+			{ID: "zone-hedge", Name: "Hedge", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "false"},
+		},
+	})
+	return h
+}
+
+func TestValve_Duration(t *testing.T) {
+	useTempValveState(t)
+	commands := captureCommands(t)
+	acc := NewValve(relayIO(CalaosIOStyleIrrigation, "false"), 12345)
+	valve := acc.Valve
+	assert.Equal(t, 0, valve.SetDuration.Value())
+
+	remoteSet(valve.SetDuration.C, 600)
+	assert.Equal(t, 600, savedValveState().Durations["test-relay-1"])
+
+	remoteSet(valve.Active.C, characteristic.ActiveActive)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "test-relay-1", id)
+	assert.Equal(t, "true", value)
+	assert.Equal(t, 600, valve.RemainingDuration.Value())
+	assert.InDelta(t, 600, valveRemaining("test-relay-1").Seconds(), 1)
+	assert.Contains(t, savedValveState().Ends, "test-relay-1")
+
+	// Turned off in Calaos before the end
+	require.NoError(t, acc.Update(&CalaosIO{ID: "test-relay-1", State: "true"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "test-relay-1", State: "false"}))
+	assert.Equal(t, 0, valve.RemainingDuration.Value())
+	assert.Zero(t, valveRemaining("test-relay-1"))
+	assert.Empty(t, savedValveState().Ends)
+
+	// The duration survives a restart
+	acc = NewValve(relayIO(CalaosIOStyleIrrigation, "false"), 12345)
+	assert.Equal(t, 600, acc.Valve.SetDuration.Value())
+}
+
+func TestValve_WithoutDuration(t *testing.T) {
+	useTempValveState(t)
+	commands := captureCommands(t)
+	acc := NewValve(relayIO(CalaosIOStylePump, "false"), 12345)
+
+	remoteSet(acc.Valve.Active.C, characteristic.ActiveActive)
+	nextCommand(t, commands)
+	assert.Zero(t, valveRemaining("test-relay-1"))
+	assert.Empty(t, savedValveState().Ends)
+}
+
+func TestValveTimer_Expires(t *testing.T) {
+	useTempValveState(t)
+	commands := captureCommands(t)
+
+	startValveTimer("zone-lawn", 20*time.Millisecond)
+	assert.Contains(t, savedValveState().Ends, "zone-lawn")
+
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "zone-lawn", id)
+	assert.Equal(t, "false", value)
+	require.Eventually(t, func() bool {
+		return len(savedValveState().Ends) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestResumeValveTimers(t *testing.T) {
+	dir := useTempValveState(t)
+	commands := captureCommands(t)
+
+	now := time.Now()
+	data, err := json.Marshal(valveState{Ends: map[string]time.Time{
+		"zone-lawn":  now.Add(-time.Minute), // on, past its end
+		"zone-hedge": now.Add(time.Hour),    // on, still running
+		"zone-gone":  now.Add(time.Hour),    // turned off while the bridge was down
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, valveStateFile), data, 0600))
+
+	h := setupIrrigationHome()
+	for i := range h.Data.Home[len(h.Data.Home)-1].IOs {
+		h.Data.Home[len(h.Data.Home)-1].IOs[i].State = "true"
+	}
+	resumeValveTimers(h)
+
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "zone-lawn", id)
+	assert.Equal(t, "false", value)
+	assert.InDelta(t, time.Hour.Seconds(), valveRemaining("zone-hedge").Seconds(), 1)
+
+	ends := savedValveState().Ends
+	assert.Len(t, ends, 1)
+	assert.Contains(t, ends, "zone-hedge")
+
+	// Running timers are kept on the next login
+	resumeValveTimers(h)
+	noCommand(t, commands, 50*time.Millisecond)
+}
+
+func TestIrrigationSystem(t *testing.T) {
+	useTempValveState(t)
+	commands := captureCommands(t)
+
+	cfg := setupTestConfig()
+	cfg.IrrigationSystems = []IrrigationSystemConfig{{
+		Name: "Garden",
+		Zones: []IrrigationZoneConfig{
+			{Output: "zone-lawn", Duration: Duration{15 * time.Minute}},
+			{Name: "Hedges", Output: "zone-hedge"},
+		},
+	}}
+	id := uint64(murmur.Sum32("zone-lawn"))
+	accs, _ := buildAccessories(setupIrrigationHome(), cfg)
+	require.Contains(t, accs, id)
+	acc := accs[id].(*IrrigationSystem)
+	assert.Equal(t, "Garden", acc.AccessoryGet().Name())
+
+	system := acc.IrrigationSystem
+	require.Len(t, acc.Zones, 2)
+	assert.Len(t, system.Linked, 2)
+	lawn, hedge := acc.Zones[0], acc.Zones[1]
+	assert.Equal(t, "Lawn", lawn.C(characteristic.TypeName).Value())
+	assert.Equal(t, "Hedges", hedge.C(characteristic.TypeName).Value())
+	assert.Equal(t, 2, hedge.C(characteristic.TypeServiceLabelIndex).Value())
+	assert.Equal(t, 900, lawn.SetDuration.Value())
+	assert.Equal(t, 0, hedge.SetDuration.Value())
+	assert.Equal(t, characteristic.InUseNotInUse, system.InUse.Value())
+
+	remoteSet(lawn.Active.C, characteristic.ActiveActive)
+	zone, value := nextCommand(t, commands)
+	assert.Equal(t, "zone-lawn", zone)
+	assert.Equal(t, "true", value)
+	assert.InDelta(t, 900, valveRemaining("zone-lawn").Seconds(), 1)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "zone-lawn", State: "true"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "zone-hedge", State: "true"}))
+	assert.Equal(t, characteristic.InUseInUse, system.InUse.Value())
+	assert.Equal(t, characteristic.ActiveActive, system.Active.Value())
+
+	// Turning the system off turns every zone off
+	remoteSet(system.Active.C, characteristic.ActiveInactive)
+	off := map[string]string{}
+	for range 2 {
+		zone, value := nextCommand(t, commands)
+		off[zone] = value
+	}
+	assert.Equal(t, map[string]string{"zone-lawn": "false", "zone-hedge": "false"}, off)
+	assert.Zero(t, valveRemaining("zone-lawn"))
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "zone-lawn", State: "false"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "zone-hedge", State: "false"}))
+	assert.Equal(t, characteristic.InUseNotInUse, system.InUse.Value())
+	assert.Error(t, acc.Update(&CalaosIO{ID: "zone-hedge", State: "invalid"}))
+}
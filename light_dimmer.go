@@ -13,10 +13,14 @@ type LightDimmer struct {
 	*accessory.Lightbulb
 	Brightness *characteristic.Brightness
 	Name       *characteristic.Name
+
+	logger *log.Entry
 }
 
+var LogComponentLightDimmer = registerLogComponent("light_dimmer")
+
 func NewLightDimmer(cio CalaosIO, id uint64) *LightDimmer {
-	acc := LightDimmer{}
+	acc := LightDimmer{logger: accessoryLogger(LogComponentLightDimmer, cio, id)}
 	info := accessory.Info{
 		Name:         cio.Name,
 		SerialNumber: cio.ID,
@@ -37,11 +41,11 @@ func NewLightDimmer(cio CalaosIO, id uint64) *LightDimmer {
 
 	acc.Lightbulb.Lightbulb.On.OnValueRemoteUpdate(func(on bool) {
 		if on == true {
-			log.Debug("Switch is on")
+			acc.logger.Debug("Switch is on")
 			cio.State = "true"
 			CalaosUpdate(cio)
 		} else {
-			log.Debug("Switch is off")
+			acc.logger.Debug("Switch is off")
 			cio.State = "false"
 			CalaosUpdate(cio)
 		}
@@ -56,7 +60,7 @@ func NewLightDimmer(cio CalaosIO, id uint64) *LightDimmer {
 }
 
 func (acc *LightDimmer) Update(cio *CalaosIO) error {
-	log.Debug("try to update val ", cio.State)
+	acc.logger.Debug("try to update val ", cio.State)
 	if cio.GuiType == "light_dimmer" {
 		v, err := strconv.Atoi(cio.State)
 		if err == nil {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// DefaultLockTimeout is the default time a lock takes to lock or unlock
+const DefaultLockTimeout = 10 * time.Second
+
+// LockConfig describes a lock made of a Calaos output and an optional status input
+type LockConfig struct {
+	Name    string   // name shown in HomeKit, defaults to the name of the Command IO
+	Command string   // output true to lock, false to unlock
+	Pulse   Duration // when set, Command receives an impulse of this length to lock and to unlock
+	Status  string   // input true while locked
+	Timeout Duration // time the lock takes to move, it is jammed when Status disagrees after it
+}
+
+func (cfg LockConfig) ios() []string {
+	if cfg.Status == "" {
+		return []string{cfg.Command}
+	}
+	return []string{cfg.Command, cfg.Status}
+}
+
+func (cfg LockConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewLock(cfg, ios, id)
+}
+
+// setLockDefaults fills the optional fields of the Locks entries
+func setLockDefaults(cfgs []LockConfig) {
+	for i := range cfgs {
+		if cfgs[i].Timeout.Duration == 0 {
+			cfgs[i].Timeout.Duration = DefaultLockTimeout
+		}
+	}
+}
+
+// validateLocks checks the Locks section of the configuration
+func validateLocks(cfgs []LockConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("Locks[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.Command == "" {
+			fail("Command", "is required")
+		}
+		if cfg.Pulse.Duration < 0 {
+			fail("Pulse", "must be positive")
+		} else if cfg.Pulse.Duration > 0 && cfg.Status == "" {
+			fail("Status", "is required with Pulse, an impulse does not tell the lock state")
+		}
+		if cfg.Timeout.Duration < 0 {
+			fail("Timeout", "must be positive")
+		}
+	}
+	return errs
+}
+
+// lockState returns the LockCurrentState or LockTargetState value of locked,
+// both use the same values
+func lockState(locked bool) int {
+	if locked {
+		return characteristic.LockCurrentStateSecured
+	}
+	return characteristic.LockCurrentStateUnsecured
+}
+
+// Lock drives a Calaos output from LockTargetState and reads LockCurrentState
+// back from the status input, the lock is jammed when they still disagree
+// after the timeout
+type Lock struct {
+	*accessory.A
+	LockMechanism *service.LockMechanism
+
+	config  LockConfig
+	command CalaosIO
+	logger  *log.Entry
+
+	mu          sync.Mutex
+	statusKnown bool // the status input has a valid state
+	locked      bool // state of the status input
+	jammed      bool
+	timer       *time.Timer // running while the lock moves
+}
+
+var LogComponentLock = registerLogComponent("lock")
+
+func NewLock(cfg LockConfig, ios map[string]CalaosIO, id uint64) *Lock {
+	command := ios[cfg.Command]
+	acc := Lock{
+		config:  cfg,
+		command: command,
+		logger:  accessoryLogger(LogComponentLock, command, id),
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = command.Name
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: command.ID,
+		Manufacturer: "Calaos",
+		Model:        command.IoType,
+	}, accessory.TypeDoorLock)
+	acc.A.Id = id
+
+	acc.LockMechanism = service.NewLockMechanism()
+	acc.AddS(acc.LockMechanism.S)
+
+	svc := acc.LockMechanism
+	output, outputErr := strconv.ParseBool(command.State)
+	if cfg.Pulse.Duration > 0 {
+		// An impulse output does not tell the lock state
+		outputErr = strconv.ErrSyntax
+	}
+	if cfg.Status != "" {
+		locked, err := strconv.ParseBool(ios[cfg.Status].State)
+		acc.locked, acc.statusKnown = locked, err == nil
+	}
+
+	switch {
+	case cfg.Status == "":
+		svc.LockTargetState.SetValue(lockState(output))
+		svc.LockCurrentState.SetValue(lockState(output))
+	case acc.statusKnown:
+		svc.LockTargetState.SetValue(lockState(acc.locked))
+		acc.showStatus()
+		if outputErr == nil && output != acc.locked {
+			// The lock may still be moving to the output state
+			acc.expect(lockState(output))
+		}
+	default:
+		if outputErr == nil {
+			svc.LockTargetState.SetValue(lockState(output))
+		} else {
+			svc.LockTargetState.SetValue(characteristic.LockTargetStateSecured)
+		}
+		acc.showStatus()
+	}
+
+	svc.LockTargetState.OnValueRemoteUpdate(func(target int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.moveTo(target)
+	})
+
+	return &acc
+}
+
+// moveTo sends the command moving the lock to target, the caller holds mu
+func (acc *Lock) moveTo(target int) {
+	cio := acc.command
+	if acc.config.Pulse.Duration > 0 {
+		if acc.timer == nil && acc.statusKnown && lockState(acc.locked) == target {
+			// An impulse toggles the lock, it would leave the target
+			acc.logger.Debugf("Lock already in state %d", target)
+			acc.expect(target)
+			return
+		}
+		cio.State = fmt.Sprintf("impulse %d", acc.config.Pulse.Milliseconds())
+	} else {
+		cio.State = strconv.FormatBool(target == characteristic.LockTargetStateSecured)
+	}
+	acc.logger.Debugf("Moving lock to %d", target)
+	if err := CalaosUpdate(cio); err != nil {
+		return
+	}
+	acc.expect(target)
+}
+
+// expect shows the lock moving to target, the status input has to confirm it
+// within the timeout, the caller holds mu
+func (acc *Lock) expect(target int) {
+	svc := acc.LockMechanism
+	svc.LockTargetState.SetValue(target)
+	if acc.config.Status == "" {
+		// Nothing tells otherwise
+		svc.LockCurrentState.SetValue(target)
+		return
+	}
+
+	acc.jammed = false
+	acc.stopTimer()
+	if acc.statusKnown && lockState(acc.locked) == target {
+		acc.showStatus()
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(acc.config.Timeout.Duration, func() {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if acc.timer != timer {
+			return
+		}
+		acc.timer = nil
+		if !acc.statusKnown || lockState(acc.locked) != target {
+			acc.logger.Warnf("Lock did not reach state %d in %s, jammed", target, acc.config.Timeout.Duration)
+			acc.jammed = true
+		}
+		acc.showStatus()
+	})
+	acc.timer = timer
+}
+
+// showStatus sets LockCurrentState from the status input, the caller holds mu
+func (acc *Lock) showStatus() {
+	state := lockState(acc.locked)
+	switch {
+	case acc.jammed:
+		state = characteristic.LockCurrentStateJammed
+	case !acc.statusKnown:
+		state = characteristic.LockCurrentStateUnknown
+	}
+	acc.LockMechanism.LockCurrentState.SetValue(state)
+}
+
+// stopTimer stops the timeout timer, the caller holds mu
+func (acc *Lock) stopTimer() {
+	if acc.timer != nil {
+		acc.timer.Stop()
+		acc.timer = nil
+	}
+}
+
+func (acc *Lock) Update(cio *CalaosIO) error {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	v, err := strconv.ParseBool(cio.State)
+	switch cio.ID {
+	case acc.config.Status:
+		acc.statusKnown = err == nil
+		acc.locked = v
+		target := acc.LockMechanism.LockTargetState.Value()
+		if acc.timer != nil {
+			if acc.statusKnown && lockState(v) == target {
+				acc.stopTimer()
+			}
+		} else if acc.statusKnown {
+			// Locked or unlocked by hand or from Calaos
+			acc.jammed = false
+			acc.LockMechanism.LockTargetState.SetValue(lockState(v))
+		}
+		acc.showStatus()
+
+	case acc.config.Command:
+		if acc.config.Pulse.Duration > 0 {
+			// An impulse output does not tell the lock state, its echoes
+			// like "impulse 500" are not errors
+			return nil
+		}
+		if err != nil {
+			break
+		}
+		if target := lockState(v); target != acc.LockMechanism.LockTargetState.Value() {
+			// Changed from Calaos
+			acc.expect(target)
+		}
+	}
+	return err
+}
+
+func (acc *Lock) AccessoryGet() *accessory.A {
+	return acc.A
+}
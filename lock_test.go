@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// lockTimeout keeps the moves of the test locks short
+const lockTimeout = 50 * time.Millisecond
+
+// setupLockHome adds a locked front door lock to the test home
+func setupLockHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Entrance",
+		IOs: []CalaosIO{
+			{ID: "lock-cmd", Name: "Front door", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "true"},
+			{ID: "lock-status", Name: "Front door locked", GuiType: "switch", IoType: "input", Visible: "true", State: "true"},
+		},
+	})
+	return h
+}
+
+func lockConfig(status string, pulse time.Duration) LockConfig {
+	cfgs := []LockConfig{{Command: "lock-cmd", Status: status, Pulse: Duration{pulse}}}
+	setLockDefaults(cfgs)
+	cfgs[0].Timeout.Duration = lockTimeout
+	return cfgs[0]
+}
+
+func newTestLock(cfg LockConfig, states map[string]string) *Lock {
+	return NewLock(cfg, homeIOs(setupLockHome(), states), uint64(murmur.Sum32(cfg.Command)))
+}
+
+func lockStates(acc *Lock) (current, target int) {
+	return acc.LockMechanism.LockCurrentState.Value(), acc.LockMechanism.LockTargetState.Value()
+}
+
+func waitLockState(t *testing.T, acc *Lock, state int) {
+	require.Eventually(t, func() bool {
+		current, _ := lockStates(acc)
+		return current == state
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestLock_InitialState(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		pulse   time.Duration
+		states  map[string]string
+		current int
+		target  int
+	}{
+		{"locked", "lock-status", 0, nil, characteristic.LockCurrentStateSecured, characteristic.LockTargetStateSecured},
+		{"unlocked", "lock-status", 0, map[string]string{"lock-cmd": "false", "lock-status": "false"}, characteristic.LockCurrentStateUnsecured, characteristic.LockTargetStateUnsecured},
+		{"unknown status", "lock-status", 0, map[string]string{"lock-status": ""}, characteristic.LockCurrentStateUnknown, characteristic.LockTargetStateSecured},
+		{"pulse", "lock-status", time.Second, map[string]string{"lock-cmd": "false"}, characteristic.LockCurrentStateSecured, characteristic.LockTargetStateSecured},
+		{"without status", "", 0, map[string]string{"lock-cmd": "false"}, characteristic.LockCurrentStateUnsecured, characteristic.LockTargetStateUnsecured},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := newTestLock(lockConfig(tt.status, tt.pulse), tt.states)
+			current, target := lockStates(acc)
+			assert.Equal(t, tt.current, current)
+			assert.Equal(t, tt.target, target)
+			assert.Equal(t, "Front door", acc.AccessoryGet().Name())
+		})
+	}
+}
+
+func TestLock_Unlock(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestLock(lockConfig("lock-status", 0), nil)
+
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateUnsecured)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "lock-cmd", id)
+	assert.Equal(t, "false", value)
+	current, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateSecured, current)
+	assert.Equal(t, characteristic.LockTargetStateUnsecured, target)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-cmd", State: "false"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-status", State: "false"}))
+	current, _ = lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnsecured, current)
+
+	// The timeout was stopped
+	time.Sleep(2 * lockTimeout)
+	current, _ = lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnsecured, current)
+}
+
+func TestLock_Pulse(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestLock(lockConfig("lock-status", 500*time.Millisecond), map[string]string{"lock-status": "false"})
+
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateSecured)
+	_, value := nextCommand(t, commands)
+	assert.Equal(t, "impulse 500", value)
+
+	// Events of an impulse output do not move the lock, whatever their state
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-cmd", State: "false"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-cmd", State: "impulse 500"}))
+	_, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockTargetStateSecured, target)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "lock-status", State: "impulse 500"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-status", State: "true"}))
+	current, _ := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateSecured, current)
+}
+
+func TestLock_PulseAlreadyAtTarget(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestLock(lockConfig("lock-status", 500*time.Millisecond), nil)
+
+	// Already locked, an impulse would unlock it
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateSecured)
+	noCommand(t, commands, 2*lockTimeout)
+	current, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateSecured, current)
+	assert.Equal(t, characteristic.LockTargetStateSecured, target)
+
+	// Locking again while unlocking needs another impulse
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateUnsecured)
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateSecured)
+	assert.Equal(t, []string{"lock-cmd=impulse 500", "lock-cmd=impulse 500"}, nextCommands(t, commands, 2))
+}
+
+func TestLock_Jammed(t *testing.T) {
+	captureCommands(t)
+	acc := newTestLock(lockConfig("lock-status", 0), nil)
+
+	remoteSet(acc.LockMechanism.LockTargetState.C, characteristic.LockTargetStateUnsecured)
+	waitLockState(t, acc, characteristic.LockCurrentStateJammed)
+
+	// The status reaching a state clears it
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-status", State: "false"}))
+	current, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnsecured, current)
+	assert.Equal(t, characteristic.LockTargetStateUnsecured, target)
+}
+
+func TestLock_Disagree(t *testing.T) {
+	// The output unlocks but the status stays locked
+	acc := newTestLock(lockConfig("lock-status", 0), map[string]string{"lock-cmd": "false"})
+	_, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockTargetStateUnsecured, target)
+	waitLockState(t, acc, characteristic.LockCurrentStateJammed)
+
+	// Same from a Calaos event
+	acc = newTestLock(lockConfig("lock-status", 0), nil)
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-cmd", State: "false"}))
+	waitLockState(t, acc, characteristic.LockCurrentStateJammed)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "lock-status", State: "invalid"}))
+	current, _ := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateJammed, current)
+}
+
+func TestLock_OperatedOutsideHomeKit(t *testing.T) {
+	acc := newTestLock(lockConfig("lock-status", 0), nil)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-status", State: "false"}))
+	current, target := lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnsecured, current)
+	assert.Equal(t, characteristic.LockTargetStateUnsecured, target)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "lock-status", State: "invalid"}))
+	current, _ = lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnknown, current)
+
+	// Without status, the output tells the state
+	acc = newTestLock(lockConfig("", 0), nil)
+	require.NoError(t, acc.Update(&CalaosIO{ID: "lock-cmd", State: "false"}))
+	current, target = lockStates(acc)
+	assert.Equal(t, characteristic.LockCurrentStateUnsecured, current)
+	assert.Equal(t, characteristic.LockTargetStateUnsecured, target)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	stdlog "log"
+	"os"
+	"sync"
+
+	haplog "github.com/brutella/hap/log"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log rotation defaults
+const (
+	DefaultLogMaxSize    = 10 // megabytes
+	DefaultLogMaxBackups = 5
+)
+
+// Log components, their level can be set in Log.Components
+const (
+	LogComponentMain      = "main"
+	LogComponentWebSocket = "websocket"
+	LogComponentHAP       = "hap"
+)
+
+// logComponents lists the valid component names, accessory types add their own
+var logComponents = []string{LogComponentMain, LogComponentWebSocket, LogComponentHAP}
+
+type LogConfig struct {
+	Level      string            // panic, fatal, error, warn, info, debug or trace, info by default
+	Format     string            // text or json, text by default
+	File       string            // log file, standard error when empty
+	MaxSize    int               // size in megabytes before the log file is rotated, 10 by default
+	MaxBackups int               // rotated log files kept, 5 by default
+	Components map[string]string // level by component, overrides Level
+}
+
+// Command line overrides of the log configuration
+var (
+	logLevelFlag  string
+	logFormatFlag string
+	logFileFlag   string
+)
+
+var (
+	logMu            sync.Mutex
+	logConfig        LogConfig
+	logFile          *lumberjack.Logger
+	componentLoggers = map[string]*log.Logger{LogComponentMain: log.StandardLogger()}
+)
+
+func init() {
+	// Route the HAP library logs through the hap component
+	hapLogger := componentLogger(LogComponentHAP)
+	haplog.Debug.SetOutput(&logWriter{entry: hapLogger, level: log.DebugLevel})
+	haplog.Debug.SetFlags(stdlog.Lshortfile)
+	haplog.Debug.SetPrefix("")
+	haplog.Info.SetOutput(&logWriter{entry: hapLogger, level: log.InfoLevel})
+	haplog.Info.SetFlags(stdlog.Lshortfile)
+	haplog.Info.SetPrefix("")
+}
+
+// registerLogComponent adds a component name accepted in Log.Components
+func registerLogComponent(name string) string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, c := range logComponents {
+		if c == name {
+			return name
+		}
+	}
+	logComponents = append(logComponents, name)
+	return name
+}
+
+// componentLogger returns the logger of a component. All components share the
+// output and format of the standard logger, their level can differ.
+func componentLogger(name string) *log.Entry {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	l, found := componentLoggers[name]
+	if !found {
+		std := log.StandardLogger()
+		l = log.New()
+		l.SetOutput(std.Out)
+		l.SetFormatter(std.Formatter)
+		l.SetLevel(componentLevel(logConfig, name, std.GetLevel()))
+		componentLoggers[name] = l
+	}
+	if name == LogComponentMain {
+		return log.NewEntry(l)
+	}
+	return l.WithField("component", name)
+}
+
+// accessoryLogger returns the logger of an accessory type with the fields identifying the accessory
+func accessoryLogger(component string, cio CalaosIO, id uint64) *log.Entry {
+	return componentLogger(component).WithFields(ioFields(cio.ID, id))
+}
+
+// ioFields identifies an IO and its accessory in log entries
+func ioFields(ioID string, accessoryID uint64) log.Fields {
+	return log.Fields{"io_id": ioID, "accessory_id": accessoryID}
+}
+
+func componentLevel(cfg LogConfig, name string, fallback log.Level) log.Level {
+	if level, err := log.ParseLevel(cfg.Components[name]); err == nil {
+		return level
+	}
+	if level, err := log.ParseLevel(cfg.Level); err == nil {
+		return level
+	}
+	return fallback
+}
+
+// withLogFlags returns cfg overridden by the command line flags
+func withLogFlags(cfg LogConfig) LogConfig {
+	if logLevelFlag != "" {
+		cfg.Level = logLevelFlag
+	}
+	if logFormatFlag != "" {
+		cfg.Format = logFormatFlag
+	}
+	if logFileFlag != "" {
+		cfg.File = logFileFlag
+	}
+	return cfg
+}
+
+// applyLogConfig sets the level, format and output of every component,
+// the configuration is validated beforehand
+func applyLogConfig(cfg LogConfig) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	var formatter log.Formatter = &log.TextFormatter{}
+	if cfg.Format == LogFormatJSON {
+		formatter = &log.JSONFormatter{}
+	}
+
+	var out io.Writer = os.Stderr
+	if cfg.File != "" {
+		if logFile == nil || logFile.Filename != cfg.File || logFile.MaxSize != cfg.MaxSize || logFile.MaxBackups != cfg.MaxBackups {
+			if logFile != nil {
+				logFile.Close()
+			}
+			logFile = &lumberjack.Logger{
+				Filename:   cfg.File,
+				MaxSize:    cfg.MaxSize,
+				MaxBackups: cfg.MaxBackups,
+			}
+		}
+		out = logFile
+	} else if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+
+	logConfig = cfg
+	for name, l := range componentLoggers {
+		l.SetOutput(out)
+		l.SetFormatter(formatter)
+		l.SetLevel(componentLevel(cfg, name, log.InfoLevel))
+	}
+}
+
+// logWriter logs each line written by a standard library logger
+type logWriter struct {
+	entry *log.Entry
+	level log.Level
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.entry.Logger.IsLevelEnabled(w.level) {
+		w.entry.Log(w.level, string(bytes.TrimRight(p, "\n")))
+	}
+	return len(p), nil
+}
+
+func isLogComponent(name string) bool {
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, c := range logComponents {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
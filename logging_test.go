@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	haplog "github.com/brutella/hap/log"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readJSONLogs returns the entries of a JSON log file
+func readJSONLogs(t *testing.T, filename string) []map[string]interface{} {
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestApplyLogConfig_ComponentLevels(t *testing.T) {
+	t.Cleanup(func() { applyLogConfig(LogConfig{}) })
+
+	applyLogConfig(LogConfig{
+		Level:      "warn",
+		Components: map[string]string{LogComponentWebSocket: "debug"},
+	})
+
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+	assert.Equal(t, log.DebugLevel, componentLogger(LogComponentWebSocket).Logger.GetLevel())
+	assert.Equal(t, log.WarnLevel, componentLogger(LogComponentLightDimmer).Logger.GetLevel())
+
+	// Components created later get their level too
+	name := registerLogComponent("test_component")
+	assert.Equal(t, log.WarnLevel, componentLogger(name).Logger.GetLevel())
+}
+
+func TestApplyLogConfig_JSONFile(t *testing.T) {
+	t.Cleanup(func() { applyLogConfig(LogConfig{}) })
+	filename := filepath.Join(t.TempDir(), "calaos-homekit.log")
+
+	applyLogConfig(LogConfig{
+		Level:      "info",
+		Format:     LogFormatJSON,
+		File:       filename,
+		MaxSize:    1,
+		MaxBackups: 1,
+		Components: map[string]string{LogComponentLightDimmer: "debug"},
+	})
+
+	cio := CalaosIO{ID: "io_1", Name: "Light", GuiType: CalaosGuiTypeLightDimmer, State: "10"}
+	NewLightDimmer(cio, 42)
+	log.Info("main message")
+	haplog.Info.Println("hap message")
+	componentLogger(LogComponentWebSocket).Debug("hidden websocket message")
+
+	entries := readJSONLogs(t, filename)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "light_dimmer", entries[0]["component"])
+	assert.Equal(t, "io_1", entries[0]["io_id"])
+	assert.Equal(t, float64(42), entries[0]["accessory_id"])
+	assert.Equal(t, "debug", entries[0]["level"])
+
+	assert.Equal(t, "main message", entries[1]["msg"])
+	assert.Nil(t, entries[1]["component"])
+
+	assert.Equal(t, "hap", entries[2]["component"])
+	assert.Contains(t, entries[2]["msg"], "hap message")
+}
+
+func TestValidateLogConfig(t *testing.T) {
+	errs := validateLogConfig(LogConfig{
+		Level:      "loud",
+		Format:     "xml",
+		MaxSize:    -1,
+		Components: map[string]string{"unknown": "debug", LogComponentHAP: "verbose"},
+	})
+
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.(*ConfigError).Field)
+	}
+	assert.ElementsMatch(t, []string{
+		"Log.Level",
+		"Log.Format",
+		"Log.MaxSize",
+		"Log.Components.unknown",
+		"Log.Components.hap",
+	}, fields)
+
+	assert.Empty(t, validateLogConfig(LogConfig{Level: "debug", Format: LogFormatJSON}))
+}
+
+func TestWithLogFlags(t *testing.T) {
+	t.Cleanup(func() { logLevelFlag, logFormatFlag, logFileFlag = "", "", "" })
+
+	cfg := LogConfig{Level: "info", Format: LogFormatText, File: "/var/log/a.log"}
+	assert.Equal(t, cfg, withLogFlags(cfg))
+
+	logLevelFlag, logFormatFlag, logFileFlag = "debug", LogFormatJSON, "/tmp/b.log"
+	assert.Equal(t, LogConfig{Level: "debug", Format: LogFormatJSON, File: "/tmp/b.log"}, withLogFlags(cfg))
+}
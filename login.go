@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default login behaviour
+const (
+	DefaultLoginTimeout     = 10 * time.Second
+	DefaultLoginRetryDelay  = 30 * time.Second
+	DefaultLoginMaxAttempts = 5
+)
+
+// Exit codes from sysexits.h, listed in RestartPreventExitStatus of the
+// systemd unit so a misconfigured bridge is not restarted in a loop
+const (
+	ExitAuthFailed  = 77 // EX_NOPERM
+	ExitConfigError = 78 // EX_CONFIG
+)
+
+var ErrLoginRejected = errors.New("Calaos rejected the credentials")
+
+// ExitRequest asks main to stop the bridge with the given exit code
+type ExitRequest struct {
+	Code int
+	Err  error
+}
+
+var exitRequests = make(chan ExitRequest, 1)
+
+var loginTimerMu sync.Mutex
+var loginTimer *time.Timer
+
+// requestExit asks main to stop, only the first request is kept
+func requestExit(code int, err error) {
+	select {
+	case exitRequests <- ExitRequest{Code: code, Err: err}:
+	default:
+	}
+}
+
+// armLoginTimer replaces the pending login timeout or retry with f
+func armLoginTimer(d time.Duration, f func()) {
+	loginTimerMu.Lock()
+	defer loginTimerMu.Unlock()
+	if loginTimer != nil {
+		loginTimer.Stop()
+	}
+	loginTimer = time.AfterFunc(d, f)
+}
+
+func stopLoginTimer() {
+	loginTimerMu.Lock()
+	defer loginTimerMu.Unlock()
+	if loginTimer != nil {
+		loginTimer.Stop()
+		loginTimer = nil
+	}
+}
+
+// startLogin sends the login message and waits for Calaos to answer it
+func startLogin() error {
+	loggedin = false
+	status.Set(StateLoggingIn, nil)
+	timeout := config.Login.Timeout.Duration
+	armLoginTimer(timeout, func() { loginTimedOut(timeout) })
+	return sendLoginMessage()
+}
+
+// loginTimedOut drops the connection when Calaos never answered the login,
+// the websocket client then reconnects and logs in again
+func loginTimedOut(timeout time.Duration) {
+	if status.State() != StateLoggingIn {
+		return
+	}
+	err := fmt.Errorf("no answer to login after %s", timeout)
+	log.Errorf("Calaos login timed out: %v", err)
+	status.Set(StateLoginTimeout, err)
+	websocketClient.Close()
+}
+
+// loginRejected retries the login later, or stops the bridge once
+// the configured number of attempts is reached
+func loginRejected() {
+	failures := status.LoginFailed()
+	status.Set(StateAuthFailed, ErrLoginRejected)
+
+	user := config.WebSocketServer.User
+	maxAttempts := config.Login.MaxAttempts
+	if maxAttempts > 0 && failures >= maxAttempts {
+		log.Errorf("Calaos rejected the credentials of user %q %d times, check User and Password in configuration", user, failures)
+		requestExit(ExitAuthFailed, ErrLoginRejected)
+		return
+	}
+
+	delay := config.Login.RetryDelay.Duration
+	log.Errorf("Calaos rejected the credentials of user %q (attempt %d), retrying in %s", user, failures, delay)
+	armLoginTimer(delay, func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		if err := startLogin(); err != nil {
+			log.Errorf("Failed to send login message: %v", err)
+		}
+	})
+}
+
+// loginOnce logs in on conn and waits for the answer of Calaos
+func loginOnce(conn *websocket.Conn, cfg Configuration) error {
+	msg, err := newLoginMessage(cfg.WebSocketServer)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return err
+	}
+
+	timeout := cfg.Login.Timeout.Duration
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("no answer to login after %s: %w", timeout, err)
+		}
+		var loginMsg CalaosJsonMsgLogin
+		if err := json.Unmarshal(data, &loginMsg); err != nil || loginMsg.Msg != CalaosMsgTypeLogin {
+			continue
+		}
+		if loginMsg.Data.Success != CalaosSuccessTrue {
+			return ErrLoginRejected
+		}
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const loginRejectedMsg = `{"msg": "login", "msg_id": "1", "data": {"success": "false"}}`
+const loginAcceptedMsg = `{"msg": "login", "msg_id": "1", "data": {"success": "true"}}`
+
+// setupLoginTest resets the login state shared by the tests
+func setupLoginTest(t *testing.T, login LoginConfig) {
+	config = setupTestConfig()
+	config.Login = login
+	setConfigDefaults(&config)
+	websocketClient = &WebSocketClient{}
+	status = newBridgeStatus()
+	for len(exitRequests) > 0 {
+		<-exitRequests
+	}
+	t.Cleanup(stopLoginTimer)
+}
+
+func TestLoginDefaults(t *testing.T) {
+	setupLoginTest(t, LoginConfig{})
+	assert.Equal(t, DefaultLoginTimeout, config.Login.Timeout.Duration)
+	assert.Equal(t, DefaultLoginRetryDelay, config.Login.RetryDelay.Duration)
+	assert.Equal(t, DefaultLoginMaxAttempts, config.Login.MaxAttempts)
+}
+
+func TestHandleLoginMessage_RejectedRetries(t *testing.T) {
+	setupLoginTest(t, LoginConfig{MaxAttempts: 3, RetryDelay: Duration{time.Hour}})
+
+	require.NoError(t, handleLoginMessage([]byte(loginRejectedMsg)))
+	assert.False(t, loggedin)
+
+	snapshot := status.Snapshot()
+	assert.Equal(t, StateAuthFailed, snapshot.State)
+	assert.Equal(t, ErrLoginRejected.Error(), snapshot.LastError)
+	assert.Equal(t, 1, snapshot.LoginFailures)
+	assert.Empty(t, exitRequests)
+}
+
+func TestHandleLoginMessage_RejectedExits(t *testing.T) {
+	setupLoginTest(t, LoginConfig{MaxAttempts: 2, RetryDelay: Duration{time.Hour}})
+
+	require.NoError(t, handleLoginMessage([]byte(loginRejectedMsg)))
+	assert.Empty(t, exitRequests)
+	require.NoError(t, handleLoginMessage([]byte(loginRejectedMsg)))
+
+	require.Len(t, exitRequests, 1)
+	req := <-exitRequests
+	assert.Equal(t, ExitAuthFailed, req.Code)
+	assert.ErrorIs(t, req.Err, ErrLoginRejected)
+}
+
+func TestHandleLoginMessage_RejectedForever(t *testing.T) {
+	setupLoginTest(t, LoginConfig{MaxAttempts: -1, RetryDelay: Duration{time.Hour}})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, handleLoginMessage([]byte(loginRejectedMsg)))
+	}
+	assert.Empty(t, exitRequests)
+	assert.Equal(t, 10, status.Snapshot().LoginFailures)
+}
+
+func TestHandleLoginMessage_AcceptedResetsFailures(t *testing.T) {
+	setupLoginTest(t, LoginConfig{RetryDelay: Duration{time.Hour}})
+
+	require.NoError(t, handleLoginMessage([]byte(loginRejectedMsg)))
+	// get_home cannot be sent without a connection
+	assert.ErrorIs(t, handleLoginMessage([]byte(loginAcceptedMsg)), ErrNotConnected)
+
+	assert.True(t, loggedin)
+	snapshot := status.Snapshot()
+	assert.Equal(t, StateLoggedIn, snapshot.State)
+	assert.Empty(t, snapshot.LastError)
+	assert.Equal(t, 0, snapshot.LoginFailures)
+}
+
+func TestStartLogin_Timeout(t *testing.T) {
+	setupLoginTest(t, LoginConfig{Timeout: Duration{10 * time.Millisecond}})
+
+	assert.ErrorIs(t, startLogin(), ErrNotConnected)
+	assert.Equal(t, StateLoggingIn, status.State())
+
+	assert.Eventually(t, func() bool {
+		return status.State() == StateLoginTimeout
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	var login LoginConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"Timeout": "15s", "RetryDelay": "2m"}`), &login))
+	assert.Equal(t, 15*time.Second, login.Timeout.Duration)
+	assert.Equal(t, 2*time.Minute, login.RetryDelay.Duration)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"Timeout": 15}`), &login))
+	assert.Error(t, json.Unmarshal([]byte(`{"Timeout": "soon"}`), &login))
+}
@@ -4,9 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/brutella/hap"
@@ -45,11 +46,23 @@ const (
 	CalaosGuiTypeLightDimmer  = "light_dimmer"
 	CalaosGuiTypeLight        = "light"
 	CalaosGuiTypeShutterSmart = "shutter_smart"
+	CalaosGuiTypeVarBool      = "var_bool"
 )
 
 // Calaos IO styles
 const (
 	CalaosIOStyleHumidity = "humidity"
+
+	// styles of light outputs
+	CalaosIOStyleLight      = "light"
+	CalaosIOStylePlug       = "plug"
+	CalaosIOStyleOutlet     = "outlet"
+	CalaosIOStyleFan        = "fan"
+	CalaosIOStyleSwitch     = "switch"
+	CalaosIOStylePump       = "pump"
+	CalaosIOStyleIrrigation = "irrigation"
+	CalaosIOStyleHeater     = "heater"
+	CalaosIOStyleBoiler     = "boiler"
 )
 
 // WebSocket URI types
@@ -63,19 +76,6 @@ const (
 	PortWSS = 443
 )
 
-type WebSocketConfig struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-}
-
-type Configuration struct {
-	WebSocketServer WebSocketConfig
-	PinCode         string
-	BridgeName      string
-}
-
 type CalaosJsonMsg struct {
 	Msg   string `json:"msg"`
 	MsgID string `json:"msg_id"`
@@ -160,8 +160,22 @@ var configFilename string
 var config Configuration
 
 var accessories map[uint64]CalaosAccessory
+var skippedIOs map[string]string // reason why an IO is not exposed, by IO id
 var websocketClient *WebSocketClient
 var hapServerStarted bool
+var hapServerStop context.CancelFunc
+var hapServerDone chan struct{}
+
+// hapStorePath is where the HAP server keeps its keys and pairings.
+// Use absolute path to avoid issues with working directory
+var hapStorePath = "/root/Calaos Gateway"
+
+// hapAddr is the address the HAP server listens on, empty to let hap choose a port
+var hapAddr string
+
+// stateMu guards config, home, accessories and skippedIOs, shared by the websocket
+// reader, the login timers and configuration reloads
+var stateMu sync.Mutex
 
 func getIOFromId(id string) *CalaosIO {
 	for i := range home.Data.Home {
@@ -188,47 +202,103 @@ func getNameFromId(id string) string {
 
 }
 
+// Reasons for not exposing a Calaos IO in HomeKit
+const (
+	SkipHidden   = "hidden in Calaos"
+	SkipExcluded = "excluded by configuration"
+)
+
 func setupCalaosHome() {
-	for i := range home.Data.Home {
-		for j := range home.Data.Home[i].IOs {
+	for _, acc := range accessories {
+		if s, ok := acc.(stoppable); ok {
+			s.stop()
+		}
+	}
+	accessories, skippedIOs = buildAccessories(home, config)
+}
 
-			cio := home.Data.Home[i].IOs[j]
-			var acc CalaosAccessory
+// buildAccessories creates the accessories exposing the IOs of h with the
+// overrides of cfg, and returns why the other IOs are not exposed
+func buildAccessories(h CalaosJsonMsgHome, cfg Configuration) (map[uint64]CalaosAccessory, map[string]string) {
+	accs := make(map[uint64]CalaosAccessory)
+	skipped := make(map[string]string)
+	routes := compositeIOs(cfg)
+	for i := range h.Data.Home {
+		for j := range h.Data.Home[i].IOs {
+
+			cio := h.Data.Home[i].IOs[j]
+			if _, found := routes[cio.ID]; found {
+				// Exposed by its composite accessory
+				continue
+			}
 			id := uint64(murmur.Sum32(cio.ID))
-			if cio.Visible != CalaosVisibleFalse {
-				switch cio.GuiType {
-				case CalaosGuiTypeTemp:
-					acc = NewTemperatureSensor(cio, id)
-
-				case CalaosGuiTypeAnalogIn:
-					if cio.IoStyle == CalaosIOStyleHumidity {
-						acc = NewHumiditySensor(cio, id)
-					}
-
-				case CalaosGuiTypeLightDimmer:
-					acc = NewLightDimmer(cio, id)
-
-				case CalaosGuiTypeLight:
-					if cio.IoStyle == "" {
-						acc = NewLightDimmer(cio, id)
-					}
-
-				//TODO:
-				// case "shutter":
-				// 	acc = NewWindowCovering(cio, id)
-
-				case CalaosGuiTypeShutterSmart:
-					acc = NewSmartShutter(cio, id)
-				}
-				if acc != nil {
-					accessories[id] = acc
-				}
+			override := cfg.IOs[cio.ID]
+			if override.Name != "" {
+				cio.Name = override.Name
+			}
+			acc, reason := newCalaosAccessory(cio, id, override)
+			if acc != nil {
+				accs[id] = acc
+			} else {
+				skipped[cio.ID] = reason
 			}
 		}
 	}
+	buildComposites(h, cfg, accs, skipped)
+	return accs, skipped
+}
+
+// newCalaosAccessory returns the accessory exposing cio, or the reason why it is not exposed
+func newCalaosAccessory(cio CalaosIO, id uint64, override IOConfig) (CalaosAccessory, string) {
+	if cio.Visible == CalaosVisibleFalse {
+		return nil, SkipHidden
+	}
+	if override.Exclude {
+		return nil, SkipExcluded
+	}
+
+	switch cio.GuiType {
+	case CalaosGuiTypeTemp:
+		return NewTemperatureSensor(cio, id), ""
+
+	case CalaosGuiTypeAnalogIn:
+		if cio.IoStyle == CalaosIOStyleHumidity {
+			return NewHumiditySensor(cio, id), ""
+		}
+
+	case CalaosGuiTypeLightDimmer:
+		return NewLightDimmer(cio, id), ""
+
+	case CalaosGuiTypeLight:
+		switch cio.IoStyle {
+		case "", CalaosIOStyleLight:
+			return NewLightDimmer(cio, id), ""
+		case CalaosIOStylePlug, CalaosIOStyleOutlet:
+			return NewOutlet(cio, id), ""
+		case CalaosIOStyleFan:
+			return NewFan(cio, id), ""
+		case CalaosIOStyleSwitch, CalaosIOStyleHeater, CalaosIOStyleBoiler:
+			// A heater cooler would show a temperature the relay does not have
+			return NewSwitch(cio, id), ""
+		case CalaosIOStylePump, CalaosIOStyleIrrigation:
+			return NewValve(cio, id), ""
+		}
+
+	//TODO:
+	// case "shutter":
+	// 	acc = NewWindowCovering(cio, id)
+
+	case CalaosGuiTypeShutterSmart:
+		return NewSmartShutter(cio, id), ""
+
+	default:
+		return nil, fmt.Sprintf("gui_type %q is not supported", cio.GuiType)
+	}
+	return nil, fmt.Sprintf("io_style %q is not supported for gui_type %q", cio.IoStyle, cio.GuiType)
 }
 
-func CalaosUpdate(cio CalaosIO) {
+// CalaosUpdate sends the state of cio to Calaos
+func CalaosUpdate(cio CalaosIO) error {
 
 	msg := CalaosJsonSetState{}
 	msg.MsgID = CalaosMsgIDUserCmd
@@ -239,25 +309,34 @@ func CalaosUpdate(cio CalaosIO) {
 	str, err := json.Marshal(msg)
 	if err != nil {
 		log.Errorf("Failed to marshal CalaosUpdate message: %v", err)
-		return
+		commandFailed()
+		return err
 	}
 
 	if err := websocketClient.WriteMessage(websocket.TextMessage, []byte(str)); err != nil {
 		log.Errorf("Failed to write CalaosUpdate message: %v", err)
-		return
+		commandFailed()
+		return err
 	}
+	commandSent(cio.ID)
+	return nil
 }
 
-// sendLoginMessage sends the initial login message to the Calaos WebSocket server
-func sendLoginMessage() error {
+// newLoginMessage returns the login message for the Calaos WebSocket server
+func newLoginMessage(cfg WebSocketConfig) ([]byte, error) {
 	loginMsg := CalaosJsonMsgLoginRequest{
 		Msg:   CalaosMsgTypeLogin,
 		MsgID: CalaosMsgIDLogin,
 	}
-	loginMsg.Data.CNUser = config.WebSocketServer.User
-	loginMsg.Data.CNPass = config.WebSocketServer.Password
+	loginMsg.Data.CNUser = cfg.User
+	loginMsg.Data.CNPass = cfg.Password
+
+	return json.Marshal(loginMsg)
+}
 
-	msgBytes, err := json.Marshal(loginMsg)
+// sendLoginMessage sends the initial login message to the Calaos WebSocket server
+func sendLoginMessage() error {
+	msgBytes, err := newLoginMessage(config.WebSocketServer)
 	if err != nil {
 		return err
 	}
@@ -271,8 +350,12 @@ func handleLoginMessage(message []byte) error {
 		return err
 	}
 
+	stopLoginTimer()
+
 	if loginMsg.Data.Success == CalaosSuccessTrue {
 		loggedin = true
+		status.ResetLoginFailures()
+		status.Set(StateLoggedIn, nil)
 		log.Info("Logged in")
 		// Send get_home message to get all IO states
 		getHomeMsg := CalaosJsonGetHomeRequest{
@@ -286,6 +369,7 @@ func handleLoginMessage(message []byte) error {
 		return websocketClient.WriteMessage(websocket.TextMessage, getHomeBytes)
 	}
 	loggedin = false
+	loginRejected()
 	return nil
 }
 
@@ -297,11 +381,15 @@ func handleEventMessage(message []byte) error {
 	}
 
 	cio := getIOFromId(eventMsg.Data.Data.ID)
+	eventReceived(cio)
 	if cio != nil {
 		cio.State = eventMsg.Data.Data.State
-		id := uint64(murmur.Sum32(cio.ID))
+		id := accessoryIDFor(compositeIOs(config), cio.ID)
 		if acc, found := accessories[id]; found {
-			acc.Update(cio)
+			if err := acc.Update(cio); err != nil {
+				log.WithFields(ioFields(cio.ID, id)).Warnf("Failed to update accessory with state %q: %v", cio.State, err)
+				stateUnparseable(cio.ID)
+			}
 		}
 	}
 	return nil
@@ -309,12 +397,16 @@ func handleEventMessage(message []byte) error {
 
 // updateAccessoryStates updates existing accessories with current state from Calaos
 func updateAccessoryStates() {
+	routes := compositeIOs(config)
 	for i := range home.Data.Home {
 		for j := range home.Data.Home[i].IOs {
 			cio := home.Data.Home[i].IOs[j]
-			id := uint64(murmur.Sum32(cio.ID))
+			id := accessoryIDFor(routes, cio.ID)
 			if acc, found := accessories[id]; found {
-				acc.Update(&cio)
+				if err := acc.Update(&cio); err != nil {
+					log.WithFields(ioFields(cio.ID, id)).Warnf("Failed to update accessory with state %q: %v", cio.State, err)
+					stateUnparseable(cio.ID)
+				}
 			}
 		}
 	}
@@ -331,10 +423,11 @@ func startHAPServer(ctx context.Context) error {
 	bridge := accessory.NewBridge(info)
 
 	// Associate Bridge and info to a new Ip transport
-	accessories = make(map[uint64]CalaosAccessory)
 	setupCalaosHome()
+	setAccessoryMetrics(accessories)
 
 	if len(accessories) == 0 {
+		log.Warn("No IO to expose, the HAP server is not started")
 		return nil
 	}
 
@@ -343,31 +436,50 @@ func startHAPServer(ctx context.Context) error {
 		list = append(list, acc.AccessoryGet())
 	}
 
-	// Store the data in the "/Calaos Gateway" directory.
-	// Use absolute path to avoid issues with working directory
-	storePath := "/root/Calaos Gateway"
-	store := hap.NewFsStore(storePath)
+	store := hap.NewFsStore(hapStorePath)
 
 	server, err := hap.NewServer(store, bridge.A, list...)
 	if err != nil {
 		return err
 	}
 
+	server.Addr = hapAddr
+
 	log.Info("Starting HAP server")
 	server.Pin = config.PinCode
 	hapServerStarted = true
 
+	serverCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	hapServerStop, hapServerDone = stop, done
+	hapRunning.Store(true)
+
 	// Run the server.
 	go func() {
+		defer close(done)
 		log.Info("HAP server listening for connections")
-		if err := server.ListenAndServe(ctx); err != nil {
+		if err := server.ListenAndServe(serverCtx); err != nil && serverCtx.Err() == nil {
 			log.Errorf("HAP server error: %v", err)
 			hapServerStarted = false
+			hapRunning.Store(false)
 		}
 	}()
 	return nil
 }
 
+// stopHAPServer stops the running HAP server and waits for it to close its connections
+func stopHAPServer() {
+	if hapServerStop == nil {
+		return
+	}
+	log.Info("Stopping HAP server")
+	hapServerStop()
+	<-hapServerDone
+	hapServerStop, hapServerDone = nil, nil
+	hapServerStarted = false
+	hapRunning.Store(false)
+}
+
 // handleGetHomeMessage processes get_home messages and either updates or initializes accessories
 func handleGetHomeMessage(message []byte, ctx context.Context) error {
 	if err := json.Unmarshal(message, &home); err != nil {
@@ -379,6 +491,9 @@ func handleGetHomeMessage(message []byte, ctx context.Context) error {
 		return nil
 	}
 
+	// Valves left on by a previous run of the bridge are turned off in time
+	resumeValveTimers(home)
+
 	// If server is already started, update existing accessories with current state
 	if hapServerStarted {
 		log.Info("HAP server already started, updating accessory states")
@@ -399,95 +514,143 @@ func handleGetHomeMessage(message []byte, ctx context.Context) error {
 
 func connectedCb(ctx context.Context) {
 	// Send login message through Calaos websocket API
-	if err := sendLoginMessage(); err != nil {
+	stateMu.Lock()
+	err := startLogin()
+	stateMu.Unlock()
+	if err != nil {
 		log.Errorf("Failed to send login message: %v", err)
 		return
 	}
 
+	ws := websocketClient
+	generation := ws.Generation()
 	go func() {
-		defer websocketClient.Close()
-		// Infinite loop
+		// Infinite loop, the client reconnects when reading fails
 		for {
-			_, message, err := websocketClient.ReadMessage()
+			_, message, err := ws.ReadMessage()
 			if err != nil {
 				log.Errorf("Failed to read WebSocket message: %v", err)
+				stateMu.Lock()
+				// The client may already be connected again, or stopped for good
+				if ws.Generation() == generation && !ws.stopped.Load() {
+					loggedin = false
+					status.Set(StateConnecting, err)
+				}
+				stateMu.Unlock()
 				return
 			}
 
-			// Try to decode JSON message
-			var msg CalaosJsonMsg
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Errorf("Failed to unmarshal message: %v", err)
-				continue
-			}
+			stateMu.Lock()
+			handleMessage(message, ctx)
+			stateMu.Unlock()
+		}
+	}()
+}
 
-			// Login message
-			if msg.Msg == CalaosMsgTypeLogin {
-				if err := handleLoginMessage(message); err != nil {
-					log.Errorf("Failed to handle login message: %v", err)
-					continue
-				}
-			}
+// handleMessage dispatches a message received from Calaos
+func handleMessage(message []byte, ctx context.Context) {
+	// Try to decode JSON message
+	var msg CalaosJsonMsg
+	if err := json.Unmarshal(message, &msg); err != nil {
+		log.Errorf("Failed to unmarshal message: %v", err)
+		return
+	}
 
-			// If we received and we are logged in
-			if loggedin {
-				// Msg event received
-				if msg.Msg == CalaosMsgTypeEvent {
-					if err := handleEventMessage(message); err != nil {
-						log.Errorf("Failed to handle event message: %v", err)
-						continue
-					}
-				}
-				// Receive get_home message
-				if msg.Msg == CalaosMsgTypeGetHome {
-					if err := handleGetHomeMessage(message, ctx); err != nil {
-						log.Errorf("Failed to handle get_home message: %v", err)
-						continue
-					}
-				}
+	// Login message
+	if msg.Msg == CalaosMsgTypeLogin {
+		if err := handleLoginMessage(message); err != nil {
+			log.Errorf("Failed to handle login message: %v", err)
+			return
+		}
+	}
+
+	// If we received and we are logged in
+	if loggedin {
+		// Msg event received
+		if msg.Msg == CalaosMsgTypeEvent {
+			if err := handleEventMessage(message); err != nil {
+				log.Errorf("Failed to handle event message: %v", err)
+				return
 			}
 		}
-	}()
+		// Receive get_home message
+		if msg.Msg == CalaosMsgTypeGetHome {
+			if err := handleGetHomeMessage(message, ctx); err != nil {
+				log.Errorf("Failed to handle get_home message: %v", err)
+				return
+			}
+		}
+	}
 }
 
 func main() {
+	if code, found := runCommand(os.Args[1:]); found {
+		os.Exit(code)
+	}
+
 	log.Info("Starting Calaos-Homekit")
 	flag.StringVar(&configFilename, "config", "./config.json", "Get the config to use. default value is ./config.json")
+	flag.StringVar(&logLevelFlag, "log-level", "", "log level, overrides Log.Level of the configuration")
+	flag.StringVar(&logFormatFlag, "log-format", "", "log format, text or json, overrides Log.Format of the configuration")
+	flag.StringVar(&logFileFlag, "log-file", "", "log file, overrides Log.File of the configuration")
+	flag.Usage = printUsage
 	flag.Parse()
 
 	// Setup a listener for interrupts and SIGTERM signals to stop the server.
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 
+	// SIGHUP and configuration file changes reload the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := make(chan struct{}, 1)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	log.Infof("Opening configuration file: %s", configFilename)
-	file, err := os.Open(configFilename)
+	var err error
+	config, err = loadConfig(configFilename)
 	if err != nil {
-		log.Errorf("Failed to open configuration file: %v", err)
-		os.Exit(1)
+		logConfigErrors(err)
+		os.Exit(ExitConfigError)
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	if err != nil {
-		log.Errorf("Failed to decode configuration: %v", err)
-		file.Close()
-		os.Exit(1)
+	logCfg := withLogFlags(config.Log)
+	if errs := validateLogConfig(logCfg); len(errs) > 0 {
+		for _, err := range errs {
+			log.Errorf("Invalid log option: %v", err)
+		}
+		os.Exit(ExitConfigError)
 	}
+	applyLogConfig(logCfg)
+	applyHealthConfig(config.Health)
 	log.Infof("Configuration loaded: WebSocket server at %s:%d", config.WebSocketServer.Host, config.WebSocketServer.Port)
 
-	uriType := URITypeWS
-	if config.WebSocketServer.Port == PortWSS {
-		uriType = URITypeWSS
+	uri, header, err := calaosEndpoint(config.WebSocketServer)
+	if err != nil {
+		log.Errorf("Invalid Calaos server address: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	dialer, err := newCalaosDialer(config.WebSocketServer)
+	if err != nil {
+		log.Errorf("Failed to configure WebSocket dialer: %v", err)
+		os.Exit(ExitConfigError)
+	}
+
+	if err := startHTTPServer(config.HTTP); err != nil {
+		log.Errorf("Failed to start HTTP server: %v", err)
+		os.Exit(ExitUnavailable)
 	}
-	calaosURI := uriType + "://" + config.WebSocketServer.Host + ":" + strconv.Itoa(config.WebSocketServer.Port) + "/api"
+	defer stopHTTPServer()
 
 	loggedin = false
 
-	log.Infof("Connecting to Calaos WebSocket: %s", calaosURI)
+	log.Infof("Connecting to Calaos WebSocket: %s", uri)
+
+	websocketClient = NewWebSocketClient(uri, dialer, header, func() { connectedCb(ctx) })
+	websocketClient.Start()
 
-	websocketClient = Dial(calaosURI, func() { connectedCb(ctx) })
+	go watchConfig(ctx, reload)
+	go runSystemdNotify(ctx, SdNotifyInterval)
 
 	// Wait for Ctrl + c to qui app and close websocket properly
 	for {
@@ -499,6 +662,7 @@ func main() {
 			defer cancel()
 
 			log.Info("Received interrupt signal, shutting down")
+			sdNotify(SdNotifyStopping)
 			err := websocketClient.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				log.Errorf("Failed to send close message: %v", err)
@@ -506,6 +670,20 @@ func main() {
 			}
 			websocketClient.Close()
 			return
+
+		case <-hup:
+			log.Info("Received SIGHUP, reloading configuration")
+			logReloadResult(reloadConfig(ctx))
+
+		case <-reload:
+			logReloadResult(reloadConfig(ctx))
+
+		case req := <-exitRequests:
+			log.Errorf("Stopping Calaos-Homekit: %v", req.Err)
+			signal.Stop(c)
+			websocketClient.Close()
+			cancel()
+			os.Exit(req.Code)
 		}
 	}
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the HTTP server exposes Prometheus metrics
+const MetricsPath = "/metrics"
+
+// CommandLatencyTimeout is how long a set_state command waits for its
+// confirmation event before it is no longer measured
+const CommandLatencyTimeout = time.Minute
+
+const metricsNamespace = "calaos_homekit"
+
+// bridgeStates lists the states reported by the bridge_state metric
+var bridgeStates = []string{StateConnecting, StateLoggingIn, StateLoggedIn, StateAuthFailed, StateLoginTimeout}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricWebSocketReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_reconnects_total",
+		Help:      "Connections to the Calaos WebSocket opened again after the first one.",
+	})
+	metricWebSocketConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_connected",
+		Help:      "1 when the Calaos WebSocket is connected.",
+	})
+	metricBridgeState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "bridge_state",
+		Help:      "1 for the current state of the Calaos session.",
+	}, []string{"state"})
+	metricEventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "Calaos events received, by gui_type of the IO.",
+	}, []string{"gui_type"})
+	metricSetStateCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "set_state_commands_total",
+		Help:      "set_state commands sent to Calaos, by result.",
+	}, []string{"result"})
+	metricSetStateLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "set_state_latency_seconds",
+		Help:      "Time between a set_state command and the Calaos event for the same IO.",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+	metricAccessoriesExposed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "accessories_exposed",
+		Help:      "Accessories exposed in HomeKit, by type.",
+	}, []string{"type"})
+	metricUnparseableStates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unparseable_states_total",
+		Help:      "Calaos states an accessory could not parse, by IO.",
+	}, []string{"io_id"})
+)
+
+// Set-state results
+const (
+	SetStateSent   = "sent"
+	SetStateFailed = "failed"
+)
+
+// hapRunning is true while the HAP server is running
+var hapRunning atomic.Bool
+
+// pendingCommands holds the time of the last set_state sent for each IO
+var pendingCommands = struct {
+	sync.Mutex
+	sent map[string]time.Time
+}{sent: map[string]time.Time{}}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricWebSocketReconnects,
+		metricWebSocketConnected,
+		metricBridgeState,
+		metricEventsReceived,
+		metricSetStateCommands,
+		metricSetStateLatency,
+		metricAccessoriesExposed,
+		metricUnparseableStates,
+	)
+	setBridgeStateMetric(StateConnecting)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// setBridgeStateMetric sets the bridge_state metric to the current state
+func setBridgeStateMetric(state string) {
+	for _, s := range bridgeStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		metricBridgeState.WithLabelValues(s).Set(v)
+	}
+}
+
+// commandSent records a set_state command for an IO
+func commandSent(ioID string) {
+	metricSetStateCommands.WithLabelValues(SetStateSent).Inc()
+	pendingCommands.Lock()
+	pendingCommands.sent[ioID] = time.Now()
+	pendingCommands.Unlock()
+}
+
+// commandFailed records a set_state command that could not be sent
+func commandFailed() {
+	metricSetStateCommands.WithLabelValues(SetStateFailed).Inc()
+}
+
+// eventReceived records an event and the latency of the command it confirms
+func eventReceived(cio *CalaosIO) {
+	if cio == nil {
+		metricEventsReceived.WithLabelValues("unknown").Inc()
+		return
+	}
+	metricEventsReceived.WithLabelValues(cio.GuiType).Inc()
+
+	pendingCommands.Lock()
+	sent, found := pendingCommands.sent[cio.ID]
+	delete(pendingCommands.sent, cio.ID)
+	pendingCommands.Unlock()
+	if found {
+		if elapsed := time.Since(sent); elapsed <= CommandLatencyTimeout {
+			metricSetStateLatency.Observe(elapsed.Seconds())
+		}
+	}
+}
+
+// stateUnparseable records a state an accessory failed to parse
+func stateUnparseable(ioID string) {
+	metricUnparseableStates.WithLabelValues(ioID).Inc()
+}
+
+// accessoryTypeName returns the type of an accessory as shown in metrics
+func accessoryTypeName(acc CalaosAccessory) string {
+	name := fmt.Sprintf("%T", acc)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// setAccessoryMetrics counts the exposed accessories by type
+func setAccessoryMetrics(accs map[uint64]CalaosAccessory) {
+	metricAccessoriesExposed.Reset()
+	for _, acc := range accs {
+		metricAccessoriesExposed.WithLabelValues(accessoryTypeName(acc)).Inc()
+	}
+}
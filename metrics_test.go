@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+func TestEventReceived_Latency(t *testing.T) {
+	home = setupTestHome()
+	cio := getIOFromId("test-io-1")
+	before := testutil.ToFloat64(metricEventsReceived.WithLabelValues(CalaosGuiTypeLightDimmer))
+
+	commandSent(cio.ID)
+	eventReceived(cio)
+	eventReceived(cio)
+	eventReceived(nil)
+
+	assert.Equal(t, before+2, testutil.ToFloat64(metricEventsReceived.WithLabelValues(CalaosGuiTypeLightDimmer)))
+	pendingCommands.Lock()
+	assert.NotContains(t, pendingCommands.sent, cio.ID)
+	pendingCommands.Unlock()
+
+	// A confirmation arriving too late is not measured
+	pendingCommands.Lock()
+	pendingCommands.sent[cio.ID] = time.Now().Add(-2 * CommandLatencyTimeout)
+	pendingCommands.Unlock()
+	count := testutil.CollectAndCount(metricSetStateLatency)
+	eventReceived(cio)
+	assert.Equal(t, count, testutil.CollectAndCount(metricSetStateLatency))
+}
+
+func TestHandleEventMessage_UnparseableState(t *testing.T) {
+	home = setupTestHome()
+	accessories = make(map[uint64]CalaosAccessory)
+	setupCalaosHome()
+	before := testutil.ToFloat64(metricUnparseableStates.WithLabelValues("test-io-2"))
+
+	require.NoError(t, handleEventMessage([]byte(`{"msg":"event","data":{"data":{"id":"test-io-2","state":"warm"}}}`)))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(metricUnparseableStates.WithLabelValues("test-io-2")))
+}
+
+func TestSetAccessoryMetrics(t *testing.T) {
+	home = setupTestHome()
+	accessories = make(map[uint64]CalaosAccessory)
+	setupCalaosHome()
+
+	setAccessoryMetrics(accessories)
+
+	assert.Equal(t, "LightDimmer", accessoryTypeName(accessories[uint64(murmur.Sum32("test-io-1"))]))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metricAccessoriesExposed.WithLabelValues("LightDimmer")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metricAccessoriesExposed.WithLabelValues("Temp")))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	status.Set(StateLoggedIn, nil)
+	t.Cleanup(func() { status.Set(StateConnecting, nil) })
+
+	srv := httptest.NewServer(newHTTPHandler(HTTPConfig{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + MetricsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `calaos_homekit_bridge_state{state="logged_in"} 1`)
+	assert.Contains(t, string(body), `calaos_homekit_bridge_state{state="connecting"} 0`)
+	assert.Contains(t, string(body), "calaos_homekit_websocket_connected 0")
+	assert.Contains(t, string(body), "go_goroutines")
+}
+
+func TestValidateHTTPConfig(t *testing.T) {
+	assert.Empty(t, validateHTTPConfig(HTTPConfig{}))
+	assert.Empty(t, validateHTTPConfig(HTTPConfig{Listen: ":9101"}))
+	assert.Empty(t, validateHTTPConfig(HTTPConfig{Listen: "127.0.0.1:9101"}))
+	assert.Len(t, validateHTTPConfig(HTTPConfig{Listen: "9101"}), 1)
+	assert.Len(t, validateHTTPConfig(HTTPConfig{Listen: ":port"}), 1)
+}
+
+func TestStartHTTPServer(t *testing.T) {
+	require.NoError(t, startHTTPServer(HTTPConfig{}))
+	assert.Nil(t, httpServer)
+
+	require.NoError(t, startHTTPServer(HTTPConfig{Listen: "127.0.0.1:0"}))
+	assert.NotNil(t, httpServer)
+	stopHTTPServer()
+	assert.Nil(t, httpServer)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// MultiSpeedFanConfig describes a fan, like a ventilation unit, whose speeds
+// are combinations of Calaos relay outputs
+type MultiSpeedFanConfig struct {
+	Name    string     // name shown in HomeKit, defaults to the name of the first output
+	Outputs []string   // relay outputs of the fan
+	Speeds  [][]string // outputs on at each speed, slowest first, defaults to one output per speed
+}
+
+// speeds returns the outputs on at each speed, slowest first
+func (cfg MultiSpeedFanConfig) speeds() [][]string {
+	if len(cfg.Speeds) > 0 {
+		return cfg.Speeds
+	}
+	speeds := make([][]string, len(cfg.Outputs))
+	for i, id := range cfg.Outputs {
+		speeds[i] = []string{id}
+	}
+	return speeds
+}
+
+func (cfg MultiSpeedFanConfig) ios() []string {
+	return cfg.Outputs
+}
+
+func (cfg MultiSpeedFanConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewMultiSpeedFan(cfg, ios, id)
+}
+
+// validateMultiSpeedFans checks the MultiSpeedFans section of the configuration
+func validateMultiSpeedFans(cfgs []MultiSpeedFanConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("MultiSpeedFans[%d].%s", i, field), Msg: msg})
+		}
+		if len(cfg.Outputs) == 0 {
+			fail("Outputs", "at least one output is required")
+		}
+		for j, id := range cfg.Outputs {
+			if id == "" {
+				fail(fmt.Sprintf("Outputs[%d]", j), "IO id cannot be empty")
+			}
+		}
+		seen := map[string]int{}
+		for j, speed := range cfg.Speeds {
+			if len(speed) == 0 {
+				fail(fmt.Sprintf("Speeds[%d]", j), "at least one output is required, the fan is off when none is on")
+			}
+			for _, id := range speed {
+				if !slices.Contains(cfg.Outputs, id) {
+					fail(fmt.Sprintf("Speeds[%d]", j), fmt.Sprintf("IO %s is not in Outputs", id))
+				}
+			}
+			key := fmt.Sprint(sortedIDs(speed))
+			if other, found := seen[key]; found {
+				fail(fmt.Sprintf("Speeds[%d]", j), fmt.Sprintf("same outputs as Speeds[%d]", other))
+			}
+			seen[key] = j
+		}
+	}
+	return errs
+}
+
+// sortedIDs returns a sorted copy of ids
+func sortedIDs(ids []string) []string {
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// MultiSpeedFan switches its outputs to the combination of the speed band
+// RotationSpeed falls in, and reads the speed back from the outputs that are on
+type MultiSpeedFan struct {
+	*accessory.A
+	Fan *service.FanV2
+
+	RotationSpeed   *characteristic.RotationSpeed
+	CurrentFanState *characteristic.CurrentFanState
+
+	outputs map[string]CalaosIO
+	speeds  [][]string
+	logger  *log.Entry
+
+	mu    sync.Mutex
+	on    map[string]bool // state of the outputs
+	speed int             // current or last speed, from 1
+}
+
+var LogComponentMultiSpeedFan = registerLogComponent("multi_speed_fan")
+
+func NewMultiSpeedFan(cfg MultiSpeedFanConfig, ios map[string]CalaosIO, id uint64) *MultiSpeedFan {
+	first := ios[cfg.Outputs[0]]
+	acc := MultiSpeedFan{
+		outputs: map[string]CalaosIO{},
+		speeds:  cfg.speeds(),
+		logger:  accessoryLogger(LogComponentMultiSpeedFan, first, id),
+		on:      map[string]bool{},
+		speed:   1,
+	}
+	for _, ioID := range cfg.Outputs {
+		acc.outputs[ioID] = ios[ioID]
+		acc.on[ioID], _ = strconv.ParseBool(ios[ioID].State)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = first.Name
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: first.ID,
+		Manufacturer: "Calaos",
+		Model:        first.IoType,
+	}, accessory.TypeFan)
+	acc.A.Id = id
+
+	acc.Fan = service.NewFanV2()
+	acc.RotationSpeed = characteristic.NewRotationSpeed()
+	acc.Fan.AddC(acc.RotationSpeed.C)
+	acc.CurrentFanState = characteristic.NewCurrentFanState()
+	acc.Fan.AddC(acc.CurrentFanState.C)
+	acc.AddS(acc.Fan.S)
+
+	acc.show()
+
+	acc.Fan.Active.OnValueRemoteUpdate(func(active int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if active == characteristic.ActiveInactive {
+			acc.setSpeed(0)
+		} else if acc.currentSpeed() == 0 {
+			acc.setSpeed(acc.speed)
+		}
+	})
+	acc.RotationSpeed.OnValueRemoteUpdate(func(v float64) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.setSpeed(acc.speedOf(v))
+	})
+
+	return &acc
+}
+
+// speedOf returns the speed of the RotationSpeed band v falls in, 0 for off
+func (acc *MultiSpeedFan) speedOf(v float64) int {
+	if v <= 0 {
+		return 0
+	}
+	speed := int(math.Ceil(v * float64(len(acc.speeds)) / 100))
+	return min(max(speed, 1), len(acc.speeds))
+}
+
+// rotationSpeed returns the RotationSpeed shown for speed, the top of its band
+func (acc *MultiSpeedFan) rotationSpeed(speed int) float64 {
+	return math.Round(100 * float64(speed) / float64(len(acc.speeds)))
+}
+
+// currentSpeed returns the speed of the outputs that are on, 0 when all are
+// off and -1 when they match no speed, the caller holds mu
+func (acc *MultiSpeedFan) currentSpeed() int {
+	var on []string
+	for id, v := range acc.on {
+		if v {
+			on = append(on, id)
+		}
+	}
+	if len(on) == 0 {
+		return 0
+	}
+	key := fmt.Sprint(sortedIDs(on))
+	for i, speed := range acc.speeds {
+		if fmt.Sprint(sortedIDs(speed)) == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// setSpeed switches the outputs to speed, 0 turns them all off, the caller holds mu
+func (acc *MultiSpeedFan) setSpeed(speed int) {
+	acc.logger.Debugf("Setting fan speed to %d", speed)
+	wanted := map[string]bool{}
+	if speed > 0 {
+		acc.speed = speed
+		for _, id := range acc.speeds[speed-1] {
+			wanted[id] = true
+		}
+	}
+
+	// Turn outputs off first, relays of a motor must not be on together
+	for _, on := range []bool{false, true} {
+		for id, cio := range acc.outputs {
+			if wanted[id] == on && acc.on[id] != on {
+				setRelay(acc.logger, cio, on)
+			}
+		}
+	}
+}
+
+// show sets the characteristics from the outputs that are on, the caller holds mu
+func (acc *MultiSpeedFan) show() {
+	switch speed := acc.currentSpeed(); speed {
+	case -1:
+		// Between two speeds, or set from Calaos to an unknown combination
+		acc.logger.Debug("Outputs match no fan speed")
+	case 0:
+		acc.Fan.Active.SetValue(characteristic.ActiveInactive)
+		acc.CurrentFanState.SetValue(characteristic.CurrentFanStateInactive)
+	default:
+		acc.speed = speed
+		acc.Fan.Active.SetValue(characteristic.ActiveActive)
+		acc.CurrentFanState.SetValue(characteristic.CurrentFanStateBlowingAir)
+		acc.RotationSpeed.SetValue(acc.rotationSpeed(speed))
+	}
+}
+
+func (acc *MultiSpeedFan) Update(cio *CalaosIO) error {
+	on, err := strconv.ParseBool(cio.State)
+	if err != nil {
+		return err
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	acc.on[cio.ID] = on
+	acc.show()
+	return nil
+}
+
+func (acc *MultiSpeedFan) AccessoryGet() *accessory.A {
+	return acc.A
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupVentilationHome adds a ventilation unit with low and high speed relays, off, to the test home
+func setupVentilationHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Technical room",
+		IOs: []CalaosIO{
+			{ID: "vmc-low", Name: "Ventilation", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "false"},
+			{ID: "vmc-high", Name: "Ventilation boost", GuiType: CalaosGuiTypeLight, IoType: "output", Visible: "true", State: "false"},
+		},
+	})
+	return h
+}
+
+func newTestMultiSpeedFan(cfg MultiSpeedFanConfig, states map[string]string) *MultiSpeedFan {
+	return NewMultiSpeedFan(cfg, homeIOs(setupVentilationHome(), states), uint64(murmur.Sum32(cfg.Outputs[0])))
+}
+
+func TestMultiSpeedFan_SpeedBands(t *testing.T) {
+	acc := newTestMultiSpeedFan(MultiSpeedFanConfig{Outputs: []string{"a", "b", "c"}}, nil)
+	tests := []struct {
+		rotation float64
+		speed    int
+	}{
+		{0, 0},
+		{1, 1},
+		{33, 1},
+		{34, 2},
+		{66.7, 3},
+		{100, 3},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.speed, acc.speedOf(tt.rotation), tt.rotation)
+	}
+	assert.Equal(t, 33.0, acc.rotationSpeed(1))
+	assert.Equal(t, 67.0, acc.rotationSpeed(2))
+	assert.Equal(t, 100.0, acc.rotationSpeed(3))
+}
+
+func TestMultiSpeedFan_ExclusiveOutputs(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestMultiSpeedFan(MultiSpeedFanConfig{Outputs: []string{"vmc-low", "vmc-high"}}, map[string]string{"vmc-low": "true"})
+	assert.Equal(t, "Ventilation", acc.AccessoryGet().Name())
+	assert.Equal(t, characteristic.ActiveActive, acc.Fan.Active.Value())
+	assert.Equal(t, 50.0, acc.RotationSpeed.Value())
+	assert.Equal(t, characteristic.CurrentFanStateBlowingAir, acc.CurrentFanState.Value())
+
+	// The low speed relay is off before the high speed one is on
+	remoteSet(acc.RotationSpeed.C, 80.0)
+	assert.Equal(t, []string{"vmc-low=false", "vmc-high=true"}, nextCommands(t, commands, 2))
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-low", State: "false"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-high", State: "true"}))
+	assert.Equal(t, characteristic.ActiveActive, acc.Fan.Active.Value())
+	assert.Equal(t, 100.0, acc.RotationSpeed.Value())
+
+	// Outputs matching no speed change nothing
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-low", State: "true"}))
+	assert.Equal(t, 100.0, acc.RotationSpeed.Value())
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-low", State: "false"}))
+
+	remoteSet(acc.Fan.Active.C, characteristic.ActiveInactive)
+	assert.Equal(t, []string{"vmc-high=false"}, nextCommands(t, commands, 1))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-high", State: "false"}))
+	assert.Equal(t, characteristic.ActiveInactive, acc.Fan.Active.Value())
+	assert.Equal(t, characteristic.CurrentFanStateInactive, acc.CurrentFanState.Value())
+
+	// Turned on again at the last speed
+	remoteSet(acc.Fan.Active.C, characteristic.ActiveActive)
+	assert.Equal(t, []string{"vmc-high=true"}, nextCommands(t, commands, 1))
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "vmc-high", State: "invalid"}))
+}
+
+func TestMultiSpeedFan_Combinations(t *testing.T) {
+	commands := captureCommands(t)
+	cfg := MultiSpeedFanConfig{
+		Outputs: []string{"vmc-low", "vmc-high"},
+		Speeds:  [][]string{{"vmc-low"}, {"vmc-high", "vmc-low"}},
+	}
+	acc := newTestMultiSpeedFan(cfg, map[string]string{"vmc-low": "true", "vmc-high": "true"})
+	assert.Equal(t, 100.0, acc.RotationSpeed.Value())
+
+	remoteSet(acc.RotationSpeed.C, 30.0)
+	assert.Equal(t, []string{"vmc-high=false"}, nextCommands(t, commands, 1))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "vmc-high", State: "false"}))
+	assert.Equal(t, 50.0, acc.RotationSpeed.Value())
+
+	// Already at the requested speed
+	remoteSet(acc.Fan.Active.C, characteristic.ActiveActive)
+	noCommand(t, commands, 50*time.Millisecond)
+
+	remoteSet(acc.RotationSpeed.C, 0.0)
+	assert.Equal(t, []string{"vmc-low=false"}, nextCommands(t, commands, 1))
+}
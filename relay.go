@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// Relay outputs are Calaos "light" IOs whose io_style says what they power.
+// They all switch with the true/false set_state of LightDimmer.
+
+var LogComponentRelay = registerLogComponent("relay")
+
+func relayInfo(cio CalaosIO) accessory.Info {
+	return accessory.Info{
+		Name:         cio.Name,
+		SerialNumber: cio.ID,
+		Manufacturer: "Calaos",
+		Model:        cio.IoType,
+	}
+}
+
+// setRelay sends on to the relay output cio
+func setRelay(logger *log.Entry, cio CalaosIO, on bool) {
+	logger.Debugf("Relay set to %t", on)
+	cio.State = strconv.FormatBool(on)
+	CalaosUpdate(cio)
+}
+
+// activeValue returns the Active characteristic value of a relay state
+func activeValue(on bool) int {
+	if on {
+		return characteristic.ActiveActive
+	}
+	return characteristic.ActiveInactive
+}
+
+// Outlet is a relay styled "plug" or "outlet"
+type Outlet struct {
+	*accessory.Outlet
+
+	logger *log.Entry
+}
+
+func NewOutlet(cio CalaosIO, id uint64) *Outlet {
+	acc := Outlet{logger: accessoryLogger(LogComponentRelay, cio, id)}
+	acc.Outlet = accessory.NewOutlet(relayInfo(cio))
+	acc.Outlet.Id = id
+
+	acc.Update(&cio)
+
+	acc.Outlet.Outlet.On.OnValueRemoteUpdate(func(on bool) {
+		setRelay(acc.logger, cio, on)
+	})
+
+	return &acc
+}
+
+func (acc *Outlet) Update(cio *CalaosIO) error {
+	on, err := strconv.ParseBool(cio.State)
+	if err == nil {
+		acc.Outlet.Outlet.On.SetValue(on)
+		acc.Outlet.Outlet.OutletInUse.SetValue(on)
+	}
+	return err
+}
+
+func (acc *Outlet) AccessoryGet() *accessory.A {
+	return acc.Outlet.A
+}
+
+// Fan is a relay styled "fan"
+type Fan struct {
+	*accessory.Fan
+
+	logger *log.Entry
+}
+
+func NewFan(cio CalaosIO, id uint64) *Fan {
+	acc := Fan{logger: accessoryLogger(LogComponentRelay, cio, id)}
+	acc.Fan = accessory.NewFan(relayInfo(cio))
+	acc.Fan.Id = id
+
+	acc.Update(&cio)
+
+	acc.Fan.Fan.On.OnValueRemoteUpdate(func(on bool) {
+		setRelay(acc.logger, cio, on)
+	})
+
+	return &acc
+}
+
+func (acc *Fan) Update(cio *CalaosIO) error {
+	on, err := strconv.ParseBool(cio.State)
+	if err == nil {
+		acc.Fan.Fan.On.SetValue(on)
+	}
+	return err
+}
+
+func (acc *Fan) AccessoryGet() *accessory.A {
+	return acc.Fan.A
+}
+
+// Switch is a relay styled "switch"
+type Switch struct {
+	*accessory.Switch
+
+	logger *log.Entry
+}
+
+func NewSwitch(cio CalaosIO, id uint64) *Switch {
+	acc := Switch{logger: accessoryLogger(LogComponentRelay, cio, id)}
+	acc.Switch = accessory.NewSwitch(relayInfo(cio))
+	acc.Switch.Id = id
+
+	acc.Update(&cio)
+
+	acc.Switch.Switch.On.OnValueRemoteUpdate(func(on bool) {
+		setRelay(acc.logger, cio, on)
+	})
+
+	return &acc
+}
+
+func (acc *Switch) Update(cio *CalaosIO) error {
+	on, err := strconv.ParseBool(cio.State)
+	if err == nil {
+		acc.Switch.Switch.On.SetValue(on)
+	}
+	return err
+}
+
+func (acc *Switch) AccessoryGet() *accessory.A {
+	return acc.Switch.A
+}
+
+// Valve is a relay styled "pump" or "irrigation", turned off by the bridge
+// when its SetDuration elapses
+type Valve struct {
+	*accessory.A
+	Valve *timedValve
+
+	logger *log.Entry
+}
+
+func NewValve(cio CalaosIO, id uint64) *Valve {
+	acc := Valve{logger: accessoryLogger(LogComponentRelay, cio, id)}
+	acc.A = accessory.New(relayInfo(cio), accessory.TypeSprinkler)
+	acc.A.Id = id
+
+	svc := service.NewValve()
+	if cio.IoStyle == CalaosIOStyleIrrigation {
+		svc.ValveType.SetValue(characteristic.ValveTypeIrrigation)
+	}
+	acc.Valve = newTimedValve(svc, cio, 0, acc.logger)
+	acc.AddS(svc.S)
+
+	return &acc
+}
+
+func (acc *Valve) Update(cio *CalaosIO) error {
+	return acc.Valve.Update(cio)
+}
+
+func (acc *Valve) AccessoryGet() *accessory.A {
+	return acc.A
+}
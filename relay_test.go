@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommands follows the set_state messages received by a FakeCalaos
+type fakeCommands struct {
+	*FakeCalaos
+	read int // commands returned so far
+}
+
+// captureCommands connects websocketClient, logged in, to a FakeCalaos whose
+// commands are returned in order by nextCommand
+func captureCommands(t *testing.T) *fakeCommands {
+	fake := NewFakeCalaos(CalaosJsonMsgHome{}, "user", "pass")
+	url, err := fake.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(fake.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	cfg := setupTestConfig()
+	cfg.WebSocketServer.User, cfg.WebSocketServer.Password = "user", "pass"
+	cfg.Login.Timeout.Duration = 2 * time.Second
+	require.NoError(t, loginOnce(conn, cfg))
+
+	withState(func() {
+		websocketClient = &WebSocketClient{conn: conn}
+		websocketClient.isConnected.Store(true)
+	})
+	return &fakeCommands{FakeCalaos: fake}
+}
+
+// nextCommand waits for the next set_state and returns its IO id and value
+func nextCommand(t *testing.T, commands *fakeCommands) (string, string) {
+	var received []CalaosJsonSetState
+	require.Eventually(t, func() bool {
+		received = commands.Commands()
+		return len(received) > commands.read
+	}, 2*time.Second, 5*time.Millisecond, "no set_state received")
+	msg := received[commands.read]
+	commands.read++
+	return msg.Data.Id, msg.Data.Value
+}
+
+// noCommand checks that no set_state is received within wait
+func noCommand(t *testing.T, commands *fakeCommands, wait time.Duration) {
+	time.Sleep(wait)
+	if received := commands.Commands(); len(received) > commands.read {
+		assert.Fail(t, "unexpected set_state", "%s=%s", received[commands.read].Data.Id, received[commands.read].Data.Value)
+	}
+}
+
+// nextCommands returns the next n set_state received, in order
+func nextCommands(t *testing.T, commands *fakeCommands, n int) []string {
+	var list []string
+	for range n {
+		id, value := nextCommand(t, commands)
+		list = append(list, id+"="+value)
+	}
+	return list
+}
+
+// remoteSet changes c like a paired controller
+func remoteSet(c *characteristic.C, v interface{}) {
+	c.SetValueRequest(v, httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+}
+
+func relayIO(style, state string) CalaosIO {
+	return CalaosIO{
+		ID:      "test-relay-1",
+		Name:    "Test Relay",
+		GuiType: CalaosGuiTypeLight,
+		IoStyle: style,
+		IoType:  "output",
+		State:   state,
+		Visible: "true",
+	}
+}
+
+func TestNewCalaosAccessory_LightStyles(t *testing.T) {
+	tests := []struct {
+		style    string
+		expected string
+	}{
+		{"", "LightDimmer"},
+		{CalaosIOStyleLight, "LightDimmer"},
+		{CalaosIOStylePlug, "Outlet"},
+		{CalaosIOStyleOutlet, "Outlet"},
+		{CalaosIOStyleFan, "Fan"},
+		{CalaosIOStyleSwitch, "Switch"},
+		{CalaosIOStylePump, "Valve"},
+		{CalaosIOStyleIrrigation, "Valve"},
+		{CalaosIOStyleHeater, "Switch"},
+		{CalaosIOStyleBoiler, "Switch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			acc, reason := newCalaosAccessory(relayIO(tt.style, "false"), 12345, IOConfig{})
+			require.NotNil(t, acc, reason)
+			assert.Equal(t, tt.expected, accessoryTypeName(acc))
+			require.NotNil(t, acc.AccessoryGet())
+			assert.Equal(t, uint64(12345), acc.AccessoryGet().Id)
+		})
+	}
+
+	acc, reason := newCalaosAccessory(relayIO("spotlight", "false"), 12345, IOConfig{})
+	assert.Nil(t, acc)
+	assert.Equal(t, `io_style "spotlight" is not supported for gui_type "light"`, reason)
+}
+
+func TestOutlet(t *testing.T) {
+	commands := captureCommands(t)
+	acc := NewOutlet(relayIO(CalaosIOStylePlug, "true"), 12345)
+	assert.True(t, acc.Outlet.Outlet.On.Value())
+	assert.True(t, acc.Outlet.Outlet.OutletInUse.Value())
+
+	require.NoError(t, acc.Update(&CalaosIO{State: "false"}))
+	assert.False(t, acc.Outlet.Outlet.On.Value())
+	assert.Error(t, acc.Update(&CalaosIO{State: "invalid"}))
+
+	remoteSet(acc.Outlet.Outlet.On.C, true)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "test-relay-1", id)
+	assert.Equal(t, "true", value)
+}
+
+func TestFan(t *testing.T) {
+	commands := captureCommands(t)
+	acc := NewFan(relayIO(CalaosIOStyleFan, "false"), 12345)
+	assert.False(t, acc.Fan.Fan.On.Value())
+
+	require.NoError(t, acc.Update(&CalaosIO{State: "true"}))
+	assert.True(t, acc.Fan.Fan.On.Value())
+
+	remoteSet(acc.Fan.Fan.On.C, false)
+	_, value := nextCommand(t, commands)
+	assert.Equal(t, "false", value)
+}
+
+func TestSwitch(t *testing.T) {
+	commands := captureCommands(t)
+	acc := NewSwitch(relayIO(CalaosIOStyleSwitch, "false"), 12345)
+
+	require.NoError(t, acc.Update(&CalaosIO{State: "true"}))
+	assert.True(t, acc.Switch.Switch.On.Value())
+
+	remoteSet(acc.Switch.Switch.On.C, false)
+	_, value := nextCommand(t, commands)
+	assert.Equal(t, "false", value)
+}
+
+func TestValve(t *testing.T) {
+	commands := captureCommands(t)
+	acc := NewValve(relayIO(CalaosIOStyleIrrigation, "false"), 12345)
+	assert.Equal(t, characteristic.ValveTypeIrrigation, acc.Valve.ValveType.Value())
+	assert.Equal(t, characteristic.ActiveInactive, acc.Valve.Active.Value())
+	assert.Equal(t, characteristic.InUseNotInUse, acc.Valve.InUse.Value())
+
+	require.NoError(t, acc.Update(&CalaosIO{State: "true"}))
+	assert.Equal(t, characteristic.ActiveActive, acc.Valve.Active.Value())
+	assert.Equal(t, characteristic.InUseInUse, acc.Valve.InUse.Value())
+
+	remoteSet(acc.Valve.Active.C, characteristic.ActiveInactive)
+	_, value := nextCommand(t, commands)
+	assert.Equal(t, "false", value)
+
+	pump := NewValve(relayIO(CalaosIOStylePump, "false"), 12345)
+	assert.Equal(t, characteristic.ValveTypeGenericValve, pump.Valve.ValveType.Value())
+}
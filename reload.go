@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/vcaesar/murmur"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigWatchInterval is how often configuration files are checked when WatchConfig is set
+const ConfigWatchInterval = 5 * time.Second
+
+// ReloadResult lists the settings changed by a configuration reload
+type ReloadResult struct {
+	Applied         []string // settings applied to the running bridge
+	RestartRequired []string // settings kept at their previous value until restart
+}
+
+// reloadConfig reads the configuration file again and applies the changes
+// that do not need a restart. Other changed settings keep their previous
+// value and are reported, as is an invalid configuration. The servers are
+// restarted first: when one of them fails, the current configuration is kept
+// and the servers it runs are started again.
+func reloadConfig(ctx context.Context) (ReloadResult, error) {
+	var result ReloadResult
+
+	newConfig, err := loadConfig(configFilename)
+	if err != nil {
+		return result, err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := config
+
+	// The pairing identity is fixed while the HAP server runs
+	if newConfig.PinCode != old.PinCode {
+		result.RestartRequired = append(result.RestartRequired, "PinCode")
+		newConfig.PinCode = old.PinCode
+	}
+	if newConfig.BridgeName != old.BridgeName {
+		result.RestartRequired = append(result.RestartRequired, "BridgeName")
+		newConfig.BridgeName = old.BridgeName
+	}
+
+	var reconnect func()
+	if !reflect.DeepEqual(newConfig.WebSocketServer, old.WebSocketServer) {
+		if reconnect, err = calaosReconnect(newConfig.WebSocketServer); err != nil {
+			// The settings were validated, this should not happen
+			return result, err
+		}
+	}
+
+	if newConfig.HTTP != old.HTTP {
+		stopHTTPServer()
+		if err := startHTTPServer(newConfig.HTTP); err != nil {
+			restoreHTTPServer(old.HTTP)
+			return result, fmt.Errorf("restarting HTTP server: %w", err)
+		}
+		result.Applied = append(result.Applied, "HTTP")
+	}
+
+	restartHAP := false
+	if !reflect.DeepEqual(newConfig.IOs, old.IOs) && excludedIOs(newConfig) != excludedIOs(old) {
+		restartHAP = true
+	}
+	if !reflect.DeepEqual(compositeConfigs(newConfig), compositeConfigs(old)) {
+		restartHAP = true
+		result.Applied = append(result.Applied, "composite accessories")
+	}
+
+	config = newConfig
+
+	if restartHAP && hapServerStarted {
+		// Accessories cannot be added or removed on a running HAP server
+		stopHAPServer()
+		if err := startHAPServer(ctx); err != nil {
+			config = old
+			if err := startHAPServer(ctx); err != nil {
+				log.Errorf("Failed to restart the HAP server of the current configuration: %v", err)
+			}
+			if newConfig.HTTP != old.HTTP {
+				restoreHTTPServer(old.HTTP)
+			}
+			return result, fmt.Errorf("restarting HAP server: %w", err)
+		}
+	}
+
+	// Nothing fails from here, the new configuration is applied in full
+
+	if !reflect.DeepEqual(newConfig.Log, old.Log) {
+		applyLogConfig(withLogFlags(newConfig.Log))
+		result.Applied = append(result.Applied, "Log")
+	}
+
+	if newConfig.Health != old.Health {
+		applyHealthConfig(newConfig.Health)
+		result.Applied = append(result.Applied, "Health")
+	}
+
+	if newConfig.WatchConfig != old.WatchConfig {
+		result.Applied = append(result.Applied, "WatchConfig")
+	}
+
+	if !reflect.DeepEqual(newConfig.Login, old.Login) {
+		// Login settings are read when logging in
+		result.Applied = append(result.Applied, "Login")
+	}
+
+	if reconnect != nil {
+		reconnect()
+		result.Applied = append(result.Applied, "WebSocketServer")
+	}
+
+	if !reflect.DeepEqual(newConfig.IOs, old.IOs) {
+		if !restartHAP {
+			applyIONames()
+		}
+		result.Applied = append(result.Applied, "IOs")
+	}
+
+	return result, nil
+}
+
+// restoreHTTPServer starts the HTTP server of cfg, the current configuration, again after a failed reload
+func restoreHTTPServer(cfg HTTPConfig) {
+	stopHTTPServer()
+	if err := startHTTPServer(cfg); err != nil {
+		log.Errorf("Failed to restart the HTTP server of the current configuration: %v", err)
+	}
+}
+
+// logReloadResult reports the outcome of a configuration reload
+func logReloadResult(result ReloadResult, err error) {
+	if err != nil {
+		log.Error("Configuration not reloaded, keeping the current one")
+		logConfigErrors(err)
+		return
+	}
+	if len(result.Applied) == 0 && len(result.RestartRequired) == 0 {
+		log.Info("Configuration reloaded, nothing changed")
+	}
+	for _, setting := range result.Applied {
+		log.Infof("Configuration reloaded, %s applied", setting)
+	}
+	for _, setting := range result.RestartRequired {
+		log.Warnf("Configuration reloaded, %s changed but needs a restart of calaos-homekit", setting)
+	}
+}
+
+// excludedIOs returns a comparable description of the excluded IOs
+func excludedIOs(cfg Configuration) string {
+	excluded := map[string]bool{}
+	for id, io := range cfg.IOs {
+		if io.Exclude {
+			excluded[id] = true
+		}
+	}
+	return fmt.Sprint(excluded)
+}
+
+// applyIONames renames the exposed accessories after their name override
+func applyIONames() {
+	routes := compositeIOs(config)
+	for i := range home.Data.Home {
+		for j := range home.Data.Home[i].IOs {
+			cio := home.Data.Home[i].IOs[j]
+			if _, found := routes[cio.ID]; found {
+				// Composite accessories are named in their section
+				continue
+			}
+			acc, found := accessories[uint64(murmur.Sum32(cio.ID))]
+			if !found || acc.AccessoryGet() == nil {
+				continue
+			}
+			name := cio.Name
+			if override := config.IOs[cio.ID].Name; override != "" {
+				name = override
+			}
+			acc.AccessoryGet().Info.Name.SetValue(name)
+		}
+	}
+}
+
+// calaosReconnect returns the function applying the WebSocketServer settings
+// cfg by reconnecting to Calaos
+func calaosReconnect(cfg WebSocketConfig) (func(), error) {
+	uri, header, err := calaosEndpoint(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newCalaosDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		log.Infof("Reconnecting to Calaos WebSocket: %s", uri)
+		websocketClient.Reconfigure(uri, dialer, header)
+	}, nil
+}
+
+// configFingerprint describes the configuration files, it changes when one of them is modified
+func configFingerprint(files []string) string {
+	fingerprint := ""
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			fingerprint += fmt.Sprintf("%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fingerprint += f + ":missing;"
+		}
+	}
+	return fingerprint
+}
+
+// watchConfig sends on reload when WatchConfig is set and a configuration file changes
+func watchConfig(ctx context.Context, reload chan<- struct{}) {
+	ticker := time.NewTicker(ConfigWatchInterval)
+	defer ticker.Stop()
+
+	stateMu.Lock()
+	lastFiles := config.files
+	stateMu.Unlock()
+	last := configFingerprint(lastFiles)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stateMu.Lock()
+			watch, files := config.WatchConfig, config.files
+			stateMu.Unlock()
+
+			current := configFingerprint(files)
+			if !reflect.DeepEqual(files, lastFiles) {
+				// A reload changed the included files, they are the new reference
+				lastFiles, last = files, current
+				continue
+			}
+			if watch && current != last {
+				log.Info("Configuration file changed, reloading")
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+			last = current
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const reloadTestConfig = `{
+    "WebSocketServer": {
+        "Host": "calaos.local",
+        "User": "user",
+        "Password": "pass"
+    },
+    "PinCode": "63613161",
+    "IOs": {
+        "test-io-1": {"Name": "Renamed Light"}
+    }
+}`
+
+// setupReloadTest loads content as the running configuration with the test home
+func setupReloadTest(t *testing.T, content string) string {
+	configFilename = writeTestConfig(t, "config.json", content)
+	var err error
+	config, err = loadConfig(configFilename)
+	require.NoError(t, err)
+
+	home = setupTestHome()
+	accessories = make(map[uint64]CalaosAccessory)
+	setupCalaosHome()
+	websocketClient = &WebSocketClient{url: "ws://calaos.local:5454/api"}
+	hapServerStarted = false
+
+	t.Cleanup(func() { applyLogConfig(LogConfig{}) })
+	return configFilename
+}
+
+func TestSetupCalaosHome_Overrides(t *testing.T) {
+	setupReloadTest(t, reloadTestConfig)
+
+	acc, found := accessories[uint64(murmur.Sum32("test-io-1"))]
+	require.True(t, found)
+	assert.Equal(t, "Renamed Light", acc.AccessoryGet().Info.Name.Value())
+
+	config.IOs["test-io-2"] = IOConfig{Exclude: true}
+	accessories = make(map[uint64]CalaosAccessory)
+	setupCalaosHome()
+	_, found = accessories[uint64(murmur.Sum32("test-io-2"))]
+	assert.False(t, found)
+}
+
+func TestReloadConfig_LiveSettings(t *testing.T) {
+	filename := setupReloadTest(t, reloadTestConfig)
+
+	require.NoError(t, os.WriteFile(filename, []byte(`{
+    "WebSocketServer": {
+        "Host": "other.local",
+        "User": "user",
+        "Password": "newpass"
+    },
+    "Log": {"Level": "debug"},
+    "PinCode": "63613161",
+    "IOs": {
+        "test-io-1": {"Name": "Kitchen"}
+    }
+}`), 0600))
+
+	result, err := reloadConfig(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Log", "WebSocketServer", "IOs"}, result.Applied)
+	assert.Empty(t, result.RestartRequired)
+
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	assert.Equal(t, "newpass", config.WebSocketServer.Password)
+	assert.Equal(t, "ws://other.local:5454/api", websocketClient.url)
+
+	acc := accessories[uint64(murmur.Sum32("test-io-1"))]
+	assert.Equal(t, "Kitchen", acc.AccessoryGet().Info.Name.Value())
+}
+
+func TestReloadConfig_RestartRequired(t *testing.T) {
+	filename := setupReloadTest(t, reloadTestConfig)
+
+	require.NoError(t, os.WriteFile(filename, []byte(`{
+    "WebSocketServer": {
+        "Host": "calaos.local",
+        "User": "user",
+        "Password": "pass"
+    },
+    "PinCode": "11122333",
+    "BridgeName": "New Name",
+    "IOs": {
+        "test-io-1": {"Name": "Renamed Light"}
+    }
+}`), 0600))
+
+	result, err := reloadConfig(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, result.Applied)
+	assert.ElementsMatch(t, []string{"PinCode", "BridgeName"}, result.RestartRequired)
+	assert.Equal(t, "63613161", config.PinCode)
+	assert.Equal(t, DefaultBridgeName, config.BridgeName)
+}
+
+func TestReloadConfig_InvalidKeepsCurrent(t *testing.T) {
+	filename := setupReloadTest(t, reloadTestConfig)
+	require.NoError(t, os.WriteFile(filename, []byte(`{"PinCode": "1"}`), 0600))
+
+	_, err := reloadConfig(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, "calaos.local", config.WebSocketServer.Host)
+	assert.Equal(t, "Renamed Light", config.IOs["test-io-1"].Name)
+}
+
+func TestReloadConfig_HTTPPortInUse(t *testing.T) {
+	filename := setupReloadTest(t, reloadTestConfig)
+	config.HTTP.Listen = "127.0.0.1:0"
+	require.NoError(t, startHTTPServer(config.HTTP))
+	t.Cleanup(stopHTTPServer)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filename, []byte(fmt.Sprintf(`{
+    "WebSocketServer": {
+        "Host": "other.local",
+        "User": "user",
+        "Password": "pass"
+    },
+    "HTTP": {"Listen": %q},
+    "PinCode": "63613161",
+    "IOs": {
+        "test-io-1": {"Name": "Kitchen"}
+    }
+}`, busy.Addr().String())), 0600))
+
+	// Nothing is applied and the current HTTP server runs again
+	_, err = reloadConfig(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, "127.0.0.1:0", config.HTTP.Listen)
+	assert.NotNil(t, httpServer)
+	assert.Equal(t, "calaos.local", config.WebSocketServer.Host)
+	assert.Equal(t, "ws://calaos.local:5454/api", websocketClient.url)
+	acc := accessories[uint64(murmur.Sum32("test-io-1"))]
+	assert.Equal(t, "Renamed Light", acc.AccessoryGet().Info.Name.Value())
+
+	// Every section is applied once the port is free
+	require.NoError(t, busy.Close())
+	result, err := reloadConfig(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"HTTP", "WebSocketServer", "IOs"}, result.Applied)
+	assert.Equal(t, "ws://other.local:5454/api", websocketClient.url)
+	assert.Equal(t, "Kitchen", acc.AccessoryGet().Info.Name.Value())
+}
+
+func TestReloadConfig_Unchanged(t *testing.T) {
+	setupReloadTest(t, reloadTestConfig)
+
+	result, err := reloadConfig(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, result.Applied)
+	assert.Empty(t, result.RestartRequired)
+}
+
+func TestConfigFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(filename, []byte("{}"), 0600))
+
+	before := configFingerprint([]string{filename, dir})
+	assert.Equal(t, before, configFingerprint([]string{filename, dir}))
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filename, later, later))
+	assert.NotEqual(t, before, configFingerprint([]string{filename, dir}))
+
+	require.NoError(t, os.Remove(filename))
+	assert.Contains(t, configFingerprint([]string{filename}), "missing")
+}
+
+func TestLoadConfig_TracksIncludedFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml":   "Include: conf.d/*.yaml\nPinCode: \"63613161\"\n",
+		"conf.d/a.yaml": "WebSocketServer:\n  Host: calaos.local\n  User: user\n  Password: pass\n",
+	})
+
+	cfg, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "conf.d"),
+		filepath.Join(dir, "conf.d/a.yaml"),
+	}, cfg.files)
+}
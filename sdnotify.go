@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// systemd notification messages
+const (
+	SdNotifyReady    = "READY=1"
+	SdNotifyWatchdog = "WATCHDOG=1"
+	SdNotifyStopping = "STOPPING=1"
+)
+
+// SdNotifyInterval is how often health is reported to systemd, shortened to
+// half the watchdog timeout when needed
+const SdNotifyInterval = 10 * time.Second
+
+// sdNotify sends state to systemd when the service runs with Type=notify.
+// It returns false without error when NOTIFY_SOCKET is not set.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns the watchdog timeout systemd expects pings
+// within, 0 when the watchdog is disabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSystemdNotify tells systemd the bridge is started, then pings its
+// watchdog while the bridge is healthy, so that systemd restarts a bridge
+// which lost Calaos for longer than Health.Grace. Readiness to serve
+// HomeKit is reported by /readyz: an unreachable Calaos or a home without
+// any IO to expose must not keep systemd waiting for the start to finish.
+func runSystemdNotify(ctx context.Context, interval time.Duration) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	if _, err := sdNotify(SdNotifyReady); err != nil {
+		log.Warnf("Failed to notify systemd: %v", err)
+	} else {
+		log.Info("Notified systemd that the bridge is started")
+	}
+
+	watchdog := sdWatchdogInterval()
+	if watchdog == 0 {
+		return
+	}
+	if watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report := currentHealth()
+		if report.Healthy {
+			if _, err := sdNotify(SdNotifyWatchdog); err != nil {
+				log.Warnf("Failed to ping systemd watchdog: %v", err)
+			}
+		} else {
+			log.Warnf("Bridge unhealthy since %s, not pinging systemd watchdog", report.Status.OfflineSince.Format(time.RFC3339))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
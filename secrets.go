@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Secret reference prefixes, a secret field without prefix is used as is
+const (
+	SecretPrefixEnv        = "env:"
+	SecretPrefixFile       = "file:"
+	SecretPrefixCredential = "credential:"
+)
+
+// resolveSecret returns the value referenced by a secret field:
+// env:NAME reads an environment variable, file:/path reads a file and
+// credential:NAME reads a systemd credential from $CREDENTIALS_DIRECTORY.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SecretPrefixEnv):
+		name := strings.TrimPrefix(value, SecretPrefixEnv)
+		v, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+
+	case strings.HasPrefix(value, SecretPrefixFile):
+		return readSecretFile(strings.TrimPrefix(value, SecretPrefixFile))
+
+	case strings.HasPrefix(value, SecretPrefixCredential):
+		name := strings.TrimPrefix(value, SecretPrefixCredential)
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", errors.New("CREDENTIALS_DIRECTORY is not set, use LoadCredential= in the systemd unit")
+		}
+		if name == "" || strings.ContainsRune(name, filepath.Separator) {
+			return "", fmt.Errorf("invalid credential name %q", name)
+		}
+		return readSecretFile(filepath.Join(dir, name))
+	}
+	return value, nil
+}
+
+// readSecretFile returns the content of path without its trailing newline
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// resolveSecrets replaces every secret reference of the configuration by its value
+func resolveSecrets(cfg *Configuration) error {
+	if err := resolveSecretField("WebSocketServer.Password", &cfg.WebSocketServer.Password); err != nil {
+		return err
+	}
+	if err := resolveSecretField("PinCode", &cfg.PinCode); err != nil {
+		return err
+	}
+	if err := resolveSecretField("HTTP.APIToken", &cfg.HTTP.APIToken); err != nil {
+		return err
+	}
+
+	// Headers can carry reverse proxy credentials
+	names := make([]string, 0, len(cfg.WebSocketServer.Headers))
+	for name := range cfg.WebSocketServer.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := cfg.WebSocketServer.Headers[name]
+		if err := resolveSecretField("WebSocketServer.Headers."+name, &v); err != nil {
+			return err
+		}
+		cfg.WebSocketServer.Headers[name] = v
+	}
+	return nil
+}
+
+func resolveSecretField(name string, field *string) error {
+	v, err := resolveSecret(*field)
+	if err != nil {
+		return &ConfigError{Field: name, Msg: err.Error()}
+	}
+	*field = v
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "password"), []byte("from-file\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "calaos-pin"), []byte("11122333"), 0600))
+	t.Setenv("CALAOS_TEST_PASSWORD", "from-env")
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "Plain value", value: "plain", expected: "plain"},
+		{name: "Empty value", value: "", expected: ""},
+		{name: "Environment variable", value: "env:CALAOS_TEST_PASSWORD", expected: "from-env"},
+		{name: "File without trailing newline", value: "file:" + filepath.Join(dir, "password"), expected: "from-file"},
+		{name: "Systemd credential", value: "credential:calaos-pin", expected: "11122333"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := resolveSecret(tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, v)
+		})
+	}
+}
+
+func TestResolveSecret_Errors(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "Unset environment variable", value: "env:CALAOS_TEST_UNSET"},
+		{name: "Missing file", value: "file:" + filepath.Join(dir, "missing")},
+		{name: "Missing credential", value: "credential:missing"},
+		{name: "Credential outside directory", value: "credential:../password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveSecret(tt.value)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	_, err := resolveSecret("credential:calaos-pin")
+	assert.Error(t, err)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("CALAOS_TEST_PASSWORD", "secret")
+	t.Setenv("CALAOS_TEST_PIN", "11122333")
+	t.Setenv("CALAOS_TEST_AUTH", "Basic dXNlcjpwYXNz")
+
+	cfg := setupTestConfig()
+	cfg.WebSocketServer.Password = "env:CALAOS_TEST_PASSWORD"
+	cfg.WebSocketServer.Headers = map[string]string{"Authorization": "env:CALAOS_TEST_AUTH"}
+	cfg.PinCode = "env:CALAOS_TEST_PIN"
+
+	require.NoError(t, resolveSecrets(&cfg))
+	assert.Equal(t, "secret", cfg.WebSocketServer.Password)
+	assert.Equal(t, "11122333", cfg.PinCode)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", cfg.WebSocketServer.Headers["Authorization"])
+
+	cfg.PinCode = "env:CALAOS_TEST_UNSET"
+	err := resolveSecrets(&cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "PinCode")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// SecuritySystemConfig describes an alarm made of Calaos variables and scenarios
+type SecuritySystemConfig struct {
+	Name      string // name shown in HomeKit, defaults to the name of the State IO
+	State     string // var_int holding the HomeKit state number, or var_bool true while armed
+	ArmAway   string // scenario or var_bool set to true to arm away
+	ArmStay   string // scenario or var_bool set to true to arm stay
+	ArmNight  string // scenario or var_bool set to true to arm night
+	Disarm    string // scenario or var_bool set to true to disarm
+	Triggered string // var_bool true while the alarm rings
+}
+
+// commands returns the command IO of each target state, by target state
+func (cfg SecuritySystemConfig) commands() map[int]string {
+	commands := map[int]string{}
+	for target, id := range map[int]string{
+		characteristic.SecuritySystemTargetStateStayArm:  cfg.ArmStay,
+		characteristic.SecuritySystemTargetStateAwayArm:  cfg.ArmAway,
+		characteristic.SecuritySystemTargetStateNightArm: cfg.ArmNight,
+		characteristic.SecuritySystemTargetStateDisarm:   cfg.Disarm,
+	} {
+		if id != "" {
+			commands[target] = id
+		}
+	}
+	return commands
+}
+
+func (cfg SecuritySystemConfig) ios() []string {
+	ios := []string{cfg.State}
+	for _, id := range []string{cfg.ArmAway, cfg.ArmStay, cfg.ArmNight, cfg.Disarm, cfg.Triggered} {
+		if id != "" {
+			ios = append(ios, id)
+		}
+	}
+	return ios
+}
+
+func (cfg SecuritySystemConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewSecuritySystem(cfg, ios, id)
+}
+
+// validateSecuritySystems checks the SecuritySystems section of the configuration
+func validateSecuritySystems(cfgs []SecuritySystemConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("SecuritySystems[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.State == "" {
+			fail("State", "is required")
+		}
+		if commands := cfg.commands(); len(commands) > 0 && commands[characteristic.SecuritySystemTargetStateDisarm] == "" {
+			fail("Disarm", "is required with arm commands")
+		}
+	}
+	return errs
+}
+
+// parseAlarmState returns the SecuritySystemCurrentState of a State IO value
+func parseAlarmState(state string) (int, error) {
+	if v, err := strconv.ParseFloat(state, 64); err == nil {
+		mode := int(v)
+		if float64(mode) != v || mode < characteristic.SecuritySystemCurrentStateStayArm || mode > characteristic.SecuritySystemCurrentStateAlarmTriggered {
+			return 0, fmt.Errorf("invalid alarm state %s", state)
+		}
+		return mode, nil
+	}
+	armed, err := strconv.ParseBool(state)
+	if err != nil {
+		return 0, err
+	}
+	if armed {
+		return characteristic.SecuritySystemCurrentStateAwayArm, nil
+	}
+	return characteristic.SecuritySystemCurrentStateDisarmed, nil
+}
+
+// SecuritySystem shows the state of a Calaos alarm and runs the command of
+// the target state chosen in HomeKit. Without commands, the target state is
+// written to the State variable.
+type SecuritySystem struct {
+	*accessory.A
+	SecuritySystem *service.SecuritySystem
+
+	config   SecuritySystemConfig
+	state    CalaosIO
+	commands map[int]CalaosIO // command IO of each target state
+	logger   *log.Entry
+
+	mu        sync.Mutex
+	mode      int  // state of the State IO
+	triggered bool // state of the Triggered IO
+}
+
+var LogComponentSecuritySystem = registerLogComponent("security_system")
+
+func NewSecuritySystem(cfg SecuritySystemConfig, ios map[string]CalaosIO, id uint64) *SecuritySystem {
+	state := ios[cfg.State]
+	acc := SecuritySystem{
+		config:   cfg,
+		state:    state,
+		commands: map[int]CalaosIO{},
+		logger:   accessoryLogger(LogComponentSecuritySystem, state, id),
+	}
+	for target, ioID := range cfg.commands() {
+		acc.commands[target] = ios[ioID]
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = state.Name
+	}
+	acc.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: state.ID,
+		Manufacturer: "Calaos",
+		Model:        state.IoType,
+	}, accessory.TypeSecuritySystem)
+	acc.A.Id = id
+
+	acc.SecuritySystem = service.NewSecuritySystem()
+	acc.AddS(acc.SecuritySystem.S)
+
+	target := acc.SecuritySystem.SecuritySystemTargetState
+	if commands := cfg.commands(); len(commands) > 0 {
+		target.ValidVals = nil
+		for _, t := range []int{
+			characteristic.SecuritySystemTargetStateStayArm,
+			characteristic.SecuritySystemTargetStateAwayArm,
+			characteristic.SecuritySystemTargetStateNightArm,
+			characteristic.SecuritySystemTargetStateDisarm,
+		} {
+			if commands[t] != "" {
+				target.ValidVals = append(target.ValidVals, t)
+			}
+		}
+	} else if state.GuiType == CalaosGuiTypeVarBool {
+		target.ValidVals = []int{characteristic.SecuritySystemTargetStateAwayArm, characteristic.SecuritySystemTargetStateDisarm}
+	}
+
+	acc.mode = characteristic.SecuritySystemCurrentStateDisarmed
+	if mode, err := parseAlarmState(state.State); err == nil {
+		acc.mode = mode
+	}
+	acc.triggered, _ = strconv.ParseBool(ios[cfg.Triggered].State)
+	acc.show()
+
+	target.OnValueRemoteUpdate(func(t int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.setTarget(t)
+	})
+
+	return &acc
+}
+
+// setTarget runs the command of target, the caller holds mu
+func (acc *SecuritySystem) setTarget(target int) {
+	acc.logger.Debugf("Setting alarm to %d", target)
+	// The State variable tells when the alarm gets there
+	if cio, found := acc.commands[target]; found {
+		cio.State = "true"
+		if err := CalaosUpdate(cio); err != nil || cio.GuiType != CalaosGuiTypeVarBool {
+			return
+		}
+		// Reset the variable, so that the next command changes it again
+		cio.State = "false"
+		CalaosUpdate(cio)
+		return
+	}
+
+	cio := acc.state
+	if acc.state.GuiType == CalaosGuiTypeVarBool {
+		cio.State = strconv.FormatBool(target != characteristic.SecuritySystemTargetStateDisarm)
+	} else {
+		cio.State = strconv.Itoa(target)
+	}
+	CalaosUpdate(cio)
+}
+
+// show sets the current and target states from the Calaos IOs, the caller holds mu
+func (acc *SecuritySystem) show() {
+	svc := acc.SecuritySystem
+	if acc.mode != characteristic.SecuritySystemCurrentStateAlarmTriggered {
+		// Current and target states use the same values but for triggered
+		svc.SecuritySystemTargetState.SetValue(acc.mode)
+	}
+	if acc.triggered {
+		svc.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
+	} else {
+		svc.SecuritySystemCurrentState.SetValue(acc.mode)
+	}
+}
+
+func (acc *SecuritySystem) Update(cio *CalaosIO) error {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	switch cio.ID {
+	case acc.config.State:
+		mode, err := parseAlarmState(cio.State)
+		if err != nil {
+			return err
+		}
+		acc.mode = mode
+	case acc.config.Triggered:
+		triggered, err := strconv.ParseBool(cio.State)
+		if err != nil {
+			return err
+		}
+		acc.triggered = triggered
+	default:
+		// Commands are only run
+		return nil
+	}
+	acc.show()
+	return nil
+}
+
+func (acc *SecuritySystem) AccessoryGet() *accessory.A {
+	return acc.A
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupAlarmHome adds a disarmed alarm to the test home
+func setupAlarmHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Alarm",
+		IOs: []CalaosIO{
+			{ID: "alarm-state", Name: "Alarm", GuiType: "var_int", IoType: "inout", Visible: "false", State: "3"},
+			{ID: "alarm-away", Name: "Arm away", GuiType: "scenario", IoType: "inout", Visible: "true", State: "false"},
+			{ID: "alarm-night", Name: "Arm night", GuiType: "scenario", IoType: "inout", Visible: "true", State: "false"},
+			{ID: "alarm-off", Name: "Disarm", GuiType: "scenario", IoType: "inout", Visible: "true", State: "false"},
+			{ID: "alarm-ringing", Name: "Alarm ringing", GuiType: CalaosGuiTypeVarBool, IoType: "inout", Visible: "false", State: "false"},
+			{ID: "alarm-armed", Name: "Alarm armed", GuiType: CalaosGuiTypeVarBool, IoType: "inout", Visible: "false", State: "true"},
+			{ID: "alarm-away-var", Name: "Arm away request", GuiType: CalaosGuiTypeVarBool, IoType: "inout", Visible: "false", State: "false"},
+			{ID: "alarm-off-var", Name: "Disarm request", GuiType: CalaosGuiTypeVarBool, IoType: "inout", Visible: "false", State: "false"},
+		},
+	})
+	return h
+}
+
+func alarmConfig() SecuritySystemConfig {
+	return SecuritySystemConfig{
+		State:     "alarm-state",
+		ArmAway:   "alarm-away",
+		ArmNight:  "alarm-night",
+		Disarm:    "alarm-off",
+		Triggered: "alarm-ringing",
+	}
+}
+
+func newTestSecuritySystem(cfg SecuritySystemConfig) *SecuritySystem {
+	return NewSecuritySystem(cfg, homeIOs(setupAlarmHome(), nil), uint64(murmur.Sum32(cfg.State)))
+}
+
+func alarmStates(acc *SecuritySystem) (current, target int) {
+	svc := acc.SecuritySystem
+	return svc.SecuritySystemCurrentState.Value(), svc.SecuritySystemTargetState.Value()
+}
+
+func TestParseAlarmState(t *testing.T) {
+	tests := []struct {
+		state    string
+		expected int
+		err      bool
+	}{
+		{"0", characteristic.SecuritySystemCurrentStateStayArm, false},
+		{"2", characteristic.SecuritySystemCurrentStateNightArm, false},
+		{"4.0", characteristic.SecuritySystemCurrentStateAlarmTriggered, false},
+		{"true", characteristic.SecuritySystemCurrentStateAwayArm, false},
+		{"false", characteristic.SecuritySystemCurrentStateDisarmed, false},
+		{"5", 0, true},
+		{"-1", 0, true},
+		{"1.5", 0, true},
+		{"armed", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			state, err := parseAlarmState(tt.state)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, state)
+		})
+	}
+}
+
+func TestSecuritySystem_Arm(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestSecuritySystem(alarmConfig())
+	current, target := alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateDisarmed, current)
+	assert.Equal(t, characteristic.SecuritySystemTargetStateDisarm, target)
+	assert.Equal(t, "Alarm", acc.AccessoryGet().Name())
+	assert.Equal(t, []int{
+		characteristic.SecuritySystemTargetStateAwayArm,
+		characteristic.SecuritySystemTargetStateNightArm,
+		characteristic.SecuritySystemTargetStateDisarm,
+	}, acc.SecuritySystem.SecuritySystemTargetState.ValidVals)
+
+	remoteSet(acc.SecuritySystem.SecuritySystemTargetState.C, characteristic.SecuritySystemTargetStateNightArm)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "alarm-night", id)
+	assert.Equal(t, "true", value)
+	current, _ = alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateDisarmed, current)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "2"}))
+	current, target = alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateNightArm, current)
+	assert.Equal(t, characteristic.SecuritySystemTargetStateNightArm, target)
+
+	// Events of the scenarios are ignored
+	assert.NoError(t, acc.Update(&CalaosIO{ID: "alarm-night", State: "invalid"}))
+	assert.Error(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "invalid"}))
+}
+
+func TestSecuritySystem_VariableCommands(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestSecuritySystem(SecuritySystemConfig{State: "alarm-state", ArmAway: "alarm-away-var", Disarm: "alarm-off-var"})
+	target := acc.SecuritySystem.SecuritySystemTargetState.C
+
+	// Each command resets its variable, so that arming away again changes it
+	for range 2 {
+		remoteSet(target, characteristic.SecuritySystemTargetStateAwayArm)
+		assert.Equal(t, []string{"alarm-away-var=true", "alarm-away-var=false"}, nextCommands(t, commands, 2))
+		require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "1"}))
+
+		// Disarmed from Calaos
+		require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "3"}))
+	}
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "1"}))
+	remoteSet(target, characteristic.SecuritySystemTargetStateDisarm)
+	assert.Equal(t, []string{"alarm-off-var=true", "alarm-off-var=false"}, nextCommands(t, commands, 2))
+}
+
+func TestSecuritySystem_Triggered(t *testing.T) {
+	acc := newTestSecuritySystem(alarmConfig())
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "1"}))
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-ringing", State: "true"}))
+	current, target := alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateAlarmTriggered, current)
+	assert.Equal(t, characteristic.SecuritySystemTargetStateAwayArm, target)
+
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-ringing", State: "false"}))
+	current, _ = alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateAwayArm, current)
+
+	// A State variable can tell it too
+	require.NoError(t, acc.Update(&CalaosIO{ID: "alarm-state", State: "4"}))
+	current, target = alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateAlarmTriggered, current)
+	assert.Equal(t, characteristic.SecuritySystemTargetStateAwayArm, target)
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "alarm-ringing", State: "invalid"}))
+}
+
+func TestSecuritySystem_WithoutCommands(t *testing.T) {
+	commands := captureCommands(t)
+
+	acc := newTestSecuritySystem(SecuritySystemConfig{State: "alarm-state"})
+	remoteSet(acc.SecuritySystem.SecuritySystemTargetState.C, characteristic.SecuritySystemTargetStateStayArm)
+	id, value := nextCommand(t, commands)
+	assert.Equal(t, "alarm-state", id)
+	assert.Equal(t, "0", value)
+
+	acc = newTestSecuritySystem(SecuritySystemConfig{State: "alarm-armed"})
+	current, _ := alarmStates(acc)
+	assert.Equal(t, characteristic.SecuritySystemCurrentStateAwayArm, current)
+	assert.Equal(t, []int{
+		characteristic.SecuritySystemTargetStateAwayArm,
+		characteristic.SecuritySystemTargetStateDisarm,
+	}, acc.SecuritySystem.SecuritySystemTargetState.ValidVals)
+	remoteSet(acc.SecuritySystem.SecuritySystemTargetState.C, characteristic.SecuritySystemTargetStateDisarm)
+	id, value = nextCommand(t, commands)
+	assert.Equal(t, "alarm-armed", id)
+	assert.Equal(t, "false", value)
+}
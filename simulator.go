@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Calaos event types
+const (
+	CalaosEventIOChanged     = "io_changed"
+	CalaosEventIOChangedType = "11"
+)
+
+// FakeCalaos is an in-process Calaos server speaking the websocket API of
+// calaos_server: it answers login, get_home and set_state from a home
+// fixture and sends an event for every state change, like a real Calaos.
+// It is used by tests and the simulate command.
+type FakeCalaos struct {
+	User     string // credentials to accept, any when User is empty
+	Password string
+
+	// OnSetState is called with every set_state received and the resulting state
+	OnSetState func(id, value, state string)
+
+	mu       sync.Mutex
+	home     CalaosJsonMsgHome
+	clients  map[*fakeCalaosClient]bool
+	commands []CalaosJsonSetState
+	server   *http.Server
+}
+
+type fakeCalaosClient struct {
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	loggedIn bool
+}
+
+func (c *fakeCalaosClient) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// NewFakeCalaos returns a fake Calaos serving h and accepting user and password
+func NewFakeCalaos(h CalaosJsonMsgHome, user, password string) *FakeCalaos {
+	h.Msg, h.MsgID = CalaosMsgTypeGetHome, CalaosMsgIDGetHome
+	return &FakeCalaos{
+		User:     user,
+		Password: password,
+		home:     h,
+		clients:  map[*fakeCalaosClient]bool{},
+	}
+}
+
+// LoadFakeHome reads a home fixture, the get_home answer printed by dump-home
+func LoadFakeHome(filename string) (CalaosJsonMsgHome, error) {
+	var h CalaosJsonMsgHome
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(h.Data.Home) == 0 {
+		return h, fmt.Errorf("%s: no rooms in data.home", filename)
+	}
+	return h, nil
+}
+
+// Start serves the fake Calaos on addr and returns its websocket URL
+func (f *FakeCalaos) Start(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(DefaultCalaosPath, f)
+	f.mu.Lock()
+	f.server = &http.Server{Handler: mux}
+	srv := f.server
+	f.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Fake Calaos server error: %v", err)
+		}
+	}()
+	return fmt.Sprintf("%s://%s%s", URITypeWS, ln.Addr(), DefaultCalaosPath), nil
+}
+
+// Close stops the server and closes the client connections
+func (f *FakeCalaos) Close() {
+	f.mu.Lock()
+	srv := f.server
+	f.server = nil
+	f.mu.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+	f.DropClients()
+}
+
+// DropClients closes the client connections, like a restarting Calaos
+func (f *FakeCalaos) DropClients() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.clients {
+		c.conn.Close()
+		delete(f.clients, c)
+	}
+}
+
+// Clients returns the number of connected clients
+func (f *FakeCalaos) Clients() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.clients)
+}
+
+// Commands returns the set_state messages received
+func (f *FakeCalaos) Commands() []CalaosJsonSetState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]CalaosJsonSetState{}, f.commands...)
+}
+
+// State returns the current state of an IO
+func (f *FakeCalaos) State(id string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cio := f.io(id); cio != nil {
+		return cio.State, true
+	}
+	return "", false
+}
+
+// SetState changes the state of an IO and sends the event to the logged in clients,
+// like a change made from Calaos itself
+func (f *FakeCalaos) SetState(id, state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cio := f.io(id)
+	if cio == nil {
+		return fmt.Errorf("unknown IO %s", id)
+	}
+	cio.State = state
+	f.broadcastEvent(id, state)
+	return nil
+}
+
+// io returns the IO of the fake home, the caller holds f.mu
+func (f *FakeCalaos) io(id string) *CalaosIO {
+	for i := range f.home.Data.Home {
+		for j := range f.home.Data.Home[i].IOs {
+			if f.home.Data.Home[i].IOs[j].ID == id {
+				return &f.home.Data.Home[i].IOs[j]
+			}
+		}
+	}
+	return nil
+}
+
+// broadcastEvent sends an io_changed event to the logged in clients, the caller holds f.mu
+func (f *FakeCalaos) broadcastEvent(id, state string) {
+	var event CalaosJsonMsgEvent
+	event.Msg = CalaosMsgTypeEvent
+	event.Data.EventRaw = fmt.Sprintf("%s id:%s state:%s", CalaosEventIOChanged, id, state)
+	event.Data.Data.ID = id
+	event.Data.Data.State = state
+	event.Data.TypeStr = CalaosEventIOChanged
+	event.Data.Type = CalaosEventIOChangedType
+
+	for c := range f.clients {
+		if c.loggedIn {
+			if err := c.send(event); err != nil {
+				log.Debugf("Fake Calaos failed to send event: %v", err)
+			}
+		}
+	}
+}
+
+// ServeHTTP upgrades the request and answers the messages of the client
+func (f *FakeCalaos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &fakeCalaosClient{conn: conn}
+	f.mu.Lock()
+	f.clients[c] = true
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.clients, c)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := f.handle(c, data); err != nil {
+			log.Debugf("Fake Calaos failed to answer: %v", err)
+			return
+		}
+	}
+}
+
+// handle answers a message of client c
+func (f *FakeCalaos) handle(c *fakeCalaosClient, data []byte) error {
+	var msg CalaosJsonMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch msg.Msg {
+	case CalaosMsgTypeLogin:
+		var login CalaosJsonMsgLoginRequest
+		json.Unmarshal(data, &login)
+		c.loggedIn = f.User == "" || (login.Data.CNUser == f.User && login.Data.CNPass == f.Password)
+
+		var answer CalaosJsonMsgLogin
+		answer.Msg, answer.MsgID = CalaosMsgTypeLogin, msg.MsgID
+		answer.Data.Success = strconv.FormatBool(c.loggedIn)
+		return c.send(answer)
+
+	case CalaosMsgTypeGetHome:
+		if !c.loggedIn {
+			return nil
+		}
+		answer := f.home
+		answer.MsgID = msg.MsgID
+		return c.send(answer)
+
+	case CalaosMsgTypeSetState:
+		if !c.loggedIn {
+			return nil
+		}
+		var setState CalaosJsonSetState
+		json.Unmarshal(data, &setState)
+		f.commands = append(f.commands, setState)
+
+		cio := f.io(setState.Data.Id)
+		if cio == nil {
+			return nil
+		}
+		state := fakeCalaosState(*cio, setState.Data.Value)
+		if f.OnSetState != nil {
+			f.OnSetState(cio.ID, setState.Data.Value, state)
+		}
+		if state != cio.State {
+			cio.State = state
+			f.broadcastEvent(cio.ID, state)
+		}
+	}
+	return nil
+}
+
+// fakeCalaosState returns the state of cio after Calaos runs a set_state
+// value on it. Outputs reach their target at once.
+func fakeCalaosState(cio CalaosIO, value string) string {
+	switch cio.GuiType {
+	case CalaosGuiTypeLightDimmer:
+		switch value {
+		case "true", "on":
+			return "100"
+		case "false", "off":
+			return "0"
+		case "toggle":
+			if cio.State == "0" {
+				return "100"
+			}
+			return "0"
+		}
+		if v, found := strings.CutPrefix(value, "set "); found {
+			return v
+		}
+
+	case CalaosGuiTypeLight:
+		if value == "toggle" {
+			b, _ := strconv.ParseBool(cio.State)
+			return strconv.FormatBool(!b)
+		}
+
+	case CalaosGuiTypeShutterSmart:
+		position := cio.State[strings.LastIndex(cio.State, " ")+1:]
+		switch {
+		case value == "up":
+			return "stop 0"
+		case value == "down":
+			return "stop 100"
+		case value == "stop":
+			return "stop " + position
+		case strings.HasPrefix(value, "set "):
+			return "stop " + strings.TrimPrefix(value, "set ")
+		}
+	}
+	return value
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+const fakeHomeFile = "testdata/home.json"
+
+// startFakeCalaos serves testdata/home.json with the user and password of setupBridgeTest
+func startFakeCalaos(t *testing.T) (*FakeCalaos, string) {
+	h, err := LoadFakeHome(fakeHomeFile)
+	require.NoError(t, err)
+	fake := NewFakeCalaos(h, "user", "pass")
+	url, err := fake.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(fake.Close)
+	return fake, url
+}
+
+// withState runs f holding stateMu
+func withState(f func()) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	f()
+}
+
+// startTestBridge runs the bridge against the Calaos server at url, as main does
+func startTestBridge(t *testing.T, url string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	withState(func() {
+		hapStorePath = t.TempDir()
+		config = setupTestConfig()
+		config.PinCode = "63613161"
+		config.WebSocketServer = WebSocketConfig{URL: url, User: "user", Password: "pass"}
+		setConfigDefaults(&config)
+		status = newBridgeStatus()
+		home = CalaosJsonMsgHome{}
+		accessories = nil
+		loggedin = false
+		hapServerStarted = false
+		websocketClient = NewWebSocketClient(url, nil, nil, func() { connectedCb(ctx) })
+	})
+	websocketClient.Start()
+
+	t.Cleanup(func() {
+		websocketClient.Stop()
+		withState(stopHAPServer)
+		cancel()
+	})
+}
+
+// waitLoggedIn waits for the bridge to log in and expose the home
+func waitLoggedIn(t *testing.T) {
+	require.Eventually(t, func() bool {
+		ready := false
+		withState(func() { ready = status.State() == StateLoggedIn && len(accessories) > 0 })
+		return ready
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLoadFakeHome(t *testing.T) {
+	h, err := LoadFakeHome(fakeHomeFile)
+	require.NoError(t, err)
+	assert.Len(t, h.Data.Home, 2)
+
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	require.NoError(t, os.WriteFile(empty, []byte(`{"data": {"home": []}}`), 0600))
+	_, err = LoadFakeHome(empty)
+	assert.ErrorContains(t, err, "no rooms")
+
+	_, err = LoadFakeHome(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestFakeCalaos_Protocol(t *testing.T) {
+	fake, url := startFakeCalaos(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Nothing is answered before logging in
+	cfg := setupTestConfig()
+	cfg.WebSocketServer.User, cfg.WebSocketServer.Password = "user", "wrong"
+	cfg.Login.Timeout.Duration = time.Second
+	assert.ErrorIs(t, loginOnce(conn, cfg), ErrLoginRejected)
+	_, err = getHomeOnce(conn, 100*time.Millisecond)
+	assert.Error(t, err)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	cfg.WebSocketServer.Password = "pass"
+	require.NoError(t, loginOnce(conn, cfg))
+	data, err := getHomeOnce(conn, time.Second)
+	require.NoError(t, err)
+	var h CalaosJsonMsgHome
+	require.NoError(t, json.Unmarshal(data, &h))
+	assert.Equal(t, "Living room", h.Data.Home[0].Name)
+
+	readEvent := func() CalaosJsonMsgEvent {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var event CalaosJsonMsgEvent
+		require.NoError(t, json.Unmarshal(data, &event))
+		require.Equal(t, CalaosMsgTypeEvent, event.Msg)
+		return event
+	}
+
+	// set_state is reflected as an event
+	var setState CalaosJsonSetState
+	setState.Msg, setState.MsgID = CalaosMsgTypeSetState, CalaosMsgIDUserCmd
+	setState.Data.Id, setState.Data.Value = "io_1", "set 40"
+	require.NoError(t, conn.WriteJSON(setState))
+	event := readEvent()
+	assert.Equal(t, "io_1", event.Data.Data.ID)
+	assert.Equal(t, "40", event.Data.Data.State)
+	assert.Equal(t, CalaosEventIOChanged, event.Data.TypeStr)
+	assert.Equal(t, []CalaosJsonSetState{setState}, fake.Commands())
+
+	// Changes made on Calaos are pushed
+	require.NoError(t, fake.SetState("io_3", "19.5"))
+	event = readEvent()
+	assert.Equal(t, "io_3", event.Data.Data.ID)
+	assert.Equal(t, "19.5", event.Data.Data.State)
+	assert.Error(t, fake.SetState("io_42", "true"))
+}
+
+func TestFakeCalaosState(t *testing.T) {
+	dimmer := CalaosIO{GuiType: CalaosGuiTypeLightDimmer, State: "0"}
+	light := CalaosIO{GuiType: CalaosGuiTypeLight, State: "false"}
+	shutter := CalaosIO{GuiType: CalaosGuiTypeShutterSmart, State: "stop 30"}
+
+	assert.Equal(t, "55", fakeCalaosState(dimmer, "set 55"))
+	assert.Equal(t, "100", fakeCalaosState(dimmer, "true"))
+	assert.Equal(t, "100", fakeCalaosState(dimmer, "toggle"))
+	assert.Equal(t, "0", fakeCalaosState(dimmer, "false"))
+	assert.Equal(t, "true", fakeCalaosState(light, "true"))
+	assert.Equal(t, "true", fakeCalaosState(light, "toggle"))
+	assert.Equal(t, "stop 0", fakeCalaosState(shutter, "up"))
+	assert.Equal(t, "stop 100", fakeCalaosState(shutter, "down"))
+	assert.Equal(t, "stop 30", fakeCalaosState(shutter, "stop"))
+	assert.Equal(t, "stop 70", fakeCalaosState(shutter, "set 70"))
+	assert.Equal(t, "12", fakeCalaosState(CalaosIO{GuiType: "var_int"}, "12"))
+}
+
+func TestBridge_FakeCalaos(t *testing.T) {
+	fake, url := startFakeCalaos(t)
+	startTestBridge(t, url)
+	waitLoggedIn(t)
+
+	lamp := uint64(murmur.Sum32("io_2"))
+	withState(func() {
+		assert.Len(t, accessories, 4)
+		assert.Contains(t, skippedIOs, "io_5")
+		assert.True(t, hapServerStarted)
+	})
+
+	// A command from HomeKit reaches Calaos, which confirms it with an event
+	withState(func() {
+		req := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+		accessories[lamp].(*LightDimmer).Lightbulb.Lightbulb.On.SetValueRequest(true, req)
+	})
+	require.Eventually(t, func() bool {
+		state, _ := fake.State("io_2")
+		return state == "true"
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		state := ""
+		withState(func() { state = getIOFromId("io_2").State })
+		return state == "true"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// A change made on Calaos updates the accessory
+	require.NoError(t, fake.SetState("io_3", "18.5"))
+	require.Eventually(t, func() bool {
+		value := 0.0
+		withState(func() {
+			value = accessories[uint64(murmur.Sum32("io_3"))].(*Temp).TempSensor.CurrentTemperature.Value()
+		})
+		return value == 18.5
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestBridge_Reconnects(t *testing.T) {
+	fake, url := startFakeCalaos(t)
+	startTestBridge(t, url)
+	waitLoggedIn(t)
+	generation := websocketClient.Generation()
+
+	fake.DropClients()
+	require.Eventually(t, func() bool {
+		return websocketClient.Generation() > generation && status.State() == StateLoggedIn
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The new session gets events
+	require.NoError(t, fake.SetState("io_1", "25"))
+	require.Eventually(t, func() bool {
+		value := 0
+		withState(func() {
+			value = accessories[uint64(murmur.Sum32("io_1"))].(*LightDimmer).Brightness.Value()
+		})
+		return value == 25
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestBridge_LoginRejected(t *testing.T) {
+	fake, url := startFakeCalaos(t)
+	fake.Password = "other"
+	startTestBridge(t, url)
+	withState(func() { config.Login.RetryDelay.Duration = time.Hour })
+
+	require.Eventually(t, func() bool {
+		return status.State() == StateAuthFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	t.Cleanup(stopLoginTimer)
+}
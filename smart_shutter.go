@@ -20,8 +20,12 @@ type SmartShutter struct {
 	*accessory.WindowCovering
 	HoldPosition *characteristic.HoldPosition
 	Name         *characteristic.Name
+
+	logger *log.Entry
 }
 
+var LogComponentSmartShutter = registerLogComponent("smart_shutter")
+
 /*
 	TargetPosition :
 	This characteristic describes the target position of accessories.
@@ -57,7 +61,7 @@ type SmartShutter struct {
 */
 
 func NewSmartShutter(cio CalaosIO, id uint64) *SmartShutter {
-	acc := SmartShutter{}
+	acc := SmartShutter{logger: accessoryLogger(LogComponentSmartShutter, cio, id)}
 
 	info := accessory.Info{
 		Name:         cio.Name,
@@ -80,14 +84,14 @@ func NewSmartShutter(cio CalaosIO, id uint64) *SmartShutter {
 	acc.WindowCovering.WindowCovering.TargetPosition.OnValueRemoteUpdate(func(targetPosition int) {
 		//TODO: we should retrieve current position from cio object to compare, not from homekit
 		currentPosition := acc.WindowCovering.WindowCovering.CurrentPosition.Val
-		log.Debug("current position : ", currentPosition, " target position : ", targetPosition)
+		acc.logger.Debug("current position : ", currentPosition, " target position : ", targetPosition)
 		if targetPosition != currentPosition {
 			// calaos and homekit shutter position values are inverted
 			// calaos open = 0, closed = 100
 			// homekit open = 100, closed = 0
 			// we need to convert from homekit value to calaos with : 100 - x
 			state := "set " + strconv.Itoa(100-targetPosition)
-			log.Debug(state)
+			acc.logger.Debug(state)
 			cio.State = state
 			CalaosUpdate(cio)
 		}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Bridge connection states
+const (
+	StateConnecting   = "connecting"
+	StateLoggingIn    = "logging_in"
+	StateLoggedIn     = "logged_in"
+	StateAuthFailed   = "auth_failed"
+	StateLoginTimeout = "login_timeout"
+)
+
+// BridgeStatus tracks the state of the Calaos session for health reporting
+type BridgeStatus struct {
+	mu            sync.Mutex
+	state         string
+	lastError     string
+	since         time.Time
+	offlineSince  time.Time // when the bridge was last logged in, zero while logged in
+	loginFailures int
+}
+
+// StatusSnapshot is a copy of the bridge status at a given time
+type StatusSnapshot struct {
+	State         string    `json:"state"`
+	LastError     string    `json:"last_error,omitempty"`
+	Since         time.Time `json:"since"`
+	OfflineSince  time.Time `json:"offline_since"`
+	LoginFailures int       `json:"login_failures"`
+}
+
+var status = newBridgeStatus()
+
+func newBridgeStatus() *BridgeStatus {
+	now := time.Now()
+	return &BridgeStatus{state: StateConnecting, since: now, offlineSince: now}
+}
+
+// Set changes the current state, err is kept as the last error when not nil
+func (s *BridgeStatus) Set(state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != state {
+		s.since = time.Now()
+		if state == StateLoggedIn {
+			s.offlineSince = time.Time{}
+		} else if s.state == StateLoggedIn {
+			s.offlineSince = s.since
+		}
+	}
+	s.state = state
+	setBridgeStateMetric(state)
+	if err != nil {
+		s.lastError = err.Error()
+	} else if state == StateLoggedIn {
+		s.lastError = ""
+	}
+}
+
+func (s *BridgeStatus) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// LoginFailed records a rejected login and returns the number of consecutive failures
+func (s *BridgeStatus) LoginFailed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginFailures++
+	return s.loginFailures
+}
+
+func (s *BridgeStatus) ResetLoginFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginFailures = 0
+}
+
+func (s *BridgeStatus) Snapshot() StatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StatusSnapshot{
+		State:         s.state,
+		LastError:     s.lastError,
+		Since:         s.since,
+		OfflineSince:  s.offlineSince,
+		LoginFailures: s.loginFailures,
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// State kept across restarts of the bridge, like the valve timers, is saved
+// as JSON files next to the HAP store.
+
+// readStoreFile decodes the file name of the HAP store directory into v, a
+// missing file leaves v unchanged
+func readStoreFile(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(hapStorePath, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeStoreFile saves v as the file name of the HAP store directory
+func writeStoreFile(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hapStorePath, 0750); err != nil {
+		return err
+	}
+	// Replace the file at once, a crash cannot leave it half written
+	tmp := filepath.Join(hapStorePath, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(hapStorePath, name))
+}
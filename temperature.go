@@ -3,17 +3,23 @@ package main
 import (
 	"strconv"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/brutella/hap/accessory"
 )
 
 type Temp struct {
 	*accessory.Thermometer
+
+	logger *log.Entry
 }
 
+var LogComponentTemperature = registerLogComponent("temperature")
+
 const TypeTemperatureSensor = "8A"
 
 func NewTemperatureSensor(cio CalaosIO, id uint64) *Temp {
-	acc := Temp{}
+	acc := Temp{logger: accessoryLogger(LogComponentTemperature, cio, id)}
 	info := accessory.Info{
 		Name:         cio.Name,
 		SerialNumber: cio.ID,
@@ -33,6 +39,7 @@ func NewTemperatureSensor(cio CalaosIO, id uint64) *Temp {
 }
 
 func (acc *Temp) Update(cio *CalaosIO) error {
+	acc.logger.Debug("update temperature ", cio.State)
 	t, err := strconv.ParseFloat(cio.State, 32)
 	if err == nil {
 		acc.TempSensor.CurrentTemperature.SetValue(t)
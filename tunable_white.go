@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+)
+
+// Color temperatures of the channels of tunable white lights, in mireds
+const (
+	DefaultTunableWhiteWarmMired = 370 // 2700 K
+	DefaultTunableWhiteColdMired = 153 // 6500 K
+)
+
+// TunableWhiteLightConfig describes a light, like a LED strip, whose warm and
+// cold white channels are two Calaos light_dimmer
+type TunableWhiteLightConfig struct {
+	Name      string // name shown in HomeKit, defaults to the name of the Warm IO
+	Warm      string // light_dimmer of the warm white channel
+	Cold      string // light_dimmer of the cold white channel
+	WarmMired int    // color temperature of the warm channel, in mireds, defaults to 370 (2700 K)
+	ColdMired int    // color temperature of the cold channel, in mireds, defaults to 153 (6500 K)
+}
+
+func (cfg TunableWhiteLightConfig) ios() []string {
+	return []string{cfg.Warm, cfg.Cold}
+}
+
+func (cfg TunableWhiteLightConfig) newAccessory(ios map[string]CalaosIO, id uint64) CalaosAccessory {
+	return NewTunableWhiteLight(cfg, ios, id)
+}
+
+// setTunableWhiteLightDefaults fills the optional fields of the TunableWhiteLights entries
+func setTunableWhiteLightDefaults(cfgs []TunableWhiteLightConfig) {
+	for i := range cfgs {
+		if cfgs[i].WarmMired == 0 {
+			cfgs[i].WarmMired = DefaultTunableWhiteWarmMired
+		}
+		if cfgs[i].ColdMired == 0 {
+			cfgs[i].ColdMired = DefaultTunableWhiteColdMired
+		}
+	}
+}
+
+// validateTunableWhiteLights checks the TunableWhiteLights section of the configuration
+func validateTunableWhiteLights(cfgs []TunableWhiteLightConfig) []error {
+	var errs []error
+	for i, cfg := range cfgs {
+		fail := func(field, msg string) {
+			errs = append(errs, &ConfigError{Field: fmt.Sprintf("TunableWhiteLights[%d].%s", i, field), Msg: msg})
+		}
+		if cfg.Warm == "" {
+			fail("Warm", "is required")
+		}
+		if cfg.Cold == "" {
+			fail("Cold", "is required")
+		}
+		if cfg.ColdMired < 50 || cfg.ColdMired > 1000 {
+			fail("ColdMired", "must be between 50 and 1000")
+		}
+		if cfg.WarmMired < 50 || cfg.WarmMired > 1000 {
+			fail("WarmMired", "must be between 50 and 1000")
+		} else if cfg.WarmMired <= cfg.ColdMired {
+			fail("WarmMired", "must be greater than ColdMired, warmer light has more mireds")
+		}
+	}
+	return errs
+}
+
+// TunableWhiteLight is a lightbulb with a color temperature, mixing a warm and
+// a cold channel. The channel closest to the color temperature is at the
+// brightness, the other one is dimmed down to mix the temperature, so that
+// both are at the brightness halfway between the channel temperatures.
+type TunableWhiteLight struct {
+	*accessory.Lightbulb
+	Brightness       *characteristic.Brightness
+	ColorTemperature *characteristic.ColorTemperature
+	Adaptive         *AdaptiveLighting
+
+	config TunableWhiteLightConfig
+	warm   CalaosIO
+	cold   CalaosIO
+	logger *log.Entry
+
+	mu         sync.Mutex
+	levels     map[string]int // level of the channels, 0 to 100
+	brightness int            // last brightness, kept while off
+	mired      int            // last color temperature, kept while off
+}
+
+var LogComponentTunableWhite = registerLogComponent("tunable_white")
+
+func NewTunableWhiteLight(cfg TunableWhiteLightConfig, ios map[string]CalaosIO, id uint64) *TunableWhiteLight {
+	warm := ios[cfg.Warm]
+	acc := TunableWhiteLight{
+		config:     cfg,
+		warm:       warm,
+		cold:       ios[cfg.Cold],
+		logger:     accessoryLogger(LogComponentTunableWhite, warm, id),
+		levels:     map[string]int{},
+		brightness: 100,
+		mired:      (cfg.WarmMired + cfg.ColdMired) / 2,
+	}
+	for _, ioID := range cfg.ios() {
+		acc.levels[ioID], _ = strconv.Atoi(ios[ioID].State)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = warm.Name
+	}
+	acc.Lightbulb = accessory.NewLightbulb(accessory.Info{
+		Name:         name,
+		SerialNumber: warm.ID,
+		Manufacturer: "Calaos",
+		Model:        warm.IoType,
+	})
+	acc.Lightbulb.Id = id
+
+	acc.Brightness = characteristic.NewBrightness()
+	acc.ColorTemperature = characteristic.NewColorTemperature()
+	acc.ColorTemperature.SetMinValue(cfg.ColdMired)
+	acc.ColorTemperature.SetMaxValue(cfg.WarmMired)
+	acc.Lightbulb.Lightbulb.AddC(acc.Brightness.C)
+	acc.Lightbulb.Lightbulb.AddC(acc.ColorTemperature.C)
+	acc.Adaptive = newAdaptiveLighting(acc.Lightbulb.A, acc.Lightbulb.Lightbulb.S, acc.Brightness, acc.ColorTemperature, func(mired int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.setColorTemperature(mired)
+	}, acc.logger)
+
+	acc.show()
+	acc.Adaptive.resume()
+
+	acc.Lightbulb.Lightbulb.On.OnValueRemoteUpdate(func(on bool) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if !on {
+			acc.setLevels(0, 0)
+			return
+		}
+		if acc.levels[cfg.Warm] == 0 && acc.levels[cfg.Cold] == 0 {
+			acc.adapt(acc.brightness)
+			acc.setLevels(acc.mix(acc.brightness, acc.mired))
+		}
+	})
+	acc.Brightness.OnValueRemoteUpdate(func(brightness int) {
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		if brightness > 0 {
+			acc.brightness = brightness
+		}
+		acc.adapt(brightness)
+		acc.setLevels(acc.mix(brightness, acc.mired))
+	})
+	acc.ColorTemperature.OnValueRemoteUpdate(func(mired int) {
+		// Setting the temperature by hand turns Adaptive Lighting off
+		acc.Adaptive.Stop()
+		acc.mu.Lock()
+		defer acc.mu.Unlock()
+		acc.setColorTemperature(mired)
+	})
+
+	return &acc
+}
+
+// mix returns the levels of the warm and cold channels giving brightness at mired
+func (acc *TunableWhiteLight) mix(brightness, mired int) (int, int) {
+	// Share of warm light, from 0 for the cold channel alone to 1 for the warm one
+	warmth := float64(mired-acc.config.ColdMired) / float64(acc.config.WarmMired-acc.config.ColdMired)
+	warmth = min(max(warmth, 0), 1)
+	warm := math.Round(float64(brightness) * min(1, 2*warmth))
+	cold := math.Round(float64(brightness) * min(1, 2*(1-warmth)))
+	return int(warm), int(cold)
+}
+
+// unmix returns the brightness and color temperature of the channel levels, the reverse of mix
+func (acc *TunableWhiteLight) unmix(warm, cold int) (int, int) {
+	brightness := max(warm, cold)
+	if brightness == 0 {
+		return 0, acc.mired
+	}
+	warmth := 0.5 * float64(warm) / float64(brightness)
+	if warm >= cold {
+		warmth = 1 - 0.5*float64(cold)/float64(brightness)
+	}
+	mired := float64(acc.config.ColdMired) + warmth*float64(acc.config.WarmMired-acc.config.ColdMired)
+	return brightness, int(math.Round(mired))
+}
+
+// adapt sets the color temperature of the Adaptive Lighting curve at
+// brightness, if it is on, the caller holds mu
+func (acc *TunableWhiteLight) adapt(brightness int) {
+	if mired, ok := acc.Adaptive.Temperature(brightness); ok {
+		acc.mired = mired
+		acc.ColorTemperature.SetValue(mired)
+	}
+}
+
+// setColorTemperature sends the levels of mired at the current brightness, the caller holds mu
+func (acc *TunableWhiteLight) setColorTemperature(mired int) {
+	acc.mired = mired
+	if acc.levels[acc.config.Warm] == 0 && acc.levels[acc.config.Cold] == 0 {
+		// Applied when turned on
+		return
+	}
+	acc.setLevels(acc.mix(acc.brightness, mired))
+}
+
+// setLevels sends the level of both channels, the caller holds mu
+func (acc *TunableWhiteLight) setLevels(warm, cold int) {
+	acc.logger.Debugf("Setting warm channel to %d and cold channel to %d", warm, cold)
+	for _, channel := range []struct {
+		cio   CalaosIO
+		level int
+	}{{acc.warm, warm}, {acc.cold, cold}} {
+		cio := channel.cio
+		cio.State = "set " + strconv.Itoa(channel.level)
+		CalaosUpdate(cio)
+	}
+}
+
+// show sets the characteristics from the channel levels, the caller holds mu
+func (acc *TunableWhiteLight) show() {
+	brightness, mired := acc.unmix(acc.levels[acc.config.Warm], acc.levels[acc.config.Cold])
+	if brightness > 0 {
+		acc.brightness, acc.mired = brightness, mired
+	}
+	// Off shows the brightness and temperature it is turned on at
+	acc.Lightbulb.Lightbulb.On.SetValue(brightness > 0)
+	acc.Brightness.SetValue(acc.brightness)
+	acc.ColorTemperature.SetValue(acc.mired)
+}
+
+func (acc *TunableWhiteLight) Update(cio *CalaosIO) error {
+	level, err := strconv.Atoi(cio.State)
+	if err != nil {
+		return err
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	acc.levels[cio.ID] = level
+	acc.show()
+	return nil
+}
+
+func (acc *TunableWhiteLight) stop() {
+	// The light built again resumes the transition
+	acc.Adaptive.halt()
+}
+
+func (acc *TunableWhiteLight) AccessoryGet() *accessory.A {
+	return acc.Lightbulb.A
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vcaesar/murmur"
+)
+
+// setupLedStripHome adds a LED strip with warm and cold channels, off, to the test home
+func setupLedStripHome() CalaosJsonMsgHome {
+	h := setupTestHome()
+	h.Data.Home = append(h.Data.Home, CalaosHome{
+		Name: "Kitchen",
+		IOs: []CalaosIO{
+			{ID: "strip-warm", Name: "Kitchen strip", GuiType: "light_dimmer", IoType: "output", Visible: "true", State: "0"},
+			{ID: "strip-cold", Name: "Kitchen strip cold", GuiType: "light_dimmer", IoType: "output", Visible: "true", State: "0"},
+		},
+	})
+	return h
+}
+
+func newTestTunableWhiteLight(states map[string]string) *TunableWhiteLight {
+	cfgs := []TunableWhiteLightConfig{{Warm: "strip-warm", Cold: "strip-cold"}}
+	setTunableWhiteLightDefaults(cfgs)
+	return NewTunableWhiteLight(cfgs[0], homeIOs(setupLedStripHome(), states), uint64(murmur.Sum32("strip-warm")))
+}
+
+func TestTunableWhiteLight_Mix(t *testing.T) {
+	acc := newTestTunableWhiteLight(nil)
+	tests := []struct {
+		brightness, mired int
+		warm, cold        int
+	}{
+		{100, 370, 100, 0},
+		{100, 153, 0, 100},
+		{80, 262, 80, 80},
+		{60, 316, 60, 30},
+		{60, 207, 30, 60},
+		{0, 300, 0, 0},
+	}
+	for _, tt := range tests {
+		warm, cold := acc.mix(tt.brightness, tt.mired)
+		assert.Equal(t, []int{tt.warm, tt.cold}, []int{warm, cold}, "mix(%d, %d)", tt.brightness, tt.mired)
+		if tt.brightness == 0 {
+			continue
+		}
+		brightness, mired := acc.unmix(warm, cold)
+		assert.Equal(t, tt.brightness, brightness)
+		assert.InDelta(t, tt.mired, mired, 1)
+	}
+
+	// Out of range temperatures are clamped
+	warm, cold := acc.mix(50, 500)
+	assert.Equal(t, []int{50, 0}, []int{warm, cold})
+}
+
+func TestTunableWhiteLight(t *testing.T) {
+	commands := captureCommands(t)
+	acc := newTestTunableWhiteLight(map[string]string{"strip-warm": "40", "strip-cold": "80"})
+	bulb := acc.Lightbulb.Lightbulb
+	assert.Equal(t, "Kitchen strip", acc.AccessoryGet().Name())
+	assert.True(t, bulb.On.Value())
+	assert.Equal(t, 80, acc.Brightness.Value())
+	assert.Equal(t, 207, acc.ColorTemperature.Value())
+	assert.Equal(t, 153, acc.ColorTemperature.MinValue())
+	assert.Equal(t, 370, acc.ColorTemperature.MaxValue())
+
+	remoteSet(acc.ColorTemperature.C, 370)
+	assert.Equal(t, []string{"strip-warm=set 80", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "strip-warm", State: "80"}))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "strip-cold", State: "0"}))
+	assert.Equal(t, 370, acc.ColorTemperature.Value())
+
+	remoteSet(acc.Brightness.C, 50)
+	assert.Equal(t, []string{"strip-warm=set 50", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+
+	remoteSet(bulb.On.C, false)
+	assert.Equal(t, []string{"strip-warm=set 0", "strip-cold=set 0"}, nextCommands(t, commands, 2))
+	require.NoError(t, acc.Update(&CalaosIO{ID: "strip-warm", State: "0"}))
+	assert.False(t, bulb.On.Value())
+	assert.Equal(t, 50, acc.Brightness.Value())
+
+	// The temperature changed while off is applied when turned on
+	remoteSet(acc.ColorTemperature.C, 153)
+	remoteSet(bulb.On.C, true)
+	assert.Equal(t, []string{"strip-warm=set 0", "strip-cold=set 50"}, nextCommands(t, commands, 2))
+
+	assert.Error(t, acc.Update(&CalaosIO{ID: "strip-cold", State: "invalid"}))
+}
@@ -2,70 +2,142 @@ package main
 
 import (
 	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 var ErrNotConnected = errors.New("websocket is not connected")
 
+// WebSocketRetryDelay is the delay between two connection attempts
+var WebSocketRetryDelay = 10 * time.Second
+
+var wsLog = componentLogger(LogComponentWebSocket)
+
 type WebSocketClient struct {
-	isConnected bool
-	url         string
-	conn        *websocket.Conn
+	isConnected  atomic.Bool
+	reconnecting atomic.Bool // a connect loop is running
+	stopped      atomic.Bool // Stop was called, do not reconnect
+	settingsMu   sync.Mutex
+	url          string
+	dialer       *websocket.Dialer
+	header       http.Header
+	connMu       sync.Mutex
+	conn         *websocket.Conn
+	writeMu      sync.Mutex
 
 	connectedCb func()
+	generation  atomic.Uint64 // number of connections opened
 }
 
 func (ws *WebSocketClient) closeAndReconnect() {
 	ws.Close()
+	if ws.stopped.Load() || !ws.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
 	go func() {
 		ws.connect()
 	}()
 }
 
 func (ws *WebSocketClient) Close() {
-
+	ws.connMu.Lock()
 	if ws.conn != nil {
 		ws.conn.Close()
 	}
-	ws.isConnected = false
+	ws.isConnected.Store(false)
+	ws.connMu.Unlock()
+	metricWebSocketConnected.Set(0)
 }
 
-func Dial(url string, connectedCb func()) *WebSocketClient {
+// Stop closes the connection for good
+func (ws *WebSocketClient) Stop() {
+	ws.stopped.Store(true)
+	ws.Close()
+}
+
+// NewWebSocketClient returns a client calling connectedCb each time it connects, Start connects it
+func NewWebSocketClient(url string, dialer *websocket.Dialer, header http.Header, connectedCb func()) *WebSocketClient {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
 
-	ws := &WebSocketClient{
+	return &WebSocketClient{
 		url:         url,
+		dialer:      dialer,
+		header:      header,
 		connectedCb: connectedCb,
 	}
+}
 
+// Start connects in the background, retrying until it succeeds
+func (ws *WebSocketClient) Start() {
+	ws.reconnecting.Store(true)
 	go func() {
 		ws.connect()
 	}()
-
-	return ws
 }
 
 func (ws *WebSocketClient) connect() {
-	for {
-		var err error
-		ws.conn, _, err = websocket.DefaultDialer.Dial(ws.url, nil)
+	for !ws.stopped.Load() {
+		ws.settingsMu.Lock()
+		url, dialer, header := ws.url, ws.dialer, ws.header
+		ws.settingsMu.Unlock()
+		conn, _, err := dialer.Dial(url, header)
 		if err == nil {
-			ws.isConnected = true
+			ws.connMu.Lock()
+			ws.conn = conn
+			generation := ws.generation.Add(1)
+			ws.isConnected.Store(true)
+			ws.connMu.Unlock()
+			ws.reconnecting.Store(false)
+
+			metricWebSocketConnected.Set(1)
+			if generation > 1 {
+				metricWebSocketReconnects.Inc()
+			}
+			if ws.stopped.Load() {
+				ws.Close()
+				return
+			}
 			ws.connectedCb()
-			break
+			return
 		}
-		log.Errorf("Failed to dial WebSocket: %v", err)
-		time.Sleep(10 * time.Second)
+		wsLog.WithField("url", url).Errorf("Failed to dial WebSocket: %v", err)
+		time.Sleep(WebSocketRetryDelay)
 	}
+	ws.reconnecting.Store(false)
+}
+
+// Reconfigure changes the server settings and reconnects with them
+func (ws *WebSocketClient) Reconfigure(url string, dialer *websocket.Dialer, header http.Header) {
+	ws.settingsMu.Lock()
+	ws.url, ws.dialer, ws.header = url, dialer, header
+	ws.settingsMu.Unlock()
+	// The reader fails on the closed connection and reconnects
+	ws.Close()
+}
 
+// currentConn returns the open connection, nil when not connected
+func (ws *WebSocketClient) currentConn() *websocket.Conn {
+	ws.connMu.Lock()
+	defer ws.connMu.Unlock()
+	if !ws.isConnected.Load() {
+		return nil
+	}
+	return ws.conn
 }
 
 func (ws *WebSocketClient) WriteMessage(messageType int, data []byte) error {
 	err := ErrNotConnected
-	if ws.IsConnected() {
-		err = ws.conn.WriteMessage(messageType, data)
+	if conn := ws.currentConn(); conn != nil {
+		// gorilla/websocket supports a single concurrent writer
+		ws.writeMu.Lock()
+		err = conn.WriteMessage(messageType, data)
+		ws.writeMu.Unlock()
 		if err != nil {
 			ws.closeAndReconnect()
 		}
@@ -77,8 +149,8 @@ func (ws *WebSocketClient) WriteMessage(messageType int, data []byte) error {
 func (ws *WebSocketClient) ReadMessage() (messageType int, message []byte, err error) {
 	err = ErrNotConnected
 
-	if ws.IsConnected() {
-		messageType, message, err = ws.conn.ReadMessage()
+	if conn := ws.currentConn(); conn != nil {
+		messageType, message, err = conn.ReadMessage()
 		if err != nil {
 			ws.closeAndReconnect()
 		}
@@ -87,6 +159,11 @@ func (ws *WebSocketClient) ReadMessage() (messageType int, message []byte, err e
 	return
 }
 
+// Generation identifies the current connection, it changes on every reconnection
+func (ws *WebSocketClient) Generation() uint64 {
+	return ws.generation.Load()
+}
+
 func (ws *WebSocketClient) IsConnected() bool {
-	return ws.isConnected
+	return ws.isConnected.Load()
 }